@@ -0,0 +1,320 @@
+package admin
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type GroupMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// Group is a set of users that owns a team folder with its own quota.
+type Group struct {
+	Name      string        `json:"name"`
+	FolderUID string        `json:"folder_UID"`
+	Used      int64         `json:"used"`
+	Quota     int64         `json:"quota"`
+	Members   []GroupMember `json:"members"`
+	CreatedAt string        `json:"created_at"`
+	uid       string
+}
+
+// Member roles are the access members get to the group's folders.
+var groupRoles = map[string]bool{"viewer": true, "editor": true, "manager": true}
+
+func groupUID(db *sql.DB, name string) (string, error) {
+	var uid string
+	err := db.QueryRow(`SELECT UID FROM groups WHERE name = ?`, name).Scan(&uid)
+	return uid, err
+}
+
+// CreateGroup adds a group and its team folder. Quota is in bytes, 0 for unlimited.
+func CreateGroup(name string, quota int64) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 400, fmt.Errorf("group name is required")
+	}
+	if quota < 0 {
+		return 400, fmt.Errorf("quota must not be negative")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	if _, err := groupUID(db, name); err == nil {
+		return 409, fmt.Errorf("group already exists")
+	} else if err != sql.ErrNoRows {
+		l.LogMessage(l.ERROR, "Group lookup failed: "+err.Error())
+		return 500, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return 500, err
+	}
+	defer tx.Rollback()
+
+	// The team folder is the group's root folder, owned by the group itself
+	uid := uuid.New().String()
+	if _, err := tx.Exec(`INSERT INTO groups (UID, name, quota, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)`, uid, name, quota); err != nil {
+		l.LogMessage(l.ERROR, "Insert query failed: "+err.Error())
+		return 500, err
+	}
+	_, err = tx.Exec(`INSERT INTO folders (UID, user_UID, name, parent_id, created_at) VALUES (?, ?, ?, NULL, CURRENT_TIMESTAMP)`, uuid.New().String(), uid, name)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Team folder creation failed: "+err.Error())
+		return 500, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return 500, err
+	}
+
+	return 200, nil
+}
+
+// DelGroup removes a group, its memberships and the access granted to it.
+// Groups that still own files must be emptied first.
+func DelGroup(name string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	uid, err := groupUID(db, name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 404, fmt.Errorf("group not found")
+		}
+		l.LogMessage(l.ERROR, "Group lookup failed: "+err.Error())
+		return 500, err
+	}
+
+	var hasFiles bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM files f JOIN folders fo ON f.folder_id = fo.UID WHERE fo.user_UID = ?)`, uid).Scan(&hasFiles)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return 500, err
+	}
+	if hasFiles {
+		return 409, fmt.Errorf("group still owns files")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return 500, err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM folder_acl WHERE grantee_type = 'group' AND grantee_UID = ?`,
+		`DELETE FROM folder_acl WHERE folder_UID IN (SELECT UID FROM folders WHERE user_UID = ?)`,
+		`DELETE FROM trash WHERE user_UID = ?`,
+		`DELETE FROM folders WHERE user_UID = ?`,
+		`DELETE FROM group_members WHERE group_UID = ?`,
+		`DELETE FROM groups WHERE UID = ?`,
+	} {
+		if _, err := tx.Exec(query, uid); err != nil {
+			l.LogMessage(l.ERROR, "Delete query failed: "+err.Error())
+			return 500, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return 500, err
+	}
+
+	return 200, nil
+}
+
+// AddGroupMember adds a user to a group, or changes the role of a member.
+func AddGroupMember(group, usr, role string) (int, error) {
+	if role == "" {
+		role = "editor"
+	}
+	if !groupRoles[role] {
+		return 400, fmt.Errorf("role must be viewer, editor or manager")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	gid, err := groupUID(db, group)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 404, fmt.Errorf("group not found")
+		}
+		l.LogMessage(l.ERROR, "Group lookup failed: "+err.Error())
+		return 500, err
+	}
+
+	var userUID string
+	err = db.QueryRow(`SELECT UID FROM users WHERE username = ?`, usr).Scan(&userUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 404, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return 500, err
+	}
+
+	insertQuery := `INSERT INTO group_members (group_UID, user_UID, role, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (group_UID, user_UID) DO UPDATE SET role = excluded.role`
+	if _, err := db.Exec(insertQuery, gid, userUID, role); err != nil {
+		l.LogMessage(l.ERROR, "Insert query failed: "+err.Error())
+		return 500, err
+	}
+
+	return 200, nil
+}
+
+// RemoveGroupMember takes a user out of a group.
+func RemoveGroupMember(group, usr string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM group_members
+		WHERE group_UID = (SELECT UID FROM groups WHERE name = ?)
+		AND user_UID = (SELECT UID FROM users WHERE username = ?)`, group, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Delete query failed: "+err.Error())
+		return 500, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to get affected rows: "+err.Error())
+		return 500, err
+	}
+
+	if rowsAffected == 0 {
+		return 404, fmt.Errorf("member not found")
+	}
+
+	return 200, nil
+}
+
+func SetGroupQuota(group string, quota int64) (int, error) {
+	if quota < 0 {
+		return 400, fmt.Errorf("quota must not be negative")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	res, err := db.Exec(`UPDATE groups SET quota = ? WHERE name = ?`, quota, group)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return 500, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to get affected rows: "+err.Error())
+		return 500, err
+	}
+
+	if rowsAffected == 0 {
+		return 404, fmt.Errorf("group not found")
+	}
+
+	return 200, nil
+}
+
+// ListGroups returns every group with its members, team folder and usage.
+func ListGroups() ([]Group, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT g.UID, g.name, g.quota, g.created_at,
+			COALESCE((SELECT UID FROM folders WHERE user_UID = g.UID AND parent_id IS NULL), ''),
+			COALESCE((SELECT SUM(f.size) FROM files f
+			JOIN folders fo ON f.folder_id = fo.UID
+			WHERE fo.user_UID = g.UID), 0) + COALESCE((SELECT SUM(v.size) FROM file_versions v
+			JOIN files f ON v.file_id = f.id
+			JOIN folders fo ON f.folder_id = fo.UID
+			WHERE fo.user_UID = g.UID), 0)
+		FROM groups g ORDER BY g.name`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	index := map[string]int{}
+	for rows.Next() {
+		var g Group
+		var createdAt sql.NullString
+		if err := rows.Scan(&g.uid, &g.Name, &g.Quota, &createdAt, &g.FolderUID, &g.Used); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return nil, err
+		}
+		g.CreatedAt = createdAt.String
+		g.Members = []GroupMember{}
+		index[g.uid] = len(groups)
+		groups = append(groups, g)
+	}
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return nil, err
+	}
+
+	memberRows, err := db.Query(`SELECT m.group_UID, u.username, m.role FROM group_members m
+		JOIN users u ON m.user_UID = u.UID ORDER BY u.username`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return nil, err
+	}
+	defer memberRows.Close()
+
+	for memberRows.Next() {
+		var gid string
+		var m GroupMember
+		if err := memberRows.Scan(&gid, &m.Username, &m.Role); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return nil, err
+		}
+		if i, ok := index[gid]; ok {
+			groups[i].Members = append(groups[i].Members, m)
+		}
+	}
+	if err = memberRows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return nil, err
+	}
+
+	return groups, nil
+}
@@ -2,8 +2,10 @@ package admin
 
 import (
 	"GoStore/auth"
+	"GoStore/client"
 	l "GoStore/log"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -29,45 +31,60 @@ func updateEnv(key, value string) error {
 	return os.WriteFile(".env", []byte(strings.Join(envData, "\n")), 0644)
 }
 
-func AdminLoginCred(usr, pwd string) (bool, bool, string) {
+// AdminLoginCred checks the credentials of a user with an administrative
+// role. It returns whether they are valid, whether the default credentials
+// still have to be changed, and otherwise the result of the login: the
+// tokens of a new session or an MFA token for the second step. The error is
+// auth.ErrSecondFactorLocked while the user is locked out of the second step.
+func AdminLoginCred(usr, pwd string) (bool, bool, auth.LoginResult, error) {
 	db, err := sql.Open("sqlite3", "main.db")
 	if err != nil {
 		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
-		return false, false, ""
+		return false, false, auth.LoginResult{}, nil
 	}
 	defer db.Close()
 
 	var storedPwd string
 	var firstLogin bool
 
-	query := `SELECT pwd, default_cred FROM ADMIN WHERE user = ?`
+	query := `SELECT pwd, must_change_pwd FROM users WHERE username = ?`
 	err = db.QueryRow(query, usr).Scan(&storedPwd, &firstLogin)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, false, ""
+			return false, false, auth.LoginResult{}, nil
 		}
 		l.LogMessage(l.ERROR, "Query error: "+err.Error())
-		return false, false, ""
+		return false, false, auth.LoginResult{}, nil
 	}
 
 	if err = bcrypt.CompareHashAndPassword([]byte(storedPwd), []byte(pwd)); err != nil {
-		return false, false, ""
+		return false, false, auth.LoginResult{}, nil
+	}
+
+	perms, err := auth.UserPermissions(usr)
+	if err != nil || !auth.IsAdministrative(perms) {
+		return false, false, auth.LoginResult{}, nil
 	}
 
 	if firstLogin {
 		// If it's the first login, do not generate a session token
-		return true, true, ""
+		return true, true, auth.LoginResult{}, nil
 	}
 
-	JWTToken, err := auth.GenerateTokenJWT(usr, pwd)
+	result, err := auth.StartLogin(auth.SessionAdmin, usr)
+	if errors.Is(err, auth.ErrSecondFactorLocked) {
+		return false, false, auth.LoginResult{}, err
+	}
 	if err != nil {
-		l.LogMessage(l.ERROR, "GenerateToken failed: "+err.Error())
-		return false, false, ""
+		l.LogMessage(l.ERROR, "Session creation failed: "+err.Error())
+		return false, false, auth.LoginResult{}, nil
 	}
 
-	return true, false, JWTToken
+	return true, false, result, nil
 }
 
+// IfFirstLogin replaces the default admin/admin credentials of the first
+// owner.
 func IfFirstLogin(newUSR, newPWD string) (int, error) {
 	db, err := sql.Open("sqlite3", "main.db")
 	if err != nil {
@@ -77,7 +94,7 @@ func IfFirstLogin(newUSR, newPWD string) (int, error) {
 	defer db.Close()
 
 	var defaultCred bool
-	err = db.QueryRow(`SELECT default_cred FROM ADMIN WHERE user = ?`, "admin").Scan(&defaultCred)
+	err = db.QueryRow(`SELECT must_change_pwd FROM users WHERE username = ?`, "admin").Scan(&defaultCred)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return 404, fmt.Errorf("admin user not found")
@@ -90,13 +107,24 @@ func IfFirstLogin(newUSR, newPWD string) (int, error) {
 		return 409, fmt.Errorf("default credentials already changed")
 	}
 
+	if newUSR != "admin" {
+		var taken bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, newUSR).Scan(&taken); err != nil {
+			l.LogMessage(l.ERROR, "Query error: "+err.Error())
+			return 500, err
+		}
+		if taken {
+			return 409, fmt.Errorf("username already taken")
+		}
+	}
+
 	hashedPwd, err := bcrypt.GenerateFromPassword([]byte(newPWD), bcrypt.DefaultCost)
 	if err != nil {
 		l.LogMessage(l.ERROR, "Password hashing failed: "+err.Error())
 		return 500, err
 	}
 
-	stmt, err := db.Prepare(`UPDATE ADMIN SET user = ?, pwd = ?, default_cred = 0 WHERE user = ?`)
+	stmt, err := db.Prepare(`UPDATE users SET username = ?, pwd = ?, must_change_pwd = 0 WHERE username = ?`)
 	if err != nil {
 		l.LogMessage(l.ERROR, "Statement preparation failed: "+err.Error())
 		return 500, err
@@ -111,6 +139,11 @@ func IfFirstLogin(newUSR, newPWD string) (int, error) {
 
 	updateEnv("DEFAULT_CRED", "false")
 
+	// Nothing signed in with the default password may stay signed in
+	if err := auth.RevokeSessions("admin"); err != nil {
+		return 500, err
+	}
+
 	return 200, nil
 }
 func DelUser(usr string) (int, error) {
@@ -121,6 +154,29 @@ func DelUser(usr string) (int, error) {
 	}
 	defer db.Close()
 
+	lastOwner, err := isLastOwner(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return 500, err
+	}
+	if lastOwner {
+		return 409, fmt.Errorf("cannot delete the last owner")
+	}
+
+	// Drop the folder access, group memberships, roles and recovery codes of the user before the user goes away
+	for _, query := range []string{
+		`DELETE FROM folder_acl WHERE grantee_type = 'user' AND grantee_UID IN (SELECT UID FROM users WHERE username = ?)`,
+		`DELETE FROM group_members WHERE user_UID IN (SELECT UID FROM users WHERE username = ?)`,
+		`DELETE FROM user_roles WHERE user_UID IN (SELECT UID FROM users WHERE username = ?)`,
+		`DELETE FROM recovery_codes WHERE user_UID IN (SELECT UID FROM users WHERE username = ?)`,
+		`DELETE FROM access_tokens WHERE user_UID IN (SELECT UID FROM users WHERE username = ?)`,
+	} {
+		if _, err := db.Exec(query, usr); err != nil {
+			l.LogMessage(l.ERROR, "Access removal failed: "+err.Error())
+			return 500, err
+		}
+	}
+
 	stmt, err := db.Prepare(`DELETE FROM users WHERE username = ?`)
 	if err != nil {
 		l.LogMessage(l.ERROR, "Statement preparation failed: "+err.Error())
@@ -144,9 +200,26 @@ func DelUser(usr string) (int, error) {
 		return 404, fmt.Errorf("user not found")
 	}
 
+	// Tokens of a deleted user must not keep working until they expire
+	if err := auth.RevokeSessions(usr); err != nil {
+		return 500, err
+	}
+	client.ForgetDAVCredentials(usr)
+
 	return 200, nil
 }
-func AddUser(usr, pwd string) (int, error) {
+
+// AddUser creates a user with the given roles, or with auth.DefaultRole when
+// none are given.
+func AddUser(usr, pwd string, roles []string) (int, error) {
+	if len(roles) == 0 {
+		roles = []string{auth.DefaultRole}
+	}
+	for _, role := range roles {
+		if _, ok := auth.Roles[role]; !ok {
+			return 400, fmt.Errorf("unknown role %q", role)
+		}
+	}
 
 	db, err := sql.Open("sqlite3", "main.db")
 	if err != nil {
@@ -184,6 +257,13 @@ func AddUser(usr, pwd string) (int, error) {
 		return 500, err
 	}
 
+	for _, role := range roles {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO user_roles (user_UID, role) VALUES (?, ?)`, uid, role); err != nil {
+			l.LogMessage(l.ERROR, "Insert query failed: "+err.Error())
+			return 500, err
+		}
+	}
+
 	return 200, nil
 }
 
@@ -220,33 +300,80 @@ func ListUsers() ([]string, error) {
 	return users, nil
 }
 
-func IsItAdmin(usr, token string) (bool, error) {
+type UserUsage struct {
+	Username string `json:"username"`
+	Used     int64  `json:"used"`
+	Quota    int64  `json:"quota"`
+}
+
+func SetQuota(usr string, quota int64) (int, error) {
+	if quota < 0 {
+		return 400, fmt.Errorf("quota must not be negative")
+	}
+
 	db, err := sql.Open("sqlite3", "main.db")
 	if err != nil {
 		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
-		return false, err
+		return 500, err
 	}
 	defer db.Close()
 
-	// Authenticate the token
-	isValid, claims := auth.AuthenticateTokenJWT(token)
-	if !isValid {
-		return false, fmt.Errorf("invalid token")
+	res, err := db.Exec(`UPDATE users SET quota = ? WHERE username = ?`, quota, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return 500, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to get affected rows: "+err.Error())
+		return 500, err
 	}
 
-	// Check if the user in the token matches the provided user
-	if claims.Username != usr {
-		return false, fmt.Errorf("token does not match the user")
+	if rowsAffected == 0 {
+		return 404, fmt.Errorf("user not found")
+	}
+
+	return 200, nil
+}
+
+// ListUsage returns the storage used by every user, including previous file
+// versions and files in their trash.
+func ListUsage() ([]UserUsage, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
 	}
+	defer db.Close()
 
-	// Check if the user has admin privileges
-	var isAdmin bool
-	query := `SELECT EXISTS(SELECT 1 FROM ADMIN WHERE user = ?)`
-	err = db.QueryRow(query, usr).Scan(&isAdmin)
+	rows, err := db.Query(`SELECT u.username, u.quota, COALESCE((SELECT SUM(f.size) FROM files f
+			JOIN folders fo ON f.folder_id = fo.UID
+			WHERE fo.user_UID = u.UID), 0) + COALESCE((SELECT SUM(v.size) FROM file_versions v
+			JOIN files f ON v.file_id = f.id
+			JOIN folders fo ON f.folder_id = fo.UID
+			WHERE fo.user_UID = u.UID), 0)
+		FROM users u ORDER BY u.username`)
 	if err != nil {
 		l.LogMessage(l.ERROR, "Query error: "+err.Error())
-		return false, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []UserUsage{}
+	for rows.Next() {
+		var u UserUsage
+		if err := rows.Scan(&u.Username, &u.Quota, &u.Used); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return nil, err
 	}
 
-	return isAdmin, nil
+	return usage, nil
 }
@@ -0,0 +1,131 @@
+package admin
+
+import (
+	"GoStore/auth"
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+)
+
+// isLastOwner reports whether usr is the only user with the owner role.
+func isLastOwner(db *sql.DB, usr string) (bool, error) {
+	var isOwner bool
+	var owners int
+	err := db.QueryRow(`SELECT
+		EXISTS(SELECT 1 FROM user_roles r JOIN users u ON u.UID = r.user_UID WHERE u.username = ? AND r.role = 'owner'),
+		(SELECT COUNT(*) FROM user_roles WHERE role = 'owner')`, usr).Scan(&isOwner, &owners)
+	if err != nil {
+		return false, err
+	}
+	return isOwner && owners == 1, nil
+}
+
+// IsPrivileged reports whether a user holds a role beyond file access. Only
+// users who can manage roles may delete or change such users.
+func IsPrivileged(usr string) (bool, error) {
+	perms, err := auth.UserPermissions(usr)
+	if err != nil {
+		return false, err
+	}
+	return auth.IsAdministrative(perms), nil
+}
+
+// ListUserRoles returns the roles of every user by username.
+func ListUserRoles() (map[string][]string, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT u.username, r.role FROM user_roles r JOIN users u ON u.UID = r.user_UID ORDER BY u.username, r.role`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := map[string][]string{}
+	for rows.Next() {
+		var username, role string
+		if err := rows.Scan(&username, &role); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return nil, err
+		}
+		roles[username] = append(roles[username], role)
+	}
+	return roles, rows.Err()
+}
+
+// GrantRole gives a user a role. Granting a role the user has is a no-op.
+func GrantRole(usr, role string) (int, error) {
+	if _, ok := auth.Roles[role]; !ok {
+		return 400, fmt.Errorf("unknown role %q", role)
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	var uid string
+	if err := db.QueryRow(`SELECT UID FROM users WHERE username = ?`, usr).Scan(&uid); err != nil {
+		if err == sql.ErrNoRows {
+			return 404, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return 500, err
+	}
+
+	if _, err := db.Exec(`INSERT OR IGNORE INTO user_roles (user_UID, role) VALUES (?, ?)`, uid, role); err != nil {
+		l.LogMessage(l.ERROR, "Insert query failed: "+err.Error())
+		return 500, err
+	}
+
+	l.LogMessage(l.INFO, "Granted role "+role+" to "+usr)
+	return 200, nil
+}
+
+// RevokeRole takes a role away from a user. The last owner keeps the owner
+// role, so that someone can always manage roles.
+func RevokeRole(usr, role string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	if role == "owner" {
+		lastOwner, err := isLastOwner(db, usr)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Query error: "+err.Error())
+			return 500, err
+		}
+		if lastOwner {
+			return 409, fmt.Errorf("cannot revoke the role of the last owner")
+		}
+	}
+
+	res, err := db.Exec(`DELETE FROM user_roles WHERE role = ? AND user_UID IN (SELECT UID FROM users WHERE username = ?)`, role, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Delete query failed: "+err.Error())
+		return 500, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to get affected rows: "+err.Error())
+		return 500, err
+	}
+
+	if rowsAffected == 0 {
+		return 404, fmt.Errorf("user does not have this role")
+	}
+
+	l.LogMessage(l.INFO, "Revoked role "+role+" from "+usr)
+	return 200, nil
+}
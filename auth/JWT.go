@@ -2,29 +2,54 @@ package auth
 
 import (
 	l "GoStore/log"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
-var jwtKey = []byte("my_secret_key")
+// Minutes an access token stays valid when ACCESS_TOKEN_TTL_MINUTES is not
+// set. Clients get a new one from their refresh token.
+const defaultAccessTokenTTLMinutes = 15
 
 type Claims struct {
 	Username string `json:"username"`
+	Kind     string `json:"kind"`
+	Session  string `json:"sid"`
 	jwt.StandardClaims
 }
 
-func GenerateTokenJWT(usr, pwd string) (string, error) {
-	expirationTime := time.Now().Add(100 * time.Hour)
+// accessTokenTTL is how long an access token stays valid after it is issued.
+func accessTokenTTL() time.Duration {
+	minutes := defaultAccessTokenTTLMinutes
+	if v, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_MINUTES")); err == nil && v > 0 {
+		minutes = v
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// generateTokenJWT signs an access token for a session.
+func generateTokenJWT(kind, usr, sessionID string) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Token signing failed: "+err.Error())
+		return "", err
+	}
+
+	expirationTime := time.Now().Add(accessTokenTTL())
 	claims := &Claims{
 		Username: usr,
+		Kind:     kind,
+		Session:  sessionID,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expirationTime.Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.Kid
+	tokenString, err := token.SignedString(key.signKey)
 	if err != nil {
 		l.LogMessage(l.ERROR, "Token signing failed: "+err.Error())
 		return "", err
@@ -33,12 +58,12 @@ func GenerateTokenJWT(usr, pwd string) (string, error) {
 	return tokenString, nil
 }
 
+// AuthenticateTokenJWT checks an access token's signature and expiry, and that
+// its session has not been revoked.
 func AuthenticateTokenJWT(tokenString string) (bool, *Claims) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, verificationKey)
 
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
@@ -46,7 +71,6 @@ func AuthenticateTokenJWT(tokenString string) (bool, *Claims) {
 			return false, nil
 		}
 		l.LogMessage(l.ERROR, "Token parsing failed: "+err.Error())
-		l.LogMessage(l.INFO, tokenString)
 		return false, nil
 	}
 
@@ -55,5 +79,10 @@ func AuthenticateTokenJWT(tokenString string) (bool, *Claims) {
 		return false, nil
 	}
 
+	if !sessionActive(claims) {
+		l.LogMessage(l.ERROR, "Token session is revoked or expired")
+		return false, nil
+	}
+
 	return true, claims
 }
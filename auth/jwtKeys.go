@@ -0,0 +1,473 @@
+package auth
+
+import (
+	l "GoStore/log"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key file used when JWT_KEY_FILE is not set.
+const defaultJWTKeyFile = "jwt_keys.json"
+
+// Algorithms keys can be generated for. HS256 keys are shared secrets, the
+// others let services that only have the public key verify tokens.
+var jwtAlgorithms = map[string]bool{"HS256": true, "RS256": true, "EdDSA": true}
+
+// jwtKey is one signing key. Retired keys only verify tokens issued before
+// the rotation and are dropped once those tokens have expired.
+type jwtKey struct {
+	Kid       string `json:"kid"`
+	Alg       string `json:"alg"`
+	Key       string `json:"key"` // base64 secret, or PKCS#8 private key for RS256 and EdDSA
+	CreatedAt string `json:"created_at"`
+	RetiredAt string `json:"retired_at,omitempty"`
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+type jwtKeyFile struct {
+	Current string    `json:"current"`
+	Keys    []*jwtKey `json:"keys"`
+}
+
+// JWTKeyInfo describes a signing key without its secret.
+type JWTKeyInfo struct {
+	Kid       string `json:"kid"`
+	Alg       string `json:"alg"`
+	Current   bool   `json:"current"`
+	CreatedAt string `json:"created_at,omitempty"`
+	RetiredAt string `json:"retired_at,omitempty"`
+}
+
+// jwtKeys holds the keys in use. In file mode the key file is reloaded when
+// it changes, so a rotation from the command line reaches a running server.
+var jwtKeys struct {
+	sync.Mutex
+	fromEnv bool
+	path    string
+	modTime time.Time
+	current *jwtKey
+	keys    map[string]*jwtKey
+}
+
+// ErrJWTKeyFromEnv is returned when rotating a key that is set by JWT_SECRET.
+var ErrJWTKeyFromEnv = errors.New("the signing key is set by JWT_SECRET, rotate it there")
+
+// InitJWTKeys loads the token signing keys. JWT_SECRET sets an HS256 secret
+// directly, with previous secrets in JWT_OLD_SECRETS (comma separated) still
+// accepted during a rotation. Otherwise keys are kept in JWT_KEY_FILE
+// (jwt_keys.json by default), which is created with a new JWT_ALGORITHM key
+// (HS256 by default) on first start.
+func InitJWTKeys() error {
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return loadEnvKeys(secret)
+	}
+
+	jwtKeys.fromEnv = false
+	jwtKeys.path = os.Getenv("JWT_KEY_FILE")
+	if jwtKeys.path == "" {
+		jwtKeys.path = defaultJWTKeyFile
+	}
+
+	if _, err := os.Stat(jwtKeys.path); errors.Is(err, os.ErrNotExist) {
+		key, err := newJWTKey(defaultJWTAlgorithm())
+		if err != nil {
+			l.LogMessage(l.ERROR, "JWT key generation failed: "+err.Error())
+			return err
+		}
+		if err := writeKeyFile(jwtKeys.path, &jwtKeyFile{Current: key.Kid, Keys: []*jwtKey{key}}); err != nil {
+			l.LogMessage(l.ERROR, "Failed to write JWT key file: "+err.Error())
+			return err
+		}
+		l.LogMessage(l.SUCS, "Generated "+key.Alg+" JWT signing key "+key.Kid+" in "+jwtKeys.path)
+	}
+
+	if err := loadKeyFile(); err != nil {
+		l.LogMessage(l.ERROR, "Failed to load JWT key file: "+err.Error())
+		return err
+	}
+	l.LogMessage(l.SUCS, "JWT signing key "+jwtKeys.current.Kid+" ("+jwtKeys.current.Alg+") loaded")
+	return nil
+}
+
+func defaultJWTAlgorithm() string {
+	if alg := os.Getenv("JWT_ALGORITHM"); alg != "" {
+		return alg
+	}
+	return "HS256"
+}
+
+func loadEnvKeys(secret string) error {
+	if len(secret) < 32 {
+		err := fmt.Errorf("JWT_SECRET must be at least 32 characters")
+		l.LogMessage(l.ERROR, err.Error())
+		return err
+	}
+
+	jwtKeys.fromEnv = true
+	jwtKeys.keys = map[string]*jwtKey{}
+	for _, old := range strings.Split(os.Getenv("JWT_OLD_SECRETS"), ",") {
+		if old = strings.TrimSpace(old); old != "" {
+			key := secretKey(old)
+			jwtKeys.keys[key.Kid] = key
+		}
+	}
+	jwtKeys.current = secretKey(secret)
+	jwtKeys.keys[jwtKeys.current.Kid] = jwtKeys.current
+
+	l.LogMessage(l.SUCS, "JWT signing key "+jwtKeys.current.Kid+" loaded from JWT_SECRET")
+	return nil
+}
+
+// secretKey builds an HS256 key from a configured secret. Its kid is derived
+// from the secret so every instance sharing it agrees on the kid.
+func secretKey(secret string) *jwtKey {
+	sum := sha256.Sum256([]byte(secret))
+	return &jwtKey{Kid: hex.EncodeToString(sum[:4]), Alg: "HS256", signKey: []byte(secret), verifyKey: []byte(secret)}
+}
+
+// newJWTKey generates a key for alg.
+func newJWTKey(alg string) (*jwtKey, error) {
+	if !jwtAlgorithms[alg] {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q, use HS256, RS256 or EdDSA", alg)
+	}
+
+	var raw []byte
+	switch alg {
+	case "HS256":
+		raw = make([]byte, 64)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+	case "RS256":
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = x509.MarshalPKCS8PrivateKey(private); err != nil {
+			return nil, err
+		}
+	case "EdDSA":
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = x509.MarshalPKCS8PrivateKey(private); err != nil {
+			return nil, err
+		}
+	}
+
+	key := &jwtKey{Alg: alg, Key: base64.StdEncoding.EncodeToString(raw), CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := key.parse(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parse decodes the stored key material and derives the kid from it.
+func (k *jwtKey) parse() error {
+	raw, err := base64.StdEncoding.DecodeString(k.Key)
+	if err != nil {
+		return fmt.Errorf("key %s: %w", k.Kid, err)
+	}
+
+	idMaterial := raw
+	switch k.Alg {
+	case "HS256":
+		k.signKey, k.verifyKey = raw, raw
+	case "RS256", "EdDSA":
+		private, err := x509.ParsePKCS8PrivateKey(raw)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", k.Kid, err)
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("key %s: not a signing key", k.Kid)
+		}
+		switch private.(type) {
+		case *rsa.PrivateKey:
+			if k.Alg != "RS256" {
+				return fmt.Errorf("key %s: RSA key for %s", k.Kid, k.Alg)
+			}
+		case ed25519.PrivateKey:
+			if k.Alg != "EdDSA" {
+				return fmt.Errorf("key %s: Ed25519 key for %s", k.Kid, k.Alg)
+			}
+		default:
+			return fmt.Errorf("key %s: unsupported key type", k.Kid)
+		}
+		k.signKey, k.verifyKey = private, signer.Public()
+		if idMaterial, err = x509.MarshalPKIXPublicKey(signer.Public()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("key %s: unsupported algorithm %q", k.Kid, k.Alg)
+	}
+
+	if k.Kid == "" {
+		sum := sha256.Sum256(idMaterial)
+		k.Kid = hex.EncodeToString(sum[:4])
+	}
+	return nil
+}
+
+// loadKeyFile reads the key file into jwtKeys. The caller holds the lock.
+func loadKeyFile() error {
+	info, err := os.Stat(jwtKeys.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(jwtKeys.path)
+	if err != nil {
+		return err
+	}
+
+	var file jwtKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	keys := map[string]*jwtKey{}
+	for _, key := range file.Keys {
+		if err := key.parse(); err != nil {
+			return err
+		}
+		keys[key.Kid] = key
+	}
+	current, ok := keys[file.Current]
+	if !ok {
+		return fmt.Errorf("current key %q is not in the key file", file.Current)
+	}
+
+	jwtKeys.keys = keys
+	jwtKeys.current = current
+	jwtKeys.modTime = info.ModTime()
+	return nil
+}
+
+// writeKeyFile replaces the key file atomically, readable by the owner only.
+func writeKeyFile(path string, file *jwtKeyFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".jwt_keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// refreshKeys reloads the key file if it changed since it was read. The caller
+// holds the lock.
+func refreshKeys() {
+	if jwtKeys.fromEnv || jwtKeys.path == "" {
+		return
+	}
+	info, err := os.Stat(jwtKeys.path)
+	if err != nil || info.ModTime().Equal(jwtKeys.modTime) {
+		return
+	}
+	if err := loadKeyFile(); err != nil {
+		l.LogMessage(l.ERROR, "Failed to reload JWT key file: "+err.Error())
+	}
+}
+
+// signingKey returns the current key.
+func signingKey() (*jwtKey, error) {
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+
+	refreshKeys()
+	if jwtKeys.current == nil {
+		return nil, fmt.Errorf("no JWT signing key loaded")
+	}
+	return jwtKeys.current, nil
+}
+
+// verificationKey is the jwt.Keyfunc for parsing tokens. The key is chosen by
+// the kid header and must be used with the algorithm it was created for.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("token has no kid")
+	}
+
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+
+	refreshKeys()
+	key, ok := jwtKeys.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Alg {
+		return nil, fmt.Errorf("token algorithm %s does not match key %s", token.Method.Alg(), kid)
+	}
+	return key.verifyKey, nil
+}
+
+// RotateJWTKey makes a new key of the given algorithm, or JWT_ALGORITHM if
+// empty, the signing key. Earlier keys keep verifying the tokens they signed
+// until those expire, after which the next rotation drops them.
+func RotateJWTKey(alg string) (string, int, error) {
+	if alg == "" {
+		alg = defaultJWTAlgorithm()
+	}
+
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+
+	if jwtKeys.fromEnv {
+		return "", 409, ErrJWTKeyFromEnv
+	}
+	if jwtKeys.path == "" {
+		return "", 500, fmt.Errorf("no JWT key file loaded")
+	}
+
+	key, err := newJWTKey(alg)
+	if err != nil {
+		return "", 400, err
+	}
+
+	refreshKeys()
+	now := time.Now().UTC()
+	file := &jwtKeyFile{Current: key.Kid, Keys: []*jwtKey{key}}
+	for _, key := range jwtKeys.keys {
+		old := *key
+		if old.RetiredAt == "" {
+			old.RetiredAt = now.Format(time.RFC3339)
+		}
+		if retired, err := time.Parse(time.RFC3339, old.RetiredAt); err == nil && now.Sub(retired) > accessTokenTTL() {
+			continue
+		}
+		file.Keys = append(file.Keys, &old)
+	}
+
+	if err := writeKeyFile(jwtKeys.path, file); err != nil {
+		l.LogMessage(l.ERROR, "Failed to write JWT key file: "+err.Error())
+		return "", 500, err
+	}
+	if err := loadKeyFile(); err != nil {
+		l.LogMessage(l.ERROR, "Failed to load JWT key file: "+err.Error())
+		return "", 500, err
+	}
+
+	l.LogMessage(l.SUCS, "Rotated JWT signing key to "+key.Kid+" ("+key.Alg+")")
+	return key.Kid, 200, nil
+}
+
+// JWTKeys lists the signing keys in use.
+func JWTKeys() []JWTKeyInfo {
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+
+	refreshKeys()
+	infos := []JWTKeyInfo{}
+	for _, key := range jwtKeys.keys {
+		infos = append(infos, JWTKeyInfo{
+			Kid:       key.Kid,
+			Alg:       key.Alg,
+			Current:   key == jwtKeys.current,
+			CreatedAt: key.CreatedAt,
+			RetiredAt: key.RetiredAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt > infos[j].CreatedAt })
+	return infos
+}
+
+// JWKS returns the public keys of the RS256 and EdDSA signing keys as a JSON
+// Web Key Set, so other services can verify tokens issued by GoStore.
+func JWKS() map[string]interface{} {
+	jwtKeys.Lock()
+	defer jwtKeys.Unlock()
+
+	refreshKeys()
+	keys := []map[string]string{}
+	for _, key := range jwtKeys.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "use": "sig", "alg": key.Alg, "kid": key.Kid,
+				"n": base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "OKP", "crv": "Ed25519", "use": "sig", "alg": key.Alg, "kid": key.Kid,
+				"x": base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// signingMethodEdDSA signs tokens with Ed25519 keys, which this version of
+// jwt-go does not support itself.
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod("EdDSA", func() jwt.SigningMethod { return signingMethodEdDSA{} })
+}
+
+func (signingMethodEdDSA) Alg() string { return "EdDSA" }
+
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,703 @@
+package auth
+
+import (
+	l "GoStore/log"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// How long the second login step may take, and how many wrong codes it allows.
+const (
+	pendingLoginTTL         = 5 * time.Minute
+	maxSecondFactorAttempts = 5
+)
+
+// How many wrong codes a user may enter across all their logins before the
+// second login step is locked for them, and for how long.
+const (
+	maxUserSecondFactorFailures = 10
+	secondFactorLockout         = 15 * time.Minute
+)
+
+// ErrSecondFactorLocked is returned while a user is locked out after too many
+// wrong two-factor codes.
+var ErrSecondFactorLocked = errors.New("too many wrong two-factor codes, try again later")
+
+// Number of recovery codes handed out at a time.
+const recoveryCodeCount = 10
+
+// LoginResult is what a correct password gets. Users without two-factor
+// authentication get a session right away, the others an MFA token to
+// finish the login with a code. EnrollmentRequired means the user has to set
+// up two-factor authentication first, because the policy requires it.
+type LoginResult struct {
+	Token              string `json:"token,omitempty"`
+	RefreshToken       string `json:"refresh_token,omitempty"`
+	MFAToken           string `json:"mfa_token,omitempty"`
+	EnrollmentRequired bool   `json:"enrollment_required,omitempty"`
+}
+
+// TOTPStatus is a user's two-factor authentication state.
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// MFAPolicy says who has to use two-factor authentication. Admins are users
+// with an administrative role, users those with access to files.
+type MFAPolicy struct {
+	RequireAdmins bool `json:"require_admins"`
+	RequireUsers  bool `json:"require_users"`
+}
+
+type pendingLogin struct {
+	kind     string
+	usr      string
+	enroll   bool
+	expires  time.Time
+	attempts int
+}
+
+var (
+	pendingMu     sync.Mutex
+	pendingLogins = map[string]*pendingLogin{}
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GetMFAPolicy reads the two-factor authentication policy.
+func GetMFAPolicy() (MFAPolicy, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return MFAPolicy{}, err
+	}
+	defer db.Close()
+
+	var policy MFAPolicy
+	rows, err := db.Query(`SELECT key, value FROM settings WHERE key IN ('mfa_require_admins', 'mfa_require_users')`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Settings query failed: "+err.Error())
+		return policy, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return policy, err
+		}
+		switch key {
+		case "mfa_require_admins":
+			policy.RequireAdmins = value == "true"
+		case "mfa_require_users":
+			policy.RequireUsers = value == "true"
+		}
+	}
+	return policy, rows.Err()
+}
+
+// SetMFAPolicy changes the two-factor authentication policy. It applies from
+// the next login; users who have to enroll are asked to when they log in.
+func SetMFAPolicy(policy MFAPolicy) error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	for key, value := range map[string]bool{"mfa_require_admins": policy.RequireAdmins, "mfa_require_users": policy.RequireUsers} {
+		_, err := db.Exec(`INSERT INTO settings (key, value) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, fmt.Sprint(value))
+		if err != nil {
+			l.LogMessage(l.ERROR, "Settings update failed: "+err.Error())
+			return err
+		}
+	}
+
+	l.LogMessage(l.INFO, fmt.Sprintf("Two-factor policy changed: admins %t, users %t", policy.RequireAdmins, policy.RequireUsers))
+	return nil
+}
+
+// mfaRequired reports whether the policy requires two-factor authentication
+// of a user.
+func mfaRequired(usr string) (bool, error) {
+	policy, err := GetMFAPolicy()
+	if err != nil {
+		return false, err
+	}
+	if !policy.RequireAdmins && !policy.RequireUsers {
+		return false, nil
+	}
+
+	perms, err := UserPermissions(usr)
+	if err != nil {
+		return false, err
+	}
+	return (policy.RequireAdmins && IsAdministrative(perms)) ||
+		(policy.RequireUsers && perms[PermFilesRead]), nil
+}
+
+// MFAEnforced reports whether a user has two-factor authentication enabled or
+// is required to. Such users cannot log in with just their password anywhere.
+func MFAEnforced(usr string) (bool, error) {
+	status, err := GetTOTPStatus(usr)
+	if err != nil {
+		return false, err
+	}
+	return status.Enabled || status.Required, nil
+}
+
+// StartLogin is called once a user's password has been checked. It starts a
+// session, or a pending login that CompleteLogin finishes with a code.
+func StartLogin(kind, usr string) (LoginResult, error) {
+	locked, err := secondFactorLocked(usr)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if locked {
+		return LoginResult{}, ErrSecondFactorLocked
+	}
+
+	status, err := GetTOTPStatus(usr)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	if !status.Enabled && !status.Required {
+		token, refreshToken, err := NewSession(kind, usr)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{Token: token, RefreshToken: refreshToken}, nil
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return LoginResult{}, err
+	}
+	mfaToken := hex.EncodeToString(buf)
+
+	pendingMu.Lock()
+	for token, p := range pendingLogins {
+		if time.Now().After(p.expires) {
+			delete(pendingLogins, token)
+		}
+	}
+	pendingLogins[mfaToken] = &pendingLogin{
+		kind:    kind,
+		usr:     usr,
+		enroll:  !status.Enabled,
+		expires: time.Now().Add(pendingLoginTTL),
+	}
+	pendingMu.Unlock()
+
+	return LoginResult{MFAToken: mfaToken, EnrollmentRequired: !status.Enabled}, nil
+}
+
+// pending looks up a pending login of the given kind.
+func pending(kind, mfaToken string) (pendingLogin, bool) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	p, ok := pendingLogins[mfaToken]
+	if !ok || p.kind != kind {
+		return pendingLogin{}, false
+	}
+	if time.Now().After(p.expires) {
+		delete(pendingLogins, mfaToken)
+		return pendingLogin{}, false
+	}
+	return *p, true
+}
+
+// BeginLoginEnrollment sets up two-factor authentication for a user who has
+// to enroll before their login can finish.
+func BeginLoginEnrollment(kind, mfaToken string) (string, string, int, error) {
+	p, ok := pending(kind, mfaToken)
+	if !ok {
+		return "", "", 401, fmt.Errorf("invalid or expired MFA token")
+	}
+	if !p.enroll {
+		return "", "", 409, fmt.Errorf("two-factor authentication is already enabled")
+	}
+	return BeginTOTPEnrollment(p.usr)
+}
+
+// CompleteLogin finishes a pending login with a TOTP or recovery code. For a
+// user who just enrolled it also returns their first recovery codes.
+func CompleteLogin(kind, mfaToken, code string) (LoginResult, []string, int, error) {
+	p, ok := pending(kind, mfaToken)
+	if !ok {
+		return LoginResult{}, nil, 401, fmt.Errorf("invalid or expired MFA token")
+	}
+
+	locked, err := secondFactorLocked(p.usr)
+	if err != nil {
+		return LoginResult{}, nil, 500, err
+	}
+	if locked {
+		return LoginResult{}, nil, 429, ErrSecondFactorLocked
+	}
+
+	var recoveryCodes []string
+	var status int
+	if p.enroll {
+		recoveryCodes, status, err = ConfirmTOTPEnrollment(p.usr, code)
+	} else {
+		var valid bool
+		valid, err = VerifySecondFactor(p.usr, code)
+		status = 500
+		if err == nil && !valid {
+			status, err = 401, fmt.Errorf("invalid code")
+		}
+	}
+
+	if err != nil {
+		if status == 401 {
+			pendingMu.Lock()
+			if cur, ok := pendingLogins[mfaToken]; ok {
+				cur.attempts++
+				if cur.attempts >= maxSecondFactorAttempts {
+					l.LogMessage(l.WARNING, "Too many wrong two-factor codes for "+p.usr)
+					delete(pendingLogins, mfaToken)
+				}
+			}
+			pendingMu.Unlock()
+
+			nowLocked, lockErr := recordSecondFactorFailure(p.usr)
+			if lockErr != nil {
+				return LoginResult{}, nil, 500, lockErr
+			}
+			if nowLocked {
+				return LoginResult{}, nil, 429, ErrSecondFactorLocked
+			}
+		}
+		return LoginResult{}, nil, status, err
+	}
+
+	if err := clearSecondFactorFailures(p.usr); err != nil {
+		return LoginResult{}, nil, 500, err
+	}
+
+	pendingMu.Lock()
+	delete(pendingLogins, mfaToken)
+	pendingMu.Unlock()
+
+	token, refreshToken, err := NewSession(kind, p.usr)
+	if err != nil {
+		return LoginResult{}, nil, 500, err
+	}
+	return LoginResult{Token: token, RefreshToken: refreshToken}, recoveryCodes, 200, nil
+}
+
+// secondFactorLocked reports whether a user is locked out of the second login
+// step.
+func secondFactorLocked(usr string) (bool, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return false, err
+	}
+	defer db.Close()
+
+	var locked bool
+	err = db.QueryRow(`SELECT mfa_locked_until IS NOT NULL AND mfa_locked_until > datetime('now')
+		FROM users WHERE username = ?`, usr).Scan(&locked)
+	if err != nil && err != sql.ErrNoRows {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return false, err
+	}
+	return locked, nil
+}
+
+// recordSecondFactorFailure counts a wrong code of a user. Once there are too
+// many, it locks the user out for a while, drops their pending logins and
+// reports true.
+func recordSecondFactorFailure(usr string) (bool, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return false, err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`UPDATE users SET mfa_failed_attempts = mfa_failed_attempts + 1 WHERE username = ?`, usr); err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return false, err
+	}
+
+	res, err := db.Exec(`UPDATE users SET mfa_failed_attempts = 0, mfa_locked_until = datetime('now', ?)
+		WHERE username = ? AND mfa_failed_attempts >= ?`,
+		fmt.Sprintf("+%d seconds", int(secondFactorLockout.Seconds())), usr, maxUserSecondFactorFailures)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	pendingMu.Lock()
+	for token, p := range pendingLogins {
+		if p.usr == usr {
+			delete(pendingLogins, token)
+		}
+	}
+	pendingMu.Unlock()
+
+	l.LogMessage(l.WARNING, "Two-factor login locked for "+usr+" after too many wrong codes")
+	return true, nil
+}
+
+// clearSecondFactorFailures forgets the wrong codes of a user, e.g. after a
+// successful login.
+func clearSecondFactorFailures(usr string) error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`UPDATE users SET mfa_failed_attempts = 0, mfa_locked_until = NULL WHERE username = ?`, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+	}
+	return err
+}
+
+// GetTOTPStatus returns a user's two-factor authentication state.
+func GetTOTPStatus(usr string) (TOTPStatus, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return TOTPStatus{}, err
+	}
+	defer db.Close()
+
+	var status TOTPStatus
+	err = db.QueryRow(`SELECT u.totp_enabled,
+		(SELECT COUNT(*) FROM recovery_codes r WHERE r.user_UID = u.UID AND r.used_at IS NULL)
+		FROM users u WHERE u.username = ?`, usr).Scan(&status.Enabled, &status.RecoveryCodesLeft)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return status, err
+	}
+
+	status.Required, err = mfaRequired(usr)
+	return status, err
+}
+
+// BeginTOTPEnrollment creates a new TOTP secret for a user and returns it
+// with its provisioning URI. It takes effect once ConfirmTOTPEnrollment sees
+// a code generated from it.
+func BeginTOTPEnrollment(usr string) (string, string, int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return "", "", 500, err
+	}
+	defer db.Close()
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		l.LogMessage(l.ERROR, "TOTP secret generation failed: "+err.Error())
+		return "", "", 500, err
+	}
+
+	res, err := db.Exec(`UPDATE users SET totp_secret = ? WHERE username = ? AND totp_enabled = 0`, secret, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return "", "", 500, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "", "", 409, fmt.Errorf("two-factor authentication is already enabled")
+	}
+
+	return secret, totpURI(secret, usr), 200, nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication once the user
+// proves their app has the secret, and returns their recovery codes.
+func ConfirmTOTPEnrollment(usr, code string) ([]string, int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, 500, err
+	}
+	defer db.Close()
+
+	var uid string
+	var secret sql.NullString
+	var enabled bool
+	err = db.QueryRow(`SELECT UID, totp_secret, totp_enabled FROM users WHERE username = ?`, usr).Scan(&uid, &secret, &enabled)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return nil, 500, err
+	}
+	if enabled {
+		return nil, 409, fmt.Errorf("two-factor authentication is already enabled")
+	}
+	if !secret.Valid {
+		return nil, 400, fmt.Errorf("two-factor enrollment has not been started")
+	}
+
+	step, ok := totpMatch(secret.String, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, 401, fmt.Errorf("invalid code")
+	}
+
+	_, err = db.Exec(`UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE UID = ?`, step, uid)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return nil, 500, err
+	}
+
+	codes, err := replaceRecoveryCodes(db, uid)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	l.LogMessage(l.INFO, "Two-factor authentication enabled for "+usr)
+	return codes, 200, nil
+}
+
+// VerifySecondFactor checks a TOTP code or an unused recovery code of a user
+// with two-factor authentication enabled. Each code is accepted only once.
+func VerifySecondFactor(usr, code string) (bool, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return false, err
+	}
+	defer db.Close()
+
+	var uid string
+	var secret sql.NullString
+	var enabled bool
+	var lastStep int64
+	err = db.QueryRow(`SELECT UID, totp_secret, totp_enabled, totp_last_step FROM users WHERE username = ?`, usr).
+		Scan(&uid, &secret, &enabled, &lastStep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return false, err
+	}
+	if !enabled || !secret.Valid {
+		return false, nil
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := totpMatch(secret.String, code, time.Now()); ok {
+		if step <= lastStep {
+			return false, nil
+		}
+		res, err := db.Exec(`UPDATE users SET totp_last_step = ? WHERE UID = ? AND totp_last_step < ?`, step, uid, step)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return err == nil && n == 1, err
+	}
+
+	res, err := db.Exec(`UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_UID = ? AND code_hash = ? AND used_at IS NULL`, uid, hashRecoveryCode(code))
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 1 {
+		l.LogMessage(l.INFO, "Recovery code used by "+usr)
+		return true, nil
+	}
+	return false, err
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking a
+// current code.
+func RegenerateRecoveryCodes(usr, code string) ([]string, int, error) {
+	valid, err := VerifySecondFactor(usr, code)
+	if err != nil {
+		return nil, 500, err
+	}
+	if !valid {
+		return nil, 401, fmt.Errorf("invalid code")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, 500, err
+	}
+	defer db.Close()
+
+	var uid string
+	if err := db.QueryRow(`SELECT UID FROM users WHERE username = ?`, usr).Scan(&uid); err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return nil, 500, err
+	}
+
+	codes, err := replaceRecoveryCodes(db, uid)
+	if err != nil {
+		return nil, 500, err
+	}
+	return codes, 200, nil
+}
+
+// DisableTOTP turns two-factor authentication off after checking a current
+// code. Users the policy requires it of cannot turn it off.
+func DisableTOTP(usr, code string) (int, error) {
+	required, err := mfaRequired(usr)
+	if err != nil {
+		return 500, err
+	}
+	if required {
+		return 409, fmt.Errorf("two-factor authentication is required for this account")
+	}
+
+	valid, err := VerifySecondFactor(usr, code)
+	if err != nil {
+		return 500, err
+	}
+	if !valid {
+		return 401, fmt.Errorf("invalid code")
+	}
+
+	return removeTOTP(usr)
+}
+
+// ResetTOTP removes a user's TOTP secret and recovery codes, e.g. when an
+// admin helps a user who lost their device. The user's sessions are revoked,
+// since whoever has the device may be signed in.
+func ResetTOTP(usr string) (int, error) {
+	if code, err := removeTOTP(usr); err != nil {
+		return code, err
+	}
+	if err := RevokeSessions(usr); err != nil {
+		return 500, err
+	}
+	return 200, nil
+}
+
+// removeTOTP removes a user's TOTP secret and recovery codes, and lifts a
+// lockout of the second login step.
+func removeTOTP(usr string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	var uid string
+	if err := db.QueryRow(`SELECT UID FROM users WHERE username = ?`, usr).Scan(&uid); err != nil {
+		if err == sql.ErrNoRows {
+			return 404, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return 500, err
+	}
+
+	for _, query := range []string{
+		`UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0,
+			mfa_failed_attempts = 0, mfa_locked_until = NULL WHERE UID = ?`,
+		`DELETE FROM recovery_codes WHERE user_UID = ?`,
+	} {
+		if _, err := db.Exec(query, uid); err != nil {
+			l.LogMessage(l.ERROR, "Two-factor reset failed: "+err.Error())
+			return 500, err
+		}
+	}
+
+	l.LogMessage(l.INFO, "Two-factor authentication removed for "+usr)
+	return 200, nil
+}
+
+// TOTPEnrolledUsers returns the usernames of users with two-factor
+// authentication enabled.
+func TOTPEnrolledUsers() ([]string, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT username FROM users WHERE totp_enabled = 1 ORDER BY username`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		users = append(users, username)
+	}
+	return users, rows.Err()
+}
+
+// replaceRecoveryCodes generates new recovery codes for a user, invalidating
+// the old ones. Codes look like abcde-fghij; case and dashes do not matter
+// when they are entered.
+func replaceRecoveryCodes(db *sql.DB, uid string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_UID = ?`, uid); err != nil {
+		l.LogMessage(l.ERROR, "Delete query failed: "+err.Error())
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(recoveryEncoding.EncodeToString(buf))[:10]
+		code := raw[:5] + "-" + raw[5:]
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO recovery_codes (user_UID, code_hash) VALUES (?, ?)`, uid, hashRecoveryCode(code)); err != nil {
+			l.LogMessage(l.ERROR, "Insert query failed: "+err.Error())
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return nil, err
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
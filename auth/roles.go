@@ -0,0 +1,111 @@
+package auth
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"sort"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Permission is an action a role allows.
+type Permission string
+
+const (
+	PermFilesRead    Permission = "files.read"    // browse and download own and shared files
+	PermFilesUpload  Permission = "files.upload"  // create folders and upload files
+	PermFilesWrite   Permission = "files.write"   // change and delete files
+	PermUsersRead    Permission = "users.read"    // see users, groups and usage
+	PermUsersManage  Permission = "users.manage"  // add and delete users, set quotas
+	PermGroupsManage Permission = "groups.manage" // manage groups and their members
+	PermSystemRead   Permission = "system.read"   // see jobs, scrubs and signing keys
+	PermSystemManage Permission = "system.manage" // run jobs and scrubs, rotate keys
+	PermRolesManage  Permission = "roles.manage"  // grant and revoke roles
+)
+
+// Roles maps each role to its permissions. A user's permissions are those of
+// all their roles, so a user who is also an admin has both roles.
+var Roles = map[string][]Permission{
+	"owner":        {PermUsersRead, PermUsersManage, PermGroupsManage, PermSystemRead, PermSystemManage, PermRolesManage},
+	"admin":        {PermUsersRead, PermUsersManage, PermGroupsManage, PermSystemRead, PermSystemManage},
+	"user-manager": {PermUsersRead, PermUsersManage, PermGroupsManage},
+	"auditor":      {PermUsersRead, PermSystemRead},
+	"user":         {PermFilesRead, PermFilesUpload, PermFilesWrite},
+	"read-only":    {PermFilesRead},
+}
+
+// Role given to new users when no roles are asked for.
+const DefaultRole = "user"
+
+// RoleInfo describes a role for the admin console.
+type RoleInfo struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// ListRoles returns every role with its permissions, sorted by name.
+func ListRoles() []RoleInfo {
+	roles := make([]RoleInfo, 0, len(Roles))
+	for name, perms := range Roles {
+		roles = append(roles, RoleInfo{Name: name, Permissions: perms})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+// IsAdministrative reports whether a set of permissions gives access to the
+// admin console, i.e. contains anything besides file access.
+func IsAdministrative(perms map[Permission]bool) bool {
+	for perm := range perms {
+		if perm != PermFilesRead && perm != PermFilesUpload && perm != PermFilesWrite {
+			return true
+		}
+	}
+	return false
+}
+
+// UserRoles returns the roles of a user, sorted by name.
+func UserRoles(usr string) ([]string, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT r.role FROM user_roles r JOIN users u ON u.UID = r.user_UID
+		WHERE u.username = ? ORDER BY r.role`, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Role query failed: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// UserPermissions returns the union of the permissions of a user's roles.
+// Roles that are no longer defined grant nothing.
+func UserPermissions(usr string) (map[Permission]bool, error) {
+	roles, err := UserRoles(usr)
+	if err != nil {
+		return nil, err
+	}
+
+	perms := map[Permission]bool{}
+	for _, role := range roles {
+		for _, perm := range Roles[role] {
+			perms[perm] = true
+		}
+	}
+	return perms, nil
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	l "GoStore/log"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Session kinds, the login endpoint a session was started from. Its refresh
+// token only works at the matching refresh endpoint.
+const (
+	SessionUser  = "user"
+	SessionAdmin = "admin"
+)
+
+// Days a session can be refreshed for when REFRESH_TOKEN_TTL_DAYS is not set.
+// After that the user has to log in again.
+const defaultRefreshTokenTTLDays = 30
+
+// ErrInvalidRefreshToken is returned for unknown, expired, revoked or
+// already used refresh tokens.
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+func refreshTokenTTLDays() int {
+	if v, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_TTL_DAYS")); err == nil && v > 0 {
+		return v
+	}
+	return defaultRefreshTokenTTLDays
+}
+
+// newRefreshSecret returns a random refresh token secret and its hash.
+func newRefreshSecret() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	return secret, hashRefreshSecret(secret), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSession starts a session for a user or admin who just logged in and
+// returns its access token and refresh token.
+func NewSession(kind, usr string) (string, string, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return "", "", err
+	}
+	defer db.Close()
+
+	sessionID := uuid.New().String()
+	secret, hash, err := newRefreshSecret()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Refresh token generation failed: "+err.Error())
+		return "", "", err
+	}
+
+	_, err = db.Exec(`INSERT INTO sessions (id, kind, username, refresh_hash, expires_at)
+		VALUES (?, ?, ?, ?, datetime('now', ?))`,
+		sessionID, kind, usr, hash, fmt.Sprintf("+%d days", refreshTokenTTLDays()))
+	if err != nil {
+		l.LogMessage(l.ERROR, "Session insert failed: "+err.Error())
+		return "", "", err
+	}
+
+	token, err := generateTokenJWT(kind, usr, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, sessionID + "." + secret, nil
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once: presenting one that was
+// already exchanged means it was copied, so the whole session is revoked.
+func RefreshSession(kind, refreshToken string) (string, string, int, error) {
+	sessionID, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || sessionID == "" || secret == "" {
+		return "", "", 401, ErrInvalidRefreshToken
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return "", "", 500, err
+	}
+	defer db.Close()
+
+	var usr, refreshHash string
+	var previousHash sql.NullString
+	var active bool
+	err = db.QueryRow(`SELECT username, refresh_hash, previous_hash,
+		revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		FROM sessions WHERE id = ? AND kind = ?`, sessionID, kind).Scan(&usr, &refreshHash, &previousHash, &active)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", 401, ErrInvalidRefreshToken
+		}
+		l.LogMessage(l.ERROR, "Session query failed: "+err.Error())
+		return "", "", 500, err
+	}
+	if !active {
+		return "", "", 401, ErrInvalidRefreshToken
+	}
+
+	hash := hashRefreshSecret(secret)
+	if previousHash.Valid && subtle.ConstantTimeCompare([]byte(hash), []byte(previousHash.String)) == 1 {
+		l.LogMessage(l.WARNING, "Refresh token reused, revoking session of "+usr)
+		if _, err := db.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ?`, sessionID); err != nil {
+			l.LogMessage(l.ERROR, "Session revocation failed: "+err.Error())
+			return "", "", 500, err
+		}
+		return "", "", 401, ErrInvalidRefreshToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(refreshHash)) != 1 {
+		return "", "", 401, ErrInvalidRefreshToken
+	}
+
+	newSecret, newHash, err := newRefreshSecret()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Refresh token generation failed: "+err.Error())
+		return "", "", 500, err
+	}
+
+	// Only one of two concurrent refreshes with the same token wins
+	res, err := db.Exec(`UPDATE sessions SET previous_hash = refresh_hash, refresh_hash = ?, last_used_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND refresh_hash = ?`, newHash, sessionID, refreshHash)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Session update failed: "+err.Error())
+		return "", "", 500, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return "", "", 401, ErrInvalidRefreshToken
+	}
+
+	token, err := generateTokenJWT(kind, usr, sessionID)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	return token, sessionID + "." + newSecret, 200, nil
+}
+
+// RevokeSession ends the session an access token belongs to. The token and
+// the session's refresh token stop working immediately.
+func RevokeSession(token string) (int, error) {
+	isValid, claims := AuthenticateTokenJWT(token)
+	if !isValid {
+		return 401, fmt.Errorf("invalid token")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL`, claims.Session)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Session revocation failed: "+err.Error())
+		return 500, err
+	}
+
+	return 200, nil
+}
+
+// RevokeSessions ends every session of a user, from either login, e.g. after
+// their password changed or their account was deleted.
+func RevokeSessions(usr string) error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE username = ? AND revoked_at IS NULL`, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Session revocation failed: "+err.Error())
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		l.LogMessage(l.INFO, fmt.Sprintf("Revoked %d sessions of %s", n, usr))
+	}
+	return nil
+}
+
+// PruneSessions deletes sessions that can no longer be used. Revoked sessions
+// are kept for a day so that reuse of their refresh tokens is still logged.
+func PruneSessions() error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM sessions WHERE expires_at < CURRENT_TIMESTAMP OR revoked_at < datetime('now', '-1 day')`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Session pruning failed: "+err.Error())
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		l.LogMessage(l.INFO, fmt.Sprintf("Pruned %d ended sessions", n))
+	}
+	return nil
+}
+
+// sessionActive reports whether the session an access token was issued for
+// is still live.
+func sessionActive(claims *Claims) bool {
+	if claims.Session == "" {
+		return false
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return false
+	}
+	defer db.Close()
+
+	var active bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND kind = ? AND username = ?
+		AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP)`,
+		claims.Session, claims.Kind, claims.Username).Scan(&active)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Session query failed: "+err.Error())
+		return false
+	}
+
+	return active
+}
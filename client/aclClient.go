@@ -0,0 +1,369 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// Access levels on a folder, from a grant or from owning it. Each level
+// includes everything the ones below it allow: viewers list and download,
+// editors also upload, create folders and delete files, managers also grant
+// and revoke access.
+const (
+	accessNone = iota
+	accessViewer
+	accessEditor
+	accessManager
+	accessOwner
+)
+
+var permissionLevels = map[string]int{
+	"viewer":  accessViewer,
+	"editor":  accessEditor,
+	"manager": accessManager,
+}
+
+// FolderGrant is access to a folder granted to another user or a group.
+type FolderGrant struct {
+	GranteeType string `json:"grantee_type"`
+	Grantee     string `json:"grantee"`
+	Permission  string `json:"permission"`
+	GrantedBy   string `json:"granted_by"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// SharedFolder is a folder another user has granted the caller access to, or
+// the team folder of a group the caller is a member of. Owner is the user or
+// group name.
+type SharedFolder struct {
+	FolderEntry
+	Owner      string `json:"owner"`
+	Permission string `json:"permission"`
+}
+
+// folderAncestors selects the UID of a folder and all of its parents into an
+// "ancestors" table for the statement that follows it.
+const folderAncestors = `WITH RECURSIVE ancestors(UID, parent_id, depth) AS (
+		SELECT UID, parent_id, 0 FROM folders WHERE UID = ?
+		UNION ALL
+		SELECT f.UID, f.parent_id, a.depth + 1 FROM folders f JOIN ancestors a ON f.UID = a.parent_id WHERE a.depth < 256
+	) `
+
+// userPrincipals matches folder_acl rows granted to a user, directly or
+// through one of their groups. It takes the user UID twice.
+const userPrincipals = `((grantee_type = 'user' AND grantee_UID = ?)
+		OR (grantee_type = 'group' AND grantee_UID IN (SELECT group_UID FROM group_members WHERE user_UID = ?)))`
+
+// folderAccess returns the access a user has to a live folder and the UID of
+// the folder's owner. Grants on a folder apply to its whole subtree, so the
+// strongest grant on the folder or any of its parents wins. Members of a group
+// get their role's access to everything the group owns.
+func folderAccess(db *sql.DB, userUID, folderUID string) (int, string, error) {
+	var ownerUID string
+	err := db.QueryRow(`SELECT user_UID FROM folders WHERE UID = ? AND trash_id IS NULL`, folderUID).Scan(&ownerUID)
+	if err != nil {
+		return accessNone, "", err
+	}
+	if ownerUID == userUID {
+		return accessOwner, ownerUID, nil
+	}
+
+	var permission string
+	query := folderAncestors + `SELECT permission FROM (
+			SELECT permission FROM folder_acl WHERE folder_UID IN (SELECT UID FROM ancestors) AND ` + userPrincipals + `
+			UNION ALL
+			SELECT role FROM group_members WHERE group_UID = ? AND user_UID = ?
+		) ORDER BY CASE permission WHEN 'manager' THEN 3 WHEN 'editor' THEN 2 ELSE 1 END DESC LIMIT 1`
+	err = db.QueryRow(query, folderUID, userUID, userUID, ownerUID, userUID).Scan(&permission)
+	if err == sql.ErrNoRows {
+		return accessNone, ownerUID, nil
+	}
+	if err != nil {
+		return accessNone, ownerUID, err
+	}
+
+	return permissionLevels[permission], ownerUID, nil
+}
+
+// fileAccess returns the access a user has to a file through its folder.
+func fileAccess(db *sql.DB, usr string, file fileRecord) (int, error) {
+	if usr == file.Owner {
+		return accessOwner, nil
+	}
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		return accessNone, err
+	}
+
+	level, _, err := folderAccess(db, userUID, file.FolderID)
+	return level, err
+}
+
+// accessibleFolder returns a folder the user has at least the needed access
+// to, along with the UID of its owner. Folders the user cannot see at all are
+// reported as not found. The "root" alias resolves to the user's own root.
+func accessibleFolder(db *sql.DB, userUID, folderID string, need int) (FolderEntry, string, int, error) {
+	if folderID == "root" {
+		folder, err := resolveFolder(db, userUID, folderID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return folder, "", http.StatusNotFound, fmt.Errorf("folder not found or unauthorized access")
+			}
+			l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+			return folder, "", http.StatusInternalServerError, err
+		}
+		return folder, userUID, http.StatusOK, nil
+	}
+
+	var folder FolderEntry
+	level, ownerUID, err := folderAccess(db, userUID, folderID)
+	if err != nil && err != sql.ErrNoRows {
+		l.LogMessage(l.ERROR, "Folder access check failed: "+err.Error())
+		return folder, "", http.StatusInternalServerError, err
+	}
+	if level < accessViewer {
+		return folder, "", http.StatusNotFound, fmt.Errorf("folder not found or unauthorized access")
+	}
+	if level < need {
+		return folder, "", http.StatusForbidden, fmt.Errorf("insufficient permission on folder")
+	}
+
+	var parentID, createdAt sql.NullString
+	err = db.QueryRow(`SELECT UID, name, parent_id, created_at FROM folders WHERE UID = ?`, folderID).Scan(&folder.UID, &folder.Name, &parentID, &createdAt)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+		return folder, "", http.StatusInternalServerError, err
+	}
+	folder.ParentID = parentID.String
+	folder.CreatedAt = createdAt.String
+
+	return folder, ownerUID, http.StatusOK, nil
+}
+
+// grantee resolves the user or group a grant is made to.
+func grantee(db *sql.DB, granteeType, name string) (string, int, error) {
+	var granteeUID string
+	var err error
+	switch granteeType {
+	case "user":
+		granteeUID, err = getUserUID(db, name)
+	case "group":
+		err = db.QueryRow(`SELECT UID FROM groups WHERE name = ?`, name).Scan(&granteeUID)
+	default:
+		return "", http.StatusBadRequest, fmt.Errorf("grantee type must be user or group")
+	}
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", http.StatusNotFound, fmt.Errorf("%s not found", granteeType)
+		}
+		l.LogMessage(l.ERROR, "Grantee lookup failed: "+err.Error())
+		return "", http.StatusInternalServerError, err
+	}
+	return granteeUID, http.StatusOK, nil
+}
+
+// GrantFolderAccess gives another user or a group viewer, editor or manager
+// access to a folder and everything below it. Granting again changes the permission.
+func GrantFolderAccess(usr, folderID, granteeType, granteeName, permission string) (FolderGrant, int, error) {
+	grant := FolderGrant{GranteeType: granteeType, Grantee: granteeName, Permission: permission, GrantedBy: usr}
+
+	if _, ok := permissionLevels[permission]; !ok {
+		return grant, http.StatusBadRequest, fmt.Errorf("permission must be viewer, editor or manager")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return grant, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return grant, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	folder, ownerUID, status, err := accessibleFolder(db, userUID, folderID, accessManager)
+	if err != nil {
+		return grant, status, err
+	}
+
+	granteeUID, status, err := grantee(db, granteeType, granteeName)
+	if err != nil {
+		return grant, status, err
+	}
+	if granteeUID == ownerUID {
+		return grant, http.StatusBadRequest, fmt.Errorf("the owner already has full access")
+	}
+
+	insertQuery := `INSERT INTO folder_acl (folder_UID, grantee_type, grantee_UID, permission, granted_by, created_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (folder_UID, grantee_type, grantee_UID) DO UPDATE SET permission = excluded.permission, granted_by = excluded.granted_by`
+	_, err = db.Exec(insertQuery, folder.UID, granteeType, granteeUID, permission, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder grant failed: "+err.Error())
+		return grant, http.StatusInternalServerError, err
+	}
+
+	l.LogMessage(l.INFO, "Folder access granted: "+folder.Name+" to "+granteeName)
+	return grant, http.StatusOK, nil
+}
+
+// ListFolderAccess returns the grants made directly on a folder.
+func ListFolderAccess(usr, folderID string) ([]FolderGrant, int, error) {
+	grants := []FolderGrant{}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return grants, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return grants, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	folder, _, status, err := accessibleFolder(db, userUID, folderID, accessManager)
+	if err != nil {
+		return grants, status, err
+	}
+
+	query := `SELECT a.grantee_type, COALESCE(u.username, gr.name, ''), a.permission, COALESCE(g.username, ''), a.created_at
+		FROM folder_acl a
+		LEFT JOIN users u ON a.grantee_type = 'user' AND a.grantee_UID = u.UID
+		LEFT JOIN groups gr ON a.grantee_type = 'group' AND a.grantee_UID = gr.UID
+		LEFT JOIN users g ON a.granted_by = g.UID
+		WHERE a.folder_UID = ?
+		ORDER BY a.grantee_type DESC, 2`
+	rows, err := db.Query(query, folder.UID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder grant query failed: "+err.Error())
+		return grants, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var grant FolderGrant
+		var createdAt sql.NullString
+		if err := rows.Scan(&grant.GranteeType, &grant.Grantee, &grant.Permission, &grant.GrantedBy, &createdAt); err != nil {
+			l.LogMessage(l.ERROR, "Folder grant scan failed: "+err.Error())
+			return grants, http.StatusInternalServerError, err
+		}
+		grant.CreatedAt = createdAt.String
+		grants = append(grants, grant)
+	}
+	if err := rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Folder grant query failed: "+err.Error())
+		return grants, http.StatusInternalServerError, err
+	}
+
+	return grants, http.StatusOK, nil
+}
+
+// RevokeFolderAccess removes a grant from a folder. Managers can revoke any
+// grant, and a grantee can always give up their own access.
+func RevokeFolderAccess(usr, folderID, granteeType, granteeName string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	granteeUID, status, err := grantee(db, granteeType, granteeName)
+	if err != nil {
+		return status, err
+	}
+
+	need := accessManager
+	if granteeType == "user" && granteeUID == userUID {
+		need = accessViewer
+	}
+	folder, _, status, err := accessibleFolder(db, userUID, folderID, need)
+	if err != nil {
+		return status, err
+	}
+
+	res, err := db.Exec(`DELETE FROM folder_acl WHERE folder_UID = ? AND grantee_type = ? AND grantee_UID = ?`, folder.UID, granteeType, granteeUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder grant removal failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return http.StatusNotFound, fmt.Errorf("grant not found")
+	}
+
+	l.LogMessage(l.INFO, "Folder access revoked: "+folder.Name+" from "+granteeName)
+	return http.StatusOK, nil
+}
+
+// SharedWithMe returns the folders other users have granted the user access
+// to, directly or through a group, and the team folders of the user's groups.
+func SharedWithMe(usr string) ([]SharedFolder, int, error) {
+	folders := []SharedFolder{}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return folders, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return folders, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	query := `SELECT f.UID, f.name, f.parent_id, f.created_at, COALESCE(u.username, g.name, ''), a.permission
+		FROM folder_acl a
+		JOIN folders f ON a.folder_UID = f.UID
+		LEFT JOIN users u ON f.user_UID = u.UID
+		LEFT JOIN groups g ON f.user_UID = g.UID
+		WHERE ` + userPrincipals + ` AND f.trash_id IS NULL AND f.user_UID != ?
+		UNION ALL
+		SELECT f.UID, f.name, f.parent_id, f.created_at, g.name, m.role
+		FROM group_members m
+		JOIN groups g ON m.group_UID = g.UID
+		JOIN folders f ON f.user_UID = g.UID AND f.parent_id IS NULL
+		WHERE m.user_UID = ?
+		ORDER BY 2 COLLATE NOCASE`
+	rows, err := db.Query(query, userUID, userUID, userUID, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Shared folder query failed: "+err.Error())
+		return folders, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var folder SharedFolder
+		var parentID, createdAt sql.NullString
+		if err := rows.Scan(&folder.UID, &folder.Name, &parentID, &createdAt, &folder.Owner, &folder.Permission); err != nil {
+			l.LogMessage(l.ERROR, "Shared folder scan failed: "+err.Error())
+			return folders, http.StatusInternalServerError, err
+		}
+		folder.ParentID = parentID.String
+		folder.CreatedAt = createdAt.String
+		folders = append(folders, folder)
+	}
+	if err := rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Shared folder query failed: "+err.Error())
+		return folders, http.StatusInternalServerError, err
+	}
+
+	return folders, http.StatusOK, nil
+}
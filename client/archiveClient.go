@@ -0,0 +1,269 @@
+package client
+
+import (
+	l "GoStore/log"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deepest folder nesting followed when building an archive.
+const maxArchiveDepth = 256
+
+// archiveEntry is a file or, when File is nil, a directory inside an archive.
+type archiveEntry struct {
+	Path    string
+	ModTime time.Time
+	File    *fileRecord
+}
+
+// archiveBuilder collects the entries of an archive and keeps their paths unique.
+type archiveBuilder struct {
+	db      *sql.DB
+	entries []archiveEntry
+	used    map[string]bool
+}
+
+// archiveName makes a stored name safe to use as a single path element.
+func archiveName(name string) string {
+	name = strings.NewReplacer("/", "_", `\`, "_").Replace(strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// uniquePath returns dir/name, numbering the name if the path is already taken.
+func (b *archiveBuilder) uniquePath(dir, name string) string {
+	name = archiveName(name)
+	p := path.Join(dir, name)
+	ext := path.Ext(name)
+	for i := 2; b.used[p]; i++ {
+		p = path.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	b.used[p] = true
+	return p
+}
+
+func (b *archiveBuilder) addFile(dir string, file fileRecord) {
+	b.entries = append(b.entries, archiveEntry{Path: b.uniquePath(dir, file.Name), ModTime: file.CreatedAt, File: &file})
+}
+
+// addFolder adds a folder and everything below it under dir.
+func (b *archiveBuilder) addFolder(dir string, folder FolderEntry, depth int) error {
+	if depth > maxArchiveDepth {
+		return fmt.Errorf("folder nesting too deep")
+	}
+
+	folderDir := b.uniquePath(dir, folder.Name)
+	modTime, _ := time.Parse(time.RFC3339, folder.CreatedAt)
+	b.entries = append(b.entries, archiveEntry{Path: folderDir, ModTime: modTime})
+
+	folders, files, err := folderContents(b.db, folder.UID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range files {
+		file, err := lookupFile(b.db, strconv.FormatInt(entry.ID, 10), "")
+		if err != nil {
+			return err
+		}
+		b.addFile(folderDir, file)
+	}
+	for _, sub := range folders {
+		if err := b.addFolder(folderDir, sub, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectArchive resolves the files and folders to archive, which the user
+// owns or may view, and picks the archive name, which is the folder name when
+// a single folder is downloaded.
+func collectArchive(db *sql.DB, usr string, fileIDs, folderIDs []string) ([]archiveEntry, string, int, error) {
+	b := &archiveBuilder{db: db, used: map[string]bool{}}
+	name := "download"
+
+	if len(fileIDs) == 0 && len(folderIDs) == 0 {
+		return nil, name, http.StatusBadRequest, fmt.Errorf("nothing to download")
+	}
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, name, http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return nil, name, http.StatusInternalServerError, err
+	}
+
+	for _, fileID := range fileIDs {
+		file, err := lookupFile(db, fileID, usr)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, name, http.StatusNotFound, fmt.Errorf("file not found")
+			}
+			l.LogMessage(l.ERROR, "Database query failed: "+err.Error())
+			return nil, name, http.StatusInternalServerError, err
+		}
+		level, err := fileAccess(db, usr, file)
+		if err != nil {
+			l.LogMessage(l.ERROR, "File access check failed: "+err.Error())
+			return nil, name, http.StatusInternalServerError, err
+		}
+		if level < accessViewer {
+			return nil, name, http.StatusNotFound, fmt.Errorf("file not found")
+		}
+		b.addFile("", file)
+	}
+
+	for _, folderID := range folderIDs {
+		folder, _, status, err := accessibleFolder(db, userUID, folderID, accessViewer)
+		if err != nil {
+			return nil, name, status, err
+		}
+		if err := b.addFolder("", folder, 0); err != nil {
+			l.LogMessage(l.ERROR, "Archive listing failed: "+err.Error())
+			return nil, name, http.StatusInternalServerError, err
+		}
+	}
+
+	if len(fileIDs) == 0 && len(folderIDs) == 1 && len(b.entries) > 0 {
+		name = b.entries[0].Path
+	}
+
+	return b.entries, name, http.StatusOK, nil
+}
+
+func writeZip(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.Path, Modified: entry.ModTime}
+		if entry.File == nil {
+			header.Name += "/"
+			header.SetMode(os.ModeDir | 0755)
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header.Method = zip.Deflate
+		header.SetMode(0644)
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyBlob(fw, entry.File.HashedName); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, entries []archiveEntry) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Path, ModTime: entry.ModTime, Format: tar.FormatPAX}
+		if entry.File == nil {
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Tar needs the exact size up front, which older rows do not record
+		info, err := statBlob(entry.File.HashedName)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeReg
+		header.Mode = 0644
+		header.Size = info.Size
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyBlob(tw, entry.File.HashedName); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func copyBlob(w io.Writer, hashedName string) error {
+	reader, err := openBlob(hashedName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// DownloadArchive streams the given files and folders of the user as a ZIP
+// or, with format "tar.gz", a gzipped tarball. Nothing is written to disk.
+func DownloadArchive(c *gin.Context, usr string, fileIDs, folderIDs []string, format string) {
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar.gz" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip or tar.gz"})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer db.Close()
+
+	entries, name, status, err := collectArchive(db, usr, fileIDs, folderIDs)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType := "application/zip"
+	if format == "tar.gz" {
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	// Headers are already sent, so a failure can only cut the archive short
+	if format == "zip" {
+		err = writeZip(c.Writer, entries)
+	} else {
+		err = writeTarGz(c.Writer, entries)
+	}
+	if err != nil {
+		l.LogMessage(l.ERROR, "Archive streaming failed: "+err.Error())
+		return
+	}
+
+	l.LogMessage(l.INFO, "Archive served: "+name+"."+format)
+}
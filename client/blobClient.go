@@ -0,0 +1,295 @@
+package client
+
+import (
+	l "GoStore/log"
+	"GoStore/storage"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// blobMu guards the blobs table so a blob is never deleted while another
+// upload is taking a reference to it.
+var blobMu sync.Mutex
+
+// StoreBlob stores content under its SHA-256 digest and takes a reference to
+// it, returning its checksums and the detected content type. open is called
+// once to hash the content and again to upload it, unless a blob with the same
+// digest is already stored. Content that is not size bytes long or does not
+// match the expected checksums is rejected with ErrChecksumMismatch before
+// anything is written.
+func StoreBlob(open func() (io.ReadCloser, error), size int64, expected Checksums) (Checksums, string, error) {
+	r, err := open()
+	if err != nil {
+		return Checksums{}, "", err
+	}
+	// Keep the head of the content for MIME detection while hashing
+	head := &limitedBuffer{limit: 3072}
+	sums, n, err := hashContent(io.TeeReader(r, head))
+	r.Close()
+	if err != nil {
+		return Checksums{}, "", err
+	}
+	if n != size {
+		return sums, "", fmt.Errorf("%w: received %d bytes, expected %d", ErrChecksumMismatch, n, size)
+	}
+	if err := sums.verify(expected); err != nil {
+		l.LogMessage(l.WARNING, "Rejected upload: "+err.Error())
+		return sums, "", err
+	}
+	digest := sums.SHA256
+	contentType := mimetype.Detect(head.Bytes()).String()
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return sums, "", err
+	}
+	defer db.Close()
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM blobs WHERE digest = ?)`, digest).Scan(&exists)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Blob lookup failed: "+err.Error())
+		return sums, "", err
+	}
+
+	if exists {
+		if _, err := storage.Store.Stat(digest); err == nil {
+			// Blobs stored before checksums were recorded pick them up here
+			_, err = db.Exec(`UPDATE blobs SET ref_count = ref_count + 1, md5 = COALESCE(md5, ?), crc32c = COALESCE(crc32c, ?) WHERE digest = ?`, sums.MD5, sums.CRC32C, digest)
+			if err != nil {
+				l.LogMessage(l.ERROR, "Blob reference update failed: "+err.Error())
+				return sums, "", err
+			}
+			l.LogMessage(l.INFO, "Deduplicated upload: "+digest)
+			return sums, contentType, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			l.LogMessage(l.ERROR, "Storage stat failed: "+err.Error())
+			return sums, "", err
+		}
+		// The row outlived its content, store it again below
+	}
+
+	r, err = open()
+	if err != nil {
+		return sums, "", err
+	}
+	defer r.Close()
+
+	// With a master key configured every new blob gets its own data key
+	var body io.Reader = r
+	storedSize := size
+	var keyID, wrappedKey sql.NullString
+	if storage.EncryptionEnabled() {
+		dataKey, err := storage.NewDataKey()
+		if err != nil {
+			l.LogMessage(l.ERROR, "Data key generation failed: "+err.Error())
+			return sums, "", err
+		}
+		keyID.String, wrappedKey.String, err = storage.WrapKey(dataKey, digest)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Data key wrapping failed: "+err.Error())
+			return sums, "", err
+		}
+		keyID.Valid, wrappedKey.Valid = true, true
+		if body, err = storage.Encrypt(r, dataKey); err != nil {
+			l.LogMessage(l.ERROR, "Blob encryption failed: "+err.Error())
+			return sums, "", err
+		}
+		storedSize = storage.EncryptedSize(size)
+	}
+
+	if err := storage.Store.Put(digest, body, storedSize); err != nil {
+		l.LogMessage(l.ERROR, "Failed to store blob: "+err.Error())
+		return sums, "", err
+	}
+
+	upsertQuery := `INSERT INTO blobs (digest, size, ref_count, md5, crc32c, key_id, wrapped_key, created_at) VALUES (?, ?, 1, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(digest) DO UPDATE SET ref_count = ref_count + 1, md5 = excluded.md5, crc32c = excluded.crc32c,
+		key_id = excluded.key_id, wrapped_key = excluded.wrapped_key, scrub_error = NULL`
+	if _, err := db.Exec(upsertQuery, digest, size, sums.MD5, sums.CRC32C, keyID, wrappedKey); err != nil {
+		l.LogMessage(l.ERROR, "Blob insertion failed: "+err.Error())
+		return sums, "", err
+	}
+
+	// Thumbnails of the lost content were encrypted with its old data key
+	if exists {
+		deleteThumbnails(digest)
+	}
+
+	return sums, contentType, nil
+}
+
+// blobDataKey returns the data key of an encrypted blob, or nil for blobs
+// stored in plaintext.
+func blobDataKey(digest string) ([]byte, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
+	}
+	defer db.Close()
+
+	var keyID, wrappedKey sql.NullString
+	err = db.QueryRow(`SELECT key_id, wrapped_key FROM blobs WHERE digest = ?`, digest).Scan(&keyID, &wrappedKey)
+	if err == sql.ErrNoRows || (err == nil && !wrappedKey.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.UnwrapKey(keyID.String, wrappedKey.String, digest)
+}
+
+// openBlob opens the content of a blob, decrypting it if it is stored
+// encrypted. Readers from seekable backends stay seekable.
+func openBlob(digest string) (io.ReadCloser, error) {
+	dataKey, err := blobDataKey(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := storage.Store.Get(digest)
+	if err != nil || dataKey == nil {
+		return reader, err
+	}
+
+	plain, err := storage.Decrypt(reader, dataKey)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return plain, nil
+}
+
+// statBlob stats a blob, reporting the plaintext size of encrypted blobs.
+func statBlob(digest string) (storage.Info, error) {
+	info, err := storage.Store.Stat(digest)
+	if err != nil {
+		return info, err
+	}
+
+	dataKey, err := blobDataKey(digest)
+	if err != nil {
+		return info, err
+	}
+	if dataKey != nil {
+		info.Size = storage.PlainSize(info.Size)
+	}
+	return info, nil
+}
+
+// blobChecksums returns the recorded checksums of a blob. Files stored before
+// content addressing have no blob row and no known checksums.
+func blobChecksums(digest string) (Checksums, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return Checksums{}, err
+	}
+	defer db.Close()
+
+	var md5Sum, crc sql.NullString
+	err = db.QueryRow(`SELECT md5, crc32c FROM blobs WHERE digest = ?`, digest).Scan(&md5Sum, &crc)
+	if err == sql.ErrNoRows {
+		return Checksums{}, nil
+	}
+	if err != nil {
+		return Checksums{}, err
+	}
+	return Checksums{SHA256: digest, MD5: md5Sum.String, CRC32C: crc.String}, nil
+}
+
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// acquireBlob takes another reference to an already stored blob, e.g. when a
+// file is copied. It accepts a transaction so the reference is only taken if
+// the copy is committed.
+func acquireBlob(q dbExecer, digest string, size int64) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	// Blobs without a row are owned by the original file, which keeps its reference
+	upsertQuery := `INSERT INTO blobs (digest, size, ref_count, created_at) VALUES (?, ?, 2, CURRENT_TIMESTAMP)
+		ON CONFLICT(digest) DO UPDATE SET ref_count = ref_count + 1`
+	_, err := q.Exec(upsertQuery, digest, size)
+	return err
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// ReleaseBlob drops a reference to a blob and deletes its content once the
+// last file pointing at it is gone.
+func ReleaseBlob(digest string) error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	var refCount int
+	err = db.QueryRow(`SELECT ref_count FROM blobs WHERE digest = ?`, digest).Scan(&refCount)
+	if err == sql.ErrNoRows {
+		// Not content addressed, the file owns its blob outright
+		deleteThumbnails(digest)
+		return storage.Store.Delete(digest)
+	}
+	if err != nil {
+		l.LogMessage(l.ERROR, "Blob lookup failed: "+err.Error())
+		return err
+	}
+
+	if refCount > 1 {
+		_, err = db.Exec(`UPDATE blobs SET ref_count = ref_count - 1 WHERE digest = ?`, digest)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Blob reference update failed: "+err.Error())
+		}
+		return err
+	}
+
+	if err := storage.Store.Delete(digest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.LogMessage(l.ERROR, "Failed to delete blob: "+err.Error())
+		return err
+	}
+
+	if _, err := db.Exec(`DELETE FROM blobs WHERE digest = ?`, digest); err != nil {
+		l.LogMessage(l.ERROR, "Blob deletion failed: "+err.Error())
+		return err
+	}
+	deleteThumbnails(digest)
+
+	return nil
+}
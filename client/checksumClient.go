@@ -0,0 +1,149 @@
+package client
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Checksums are the digests of a blob's plaintext, all lowercase hex. SHA256
+// is also the blob's name in storage.
+type Checksums struct {
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// ErrChecksumMismatch is returned when content does not match the digest the
+// client said it sent.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// hashContent computes every checksum of r in one pass and counts its bytes.
+func hashContent(r io.Reader) (Checksums, int64, error) {
+	sha := sha256.New()
+	sum := md5.New()
+	crc := crc32.New(crc32cTable)
+
+	n, err := io.Copy(io.MultiWriter(sha, sum, crc), r)
+	if err != nil {
+		return Checksums{}, n, err
+	}
+	return Checksums{
+		SHA256: hex.EncodeToString(sha.Sum(nil)),
+		MD5:    hex.EncodeToString(sum.Sum(nil)),
+		CRC32C: hex.EncodeToString(crc.Sum(nil)),
+	}, n, nil
+}
+
+// verify checks the computed checksums against the expected ones. Digests the
+// client did not send are not checked.
+func (c Checksums) verify(expected Checksums) error {
+	for _, d := range []struct{ name, want, got string }{
+		{"sha-256", expected.SHA256, c.SHA256},
+		{"md5", expected.MD5, c.MD5},
+		{"crc32c", expected.CRC32C, c.CRC32C},
+	} {
+		if d.want != "" && d.want != d.got {
+			return fmt.Errorf("%w: expected %s %s, got %s", ErrChecksumMismatch, d.name, d.want, d.got)
+		}
+	}
+	return nil
+}
+
+// DigestHeader formats the checksums as an RFC 3230 Digest header value,
+// e.g. "sha-256=<base64>,md5=<base64>".
+func (c Checksums) DigestHeader() string {
+	var parts []string
+	for _, d := range []struct{ name, value string }{
+		{"sha-256", c.SHA256},
+		{"md5", c.MD5},
+		{"crc32c", c.CRC32C},
+	} {
+		if raw, err := hex.DecodeString(d.value); err == nil && len(raw) > 0 {
+			parts = append(parts, d.name+"="+base64.StdEncoding.EncodeToString(raw))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ExpectedChecksums collects the digests a client expects its upload to have,
+// from a Digest header ("sha-256=<base64>,md5=<base64>"), a Content-MD5 header
+// and explicitly sent fields. Values may be hex or base64. Sources that
+// disagree about the same algorithm are rejected.
+func ExpectedChecksums(digest, contentMD5 string, fields Checksums) (Checksums, error) {
+	var expected Checksums
+
+	set := func(target *string, name, value string, size int) error {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return nil
+		}
+		normalized, err := normalizeDigest(value, size)
+		if err != nil {
+			return fmt.Errorf("invalid %s digest: %q", name, value)
+		}
+		if *target != "" && *target != normalized {
+			return fmt.Errorf("conflicting %s digests", name)
+		}
+		*target = normalized
+		return nil
+	}
+
+	for _, part := range strings.Split(digest, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		var err error
+		// Algorithms we do not compute, e.g. sha-512, are ignored
+		switch strings.ToLower(strings.TrimSpace(alg)) {
+		case "sha-256":
+			err = set(&expected.SHA256, "sha-256", value, sha256.Size)
+		case "md5":
+			err = set(&expected.MD5, "md5", value, md5.Size)
+		case "crc32c":
+			err = set(&expected.CRC32C, "crc32c", value, crc32.Size)
+		}
+		if err != nil {
+			return expected, err
+		}
+	}
+
+	for _, d := range []struct {
+		target      *string
+		name, value string
+		size        int
+	}{
+		{&expected.MD5, "md5", contentMD5, md5.Size},
+		{&expected.SHA256, "sha-256", fields.SHA256, sha256.Size},
+		{&expected.MD5, "md5", fields.MD5, md5.Size},
+		{&expected.CRC32C, "crc32c", fields.CRC32C, crc32.Size},
+	} {
+		if err := set(d.target, d.name, d.value, d.size); err != nil {
+			return expected, err
+		}
+	}
+
+	return expected, nil
+}
+
+// normalizeDigest decodes a hex or base64 digest of size bytes to lowercase hex.
+func normalizeDigest(value string, size int) (string, error) {
+	if raw, err := hex.DecodeString(value); err == nil && len(raw) == size {
+		return hex.EncodeToString(raw), nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if raw, err := enc.DecodeString(value); err == nil && len(raw) == size {
+			return hex.EncodeToString(raw), nil
+		}
+	}
+	return "", fmt.Errorf("invalid digest")
+}
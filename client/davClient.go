@@ -0,0 +1,680 @@
+package client
+
+import (
+	"GoStore/auth"
+	l "GoStore/log"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// How long a successful WebDAV login is remembered. Clients send credentials
+// with every request and checking bcrypt hashes each time is slow.
+const davAuthTTL = 5 * time.Minute
+
+type davCredential struct {
+	sum     [sha256.Size]byte
+	userUID string
+	expires time.Time
+}
+
+// davAuthCache maps usernames to recently verified credentials.
+var davAuthCache sync.Map
+
+// davChecksumsKey carries the checksums a PUT request expects through the
+// request context to the file it writes.
+type davChecksumsKey struct{}
+
+// davLocks holds one lock system per user, since every user sees their own
+// root at the same paths.
+var davLocks sync.Map
+
+// davLogin checks Basic auth credentials the same way as Login and returns
+// the user's UID and whether the user may change files. Only the password
+// check is cached; roles and two-factor settings apply to the next request.
+func davLogin(usr, pwd string) (string, bool, error) {
+	userUID, err := davPassword(usr, pwd)
+	if err != nil {
+		return "", false, err
+	}
+
+	perms, err := auth.UserPermissions(usr)
+	if err != nil {
+		return "", false, err
+	}
+	if !perms[auth.PermFilesRead] {
+		return "", false, fmt.Errorf("user has no access to files")
+	}
+
+	// Basic auth has no way to ask for a second factor
+	enforced, err := auth.MFAEnforced(usr)
+	if err != nil {
+		return "", false, err
+	}
+	if enforced {
+		l.LogMessage(l.WARNING, "WebDAV login refused for "+usr+": two-factor authentication is enabled")
+		return "", false, fmt.Errorf("two-factor authentication is enabled")
+	}
+
+	return userUID, perms[auth.PermFilesWrite], nil
+}
+
+// davPassword checks a password, remembering it for davAuthTTL.
+func davPassword(usr, pwd string) (string, error) {
+	sum := sha256.Sum256([]byte(pwd))
+	if v, ok := davAuthCache.Load(usr); ok {
+		cred := v.(davCredential)
+		if time.Now().Before(cred.expires) && subtle.ConstantTimeCompare(cred.sum[:], sum[:]) == 1 {
+			return cred.userUID, nil
+		}
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return "", err
+	}
+	defer db.Close()
+
+	userUID, err := verifyPassword(db, usr, pwd)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureRootFolder(db, userUID); err != nil {
+		return "", err
+	}
+
+	// Drop expired logins of other users, so the cache only holds users
+	// active within the last davAuthTTL
+	now := time.Now()
+	davAuthCache.Range(func(key, v any) bool {
+		if now.After(v.(davCredential).expires) {
+			davAuthCache.Delete(key)
+		}
+		return true
+	})
+	davAuthCache.Store(usr, davCredential{sum: sum, userUID: userUID, expires: now.Add(davAuthTTL)})
+	return userUID, nil
+}
+
+// ForgetDAVCredentials drops the remembered WebDAV login of a user, so that
+// an old password stops working at once, e.g. after it was changed or the
+// user was deleted.
+func ForgetDAVCredentials(usr string) {
+	davAuthCache.Delete(usr)
+}
+
+// DAVHandler serves each user's files over WebDAV under prefix, authenticated
+// with HTTP Basic auth using the same credentials as the client login.
+func DAVHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usr, pwd, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="GoStore"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userUID, canWrite, err := davLogin(usr, pwd)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="GoStore"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		default:
+			if !canWrite {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		if r.Method == http.MethodPut {
+			expected, err := ExpectedChecksums(r.Header.Get("Digest"), r.Header.Get("Content-MD5"), Checksums{})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), davChecksumsKey{}, expected))
+		}
+
+		ls, _ := davLocks.LoadOrStore(usr, webdav.NewMemLS())
+		handler := &webdav.Handler{
+			Prefix:     prefix,
+			FileSystem: &davFS{usr: usr, userUID: userUID},
+			LockSystem: ls.(webdav.LockSystem),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					l.LogMessage(l.WARNING, "WebDAV "+r.Method+" "+r.URL.Path+": "+err.Error())
+				}
+			},
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// davFS is a webdav.FileSystem over the folders and files of one user. Paths
+// are resolved by name from the user's root folder.
+type davFS struct {
+	usr     string
+	userUID string
+}
+
+// davNode is a resolved path: a folder, or a file when file is not nil.
+type davNode struct {
+	folder FolderEntry
+	file   *fileRecord
+	isRoot bool
+}
+
+func davSplit(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// childFolder finds a live subfolder by name.
+func childFolder(db *sql.DB, parentUID, name string) (FolderEntry, error) {
+	var folder FolderEntry
+	var parentID, createdAt sql.NullString
+	query := `SELECT UID, name, parent_id, created_at FROM folders WHERE parent_id = ? AND name = ? AND trash_id IS NULL ORDER BY created_at LIMIT 1`
+	err := db.QueryRow(query, parentUID, name).Scan(&folder.UID, &folder.Name, &parentID, &createdAt)
+	folder.ParentID = parentID.String
+	folder.CreatedAt = createdAt.String
+	return folder, err
+}
+
+// childFile finds a live file by name. Duplicate names resolve to the oldest.
+func childFile(db *sql.DB, folderUID, name string) (fileRecord, error) {
+	var fileID int64
+	query := `SELECT id FROM files WHERE folder_id = ? AND name = ? AND trash_id IS NULL ORDER BY id LIMIT 1`
+	if err := db.QueryRow(query, folderUID, name).Scan(&fileID); err != nil {
+		return fileRecord{}, err
+	}
+	return lookupFile(db, strconv.FormatInt(fileID, 10), "")
+}
+
+// resolve walks a path from the user's root. Folders shadow files of the same name.
+func (d *davFS) resolve(db *sql.DB, name string) (davNode, error) {
+	root, err := resolveFolder(db, d.userUID, "root")
+	if err != nil {
+		return davNode{}, err
+	}
+	node := davNode{folder: root, isRoot: true}
+
+	parts := davSplit(name)
+	for i, part := range parts {
+		folder, err := childFolder(db, node.folder.UID, part)
+		if err == nil {
+			node = davNode{folder: folder}
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return node, err
+		}
+
+		// Only the last element may be a file
+		if i == len(parts)-1 {
+			file, err := childFile(db, node.folder.UID, part)
+			if err == nil {
+				return davNode{folder: node.folder, file: &file}, nil
+			}
+			if err != sql.ErrNoRows {
+				return node, err
+			}
+		}
+		return node, os.ErrNotExist
+	}
+
+	return node, nil
+}
+
+// resolveParent resolves the folder a new item at name would be created in.
+func (d *davFS) resolveParent(db *sql.DB, name string) (FolderEntry, string, error) {
+	parts := davSplit(name)
+	if len(parts) == 0 {
+		return FolderEntry{}, "", os.ErrInvalid
+	}
+	parent, err := d.resolve(db, strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return FolderEntry{}, "", err
+	}
+	if parent.file != nil {
+		return FolderEntry{}, "", os.ErrNotExist
+	}
+	return parent.folder, parts[len(parts)-1], nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	parent, base, err := d.resolveParent(db, name)
+	if err != nil {
+		return err
+	}
+	if err := validItemName(base); err != nil {
+		return err
+	}
+	if _, err := d.resolve(db, name); err == nil {
+		return os.ErrExist
+	}
+
+	if _, err := NewFolder(d.userUID, base, parent.UID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	node, err := d.resolve(db, name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if exists && node.file == nil {
+			return nil, fmt.Errorf("%s is a folder", name)
+		}
+		if exists && flag&os.O_EXCL != 0 {
+			return nil, os.ErrExist
+		}
+		if !exists && flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+
+		parent, base, err := d.resolveParent(db, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := validItemName(base); err != nil {
+			return nil, err
+		}
+		expected, _ := ctx.Value(davChecksumsKey{}).(Checksums)
+		return newDavWriteFile(d.userUID, parent.UID, base, expected)
+	}
+
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	if node.file == nil {
+		return &davDir{folder: node.folder, info: folderInfo(node.folder)}, nil
+	}
+
+	info := fileInfo(*node.file)
+	if info.size == 0 {
+		// Older rows do not record the size
+		if stat, err := statBlob(node.file.HashedName); err == nil {
+			info.size = stat.Size
+		}
+	}
+	return &davReadFile{file: *node.file, info: info}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	node, err := d.resolve(db, name)
+	if err != nil {
+		return err
+	}
+	if node.isRoot {
+		return os.ErrPermission
+	}
+
+	// Deleted items go to the trash like everywhere else
+	if node.file != nil {
+		return trashFile(db, d.userUID, *node.file)
+	}
+	if _, err := TrashFolder(d.usr, node.folder.UID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	node, err := d.resolve(db, oldName)
+	if err != nil {
+		return err
+	}
+	if node.isRoot {
+		return os.ErrPermission
+	}
+
+	parent, base, err := d.resolveParent(db, newName)
+	if err != nil {
+		return err
+	}
+	if err := validItemName(base); err != nil {
+		return err
+	}
+	if _, err := d.resolve(db, newName); err == nil {
+		return os.ErrExist
+	}
+
+	if node.file != nil {
+		_, err = db.Exec(`UPDATE files SET folder_id = ?, name = ? WHERE id = ?`, parent.UID, base, node.file.ID)
+		return err
+	}
+
+	var cycle bool
+	err = db.QueryRow(folderSubtree+`SELECT EXISTS(SELECT 1 FROM subtree WHERE UID = ?)`, node.folder.UID, parent.UID).Scan(&cycle)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return fmt.Errorf("a folder cannot be moved into itself or one of its subfolders")
+	}
+
+	_, err = db.Exec(`UPDATE folders SET parent_id = ?, name = ? WHERE UID = ?`, parent.UID, base, node.folder.UID)
+	return err
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	node, err := d.resolve(db, name)
+	if err != nil {
+		return nil, err
+	}
+	if node.file != nil {
+		return fileInfo(*node.file), nil
+	}
+	return folderInfo(node.folder), nil
+}
+
+// davInfo describes a file or folder. It also reports the blob digest as the
+// ETag and the content type detected at upload, so PROPFIND never has to read
+// file contents.
+type davInfo struct {
+	name        string
+	size        int64
+	modTime     time.Time
+	dir         bool
+	etag        string
+	contentType string
+}
+
+func fileInfo(file fileRecord) *davInfo {
+	return &davInfo{name: file.Name, size: file.Size, modTime: file.CreatedAt, etag: file.HashedName, contentType: file.ContentType}
+}
+
+func folderInfo(folder FolderEntry) *davInfo {
+	modTime, _ := time.Parse(time.RFC3339, folder.CreatedAt)
+	return &davInfo{name: folder.Name, modTime: modTime, dir: true}
+}
+
+func (i *davInfo) Name() string       { return i.name }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.modTime }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() interface{}   { return nil }
+
+func (i *davInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *davInfo) ETag(ctx context.Context) (string, error) {
+	if i.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.etag + `"`, nil
+}
+
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.dir || i.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.contentType, nil
+}
+
+// davDir lists a folder.
+type davDir struct {
+	folder  FolderEntry
+	info    *davInfo
+	entries []fs.FileInfo
+	loaded  bool
+	pos     int
+}
+
+func (f *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.loaded {
+		db, err := sql.Open("sqlite3", "main.db")
+		if err != nil {
+			return nil, err
+		}
+		folders, files, err := folderContents(db, f.folder.UID)
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, folder := range folders {
+			f.entries = append(f.entries, folderInfo(folder))
+		}
+		for _, file := range files {
+			modTime, _ := time.Parse(time.RFC3339, file.CreatedAt)
+			f.entries = append(f.entries, &davInfo{name: file.Name, size: file.Size, modTime: modTime, etag: file.HashedName, contentType: file.ContentType})
+		}
+		f.loaded = true
+	}
+
+	rest := f.entries[f.pos:]
+	if count <= 0 {
+		f.pos = len(f.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	f.pos += count
+	return rest[:count], nil
+}
+
+func (f *davDir) Stat() (fs.FileInfo, error)                   { return f.info, nil }
+func (f *davDir) Read(p []byte) (int, error)                   { return 0, fmt.Errorf("%s is a folder", f.folder.Name) }
+func (f *davDir) Write(p []byte) (int, error)                  { return 0, fmt.Errorf("%s is a folder", f.folder.Name) }
+func (f *davDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (f *davDir) Close() error                                 { return nil }
+
+// davReadFile reads a stored file. The blob is opened lazily, so a PROPFIND
+// or a seek to the end to learn the size never touches storage.
+type davReadFile struct {
+	file   fileRecord
+	info   *davInfo
+	reader io.ReadCloser
+	pos    int64 // position requested by Seek
+	rpos   int64 // position of reader
+}
+
+func (f *davReadFile) Read(p []byte) (int, error) {
+	if f.reader == nil || f.rpos != f.pos {
+		if err := f.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.reader.Read(p)
+	f.pos += int64(n)
+	f.rpos = f.pos
+	return n, err
+}
+
+// reopen positions the blob reader at pos, seeking when the backend allows
+// it and otherwise reading forward, from the start if need be.
+func (f *davReadFile) reopen() error {
+	if f.reader != nil && f.rpos > f.pos {
+		if _, ok := f.reader.(io.ReadSeeker); !ok {
+			f.reader.Close()
+			f.reader = nil
+		}
+	}
+	if f.reader == nil {
+		reader, err := openBlob(f.file.HashedName)
+		if err != nil {
+			return err
+		}
+		f.reader = reader
+		f.rpos = 0
+	}
+
+	if rs, ok := f.reader.(io.ReadSeeker); ok {
+		if _, err := rs.Seek(f.pos, io.SeekStart); err != nil {
+			return err
+		}
+		f.rpos = f.pos
+		return nil
+	}
+	skipped, err := io.CopyN(io.Discard, f.reader, f.pos-f.rpos)
+	f.rpos += skipped
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (f *davReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return f.pos, os.ErrInvalid
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *davReadFile) Close() error {
+	if f.reader != nil {
+		return f.reader.Close()
+	}
+	return nil
+}
+
+func (f *davReadFile) Stat() (fs.FileInfo, error)               { return f.info, nil }
+func (f *davReadFile) Readdir(count int) ([]fs.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *davReadFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+
+// davWriteFile buffers an upload in a temporary file and stores it when the
+// client closes it. Writing to an existing name adds a new version.
+type davWriteFile struct {
+	userUID   string
+	folderUID string
+	tmp       *os.File
+	info      *davInfo
+	expected  Checksums
+}
+
+func newDavWriteFile(userUID, folderUID, name string, expected Checksums) (*davWriteFile, error) {
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(partialDir, "dav-*")
+	if err != nil {
+		return nil, err
+	}
+	return &davWriteFile{
+		userUID:   userUID,
+		folderUID: folderUID,
+		tmp:       tmp,
+		info:      &davInfo{name: name, modTime: time.Now()},
+		expected:  expected,
+	}, nil
+}
+
+func (f *davWriteFile) Write(p []byte) (int, error) {
+	n, err := f.tmp.Write(p)
+	f.info.size += int64(n)
+	return n, err
+}
+
+func (f *davWriteFile) Close() error {
+	defer os.Remove(f.tmp.Name())
+	if err := f.tmp.Close(); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		return err
+	}
+	_, err = checkQuota(db, f.userUID, f.info.size)
+	db.Close()
+	if err != nil {
+		return err
+	}
+
+	// A checksum mismatch fails the PUT and nothing is stored
+	sums, contentType, err := StoreBlob(func() (io.ReadCloser, error) { return os.Open(f.tmp.Name()) }, f.info.size, f.expected)
+	if err != nil {
+		return err
+	}
+	digest := sums.SHA256
+	// Writes over WebDAV need files.write, so replacing a file is allowed
+	if _, _, err := SaveFileMetadata(f.userUID, f.folderUID, f.info.name, digest, contentType, f.info.size, true); err != nil {
+		ReleaseBlob(digest)
+		return err
+	}
+
+	// Stat was taken before Close, so this also fills in the PUT response ETag
+	f.info.etag = digest
+	f.info.contentType = contentType
+	return nil
+}
+
+func (f *davWriteFile) Read(p []byte) (int, error) { return 0, os.ErrPermission }
+func (f *davWriteFile) Seek(offset int64, whence int) (int64, error) {
+	return f.tmp.Seek(offset, whence)
+}
+func (f *davWriteFile) Readdir(count int) ([]fs.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *davWriteFile) Stat() (fs.FileInfo, error)               { return f.info, nil }
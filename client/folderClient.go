@@ -0,0 +1,191 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type FolderEntry struct {
+	UID       string `json:"UID"`
+	Name      string `json:"name"`
+	ParentID  string `json:"parent_id"`
+	CreatedAt string `json:"created_at"`
+}
+
+type FileEntry struct {
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	HashedName  string     `json:"hashed_name"`
+	ContentType string     `json:"content_type"`
+	Size        int64      `json:"size"`
+	CreatedAt   string     `json:"created_at"`
+	Checksums   *Checksums `json:"checksums,omitempty"`
+}
+
+type FolderListing struct {
+	Folder  FolderEntry   `json:"folder"`
+	Folders []FolderEntry `json:"folders"`
+	Files   []FileEntry   `json:"files"`
+}
+
+// folderSubtree selects the UID of a folder and all of its live descendants
+// into a "subtree" table for the statement that follows it.
+const folderSubtree = `WITH RECURSIVE subtree(UID) AS (
+		SELECT UID FROM folders WHERE UID = ?
+		UNION ALL
+		SELECT f.UID FROM folders f JOIN subtree s ON f.parent_id = s.UID WHERE f.trash_id IS NULL
+	) `
+
+// getUserUID looks up the UID of a user by username.
+func getUserUID(db *sql.DB, usr string) (string, error) {
+	var userUID string
+	err := db.QueryRow(`SELECT UID FROM users WHERE username = ?`, usr).Scan(&userUID)
+	if err != nil {
+		return "", err
+	}
+	return userUID, nil
+}
+
+// UserUID looks up the UID of a user by username.
+func UserUID(usr string) (string, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return "", err
+	}
+	defer db.Close()
+
+	return getUserUID(db, usr)
+}
+
+// resolveFolder returns the folder with the given ID if it belongs to the
+// user. The "root" alias resolves to the user's top level folder.
+func resolveFolder(db *sql.DB, userUID, folderID string) (FolderEntry, error) {
+	var folder FolderEntry
+	var parentID, createdAt sql.NullString
+
+	var row *sql.Row
+	if folderID == "root" {
+		row = db.QueryRow(`SELECT UID, name, parent_id, created_at FROM folders WHERE user_UID = ? AND parent_id IS NULL`, userUID)
+	} else {
+		row = db.QueryRow(`SELECT UID, name, parent_id, created_at FROM folders WHERE UID = ? AND user_UID = ? AND trash_id IS NULL`, folderID, userUID)
+	}
+
+	err := row.Scan(&folder.UID, &folder.Name, &parentID, &createdAt)
+	if err != nil {
+		return folder, err
+	}
+	folder.ParentID = parentID.String
+	folder.CreatedAt = createdAt.String
+
+	return folder, nil
+}
+
+// ListFolder returns the subfolders and files inside a folder the user owns
+// or has been granted access to.
+func ListFolder(usr, folderID string) (FolderListing, int, error) {
+	listing := FolderListing{Folders: []FolderEntry{}, Files: []FileEntry{}}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return listing, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return listing, http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return listing, http.StatusInternalServerError, err
+	}
+
+	var status int
+	listing.Folder, _, status, err = accessibleFolder(db, userUID, folderID, accessViewer)
+	if err != nil {
+		return listing, status, err
+	}
+
+	listing.Folders, listing.Files, err = folderContents(db, listing.Folder.UID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder listing failed: "+err.Error())
+		return listing, http.StatusInternalServerError, err
+	}
+
+	return listing, http.StatusOK, nil
+}
+
+// folderContents returns the live subfolders and files directly inside a folder.
+func folderContents(db *sql.DB, folderUID string) ([]FolderEntry, []FileEntry, error) {
+	folders := []FolderEntry{}
+	files := []FileEntry{}
+
+	rows, err := db.Query(`SELECT UID, name, parent_id, created_at FROM folders WHERE parent_id = ? AND trash_id IS NULL ORDER BY name`, folderUID)
+	if err != nil {
+		return folders, files, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var folder FolderEntry
+		var parentID, createdAt sql.NullString
+		if err := rows.Scan(&folder.UID, &folder.Name, &parentID, &createdAt); err != nil {
+			return folders, files, err
+		}
+		folder.ParentID = parentID.String
+		folder.CreatedAt = createdAt.String
+		folders = append(folders, folder)
+	}
+	if err = rows.Err(); err != nil {
+		return folders, files, err
+	}
+
+	fileRows, err := db.Query(`SELECT id, name, hashed_name, content_type, size, created_at FROM files WHERE folder_id = ? AND trash_id IS NULL ORDER BY name`, folderUID)
+	if err != nil {
+		return folders, files, err
+	}
+	defer fileRows.Close()
+
+	for fileRows.Next() {
+		var file FileEntry
+		var createdAt sql.NullString
+		if err := fileRows.Scan(&file.ID, &file.Name, &file.HashedName, &file.ContentType, &file.Size, &createdAt); err != nil {
+			return folders, files, err
+		}
+		file.CreatedAt = createdAt.String
+		files = append(files, file)
+	}
+	return folders, files, fileRows.Err()
+}
+
+// folderPath rebuilds the path of a folder from its parent_id chain, e.g.
+// "/docs/reports". The user's root folder is "/".
+func folderPath(db *sql.DB, folderUID string) (string, error) {
+	var names []string
+	current := folderUID
+
+	// Guard against cycles in corrupted data
+	for depth := 0; depth < 256; depth++ {
+		var name string
+		var parentID sql.NullString
+		err := db.QueryRow(`SELECT name, parent_id FROM folders WHERE UID = ?`, current).Scan(&name, &parentID)
+		if err != nil {
+			return "", err
+		}
+		if !parentID.Valid {
+			break
+		}
+		names = append([]string{name}, names...)
+		if parentID.String == "" {
+			break
+		}
+		current = parentID.String
+	}
+
+	return "/" + strings.Join(names, "/"), nil
+}
@@ -5,62 +5,137 @@ import (
 	"GoStore/log"
 	"database/sql"
 	"fmt"
+	"net/http"
 
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func Login(usr, pwd string) (string, string, error) {
-	log.LogMessage(log.SUCS, "Working client")
-
-	db, err := sql.Open("sqlite3", "main.db")
-	if err != nil {
-		log.LogMessage(log.ERROR, "Database connection failed: "+err.Error())
-		return "", "", err
-	}
-	defer db.Close()
-
+// verifyPassword checks a user's password and returns the user's UID.
+func verifyPassword(db *sql.DB, usr, pwd string) (string, error) {
 	var storedPwd, userUID string
-	err = db.QueryRow("SELECT UID, pwd FROM users WHERE username = ?", usr).Scan(&userUID, &storedPwd)
+	err := db.QueryRow("SELECT UID, pwd FROM users WHERE username = ?", usr).Scan(&userUID, &storedPwd)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.LogMessage(log.ERROR, "User not found")
-			return "", "", fmt.Errorf("user not found")
+			return "", fmt.Errorf("user not found")
 		}
 		log.LogMessage(log.ERROR, "Query failed: "+err.Error())
-		return "", "", err
+		return "", err
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(storedPwd), []byte(pwd))
 	if err != nil {
 		log.LogMessage(log.ERROR, "Password mismatch: "+err.Error())
-		return "", "", fmt.Errorf("invalid credentials")
+		return "", fmt.Errorf("invalid credentials")
 	}
 
-	// Ensure root folder exists for the user
+	return userUID, nil
+}
+
+// ensureRootFolder creates the user's root folder on first login.
+func ensureRootFolder(db *sql.DB, userUID string) error {
 	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM folders WHERE user_UID = ? AND parent_id IS NULL", userUID).Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM folders WHERE user_UID = ? AND parent_id IS NULL", userUID).Scan(&count)
 
 	if err != nil {
 		log.LogMessage(log.ERROR, "Failed to create root folder: "+err.Error())
-		return "", "", err
+		return err
 	}
 
 	if count == 0 {
 		rootUID := uuid.New().String()
-		_, err = db.Exec("INSERT INTO folders (UID, user_UID, name, parent_id) VALUES (?, ?, 'root', NULL)", rootUID, userUID)
+		_, err = db.Exec("INSERT INTO folders (UID, user_UID, name, parent_id, created_at) VALUES (?, ?, 'root', NULL, CURRENT_TIMESTAMP)", rootUID, userUID)
 		if err != nil {
-			return "", "", err
+			return err
 		}
 		log.LogMessage(log.SUCS, "Root folder created for user:")
 	}
 
-	token, err := auth.GenerateTokenJWT(usr, pwd)
+	return nil
+}
+
+// Login checks a user's credentials. It returns the tokens of a new session,
+// or an MFA token when the login has to be finished with a second factor,
+// and the user's UID.
+func Login(usr, pwd string) (auth.LoginResult, string, error) {
+	log.LogMessage(log.SUCS, "Working client")
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		log.LogMessage(log.ERROR, "Database connection failed: "+err.Error())
+		return auth.LoginResult{}, "", err
+	}
+	defer db.Close()
+
+	userUID, err := verifyPassword(db, usr, pwd)
+	if err != nil {
+		return auth.LoginResult{}, "", err
+	}
+
+	perms, err := auth.UserPermissions(usr)
+	if err != nil {
+		return auth.LoginResult{}, "", err
+	}
+	if !perms[auth.PermFilesRead] {
+		return auth.LoginResult{}, "", fmt.Errorf("user has no access to files")
+	}
+
+	// Ensure root folder exists for the user
+	if err := ensureRootFolder(db, userUID); err != nil {
+		return auth.LoginResult{}, "", err
+	}
+
+	result, err := auth.StartLogin(auth.SessionUser, usr)
+	if err != nil {
+		log.LogMessage(log.ERROR, "Session creation failed: "+err.Error())
+		return auth.LoginResult{}, "", err
+	}
+
+	return result, userUID, nil
+}
+
+// ChangePassword replaces a user's password after checking the current one.
+// All sessions of the user are revoked and the tokens of a new session are
+// returned, so only the client that changed the password stays signed in.
+func ChangePassword(usr, oldPwd, newPwd string) (string, string, int, error) {
+	if newPwd == "" {
+		return "", "", http.StatusBadRequest, fmt.Errorf("new password must not be empty")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		log.LogMessage(log.ERROR, "Database connection failed: "+err.Error())
+		return "", "", http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	if _, err := verifyPassword(db, usr, oldPwd); err != nil {
+		return "", "", http.StatusUnauthorized, err
+	}
+
+	hashedPwd, err := bcrypt.GenerateFromPassword([]byte(newPwd), bcrypt.DefaultCost)
+	if err != nil {
+		log.LogMessage(log.ERROR, "Password hashing failed: "+err.Error())
+		return "", "", http.StatusInternalServerError, err
+	}
+
+	if _, err := db.Exec(`UPDATE users SET pwd = ? WHERE username = ?`, string(hashedPwd), usr); err != nil {
+		log.LogMessage(log.ERROR, "Update query failed: "+err.Error())
+		return "", "", http.StatusInternalServerError, err
+	}
+
+	if err := auth.RevokeSessions(usr); err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	ForgetDAVCredentials(usr)
+
+	token, refreshToken, err := auth.NewSession(auth.SessionUser, usr)
 	if err != nil {
-		log.LogMessage(log.ERROR, "Token generation failed: "+err.Error())
-		return "", "", err
+		log.LogMessage(log.ERROR, "Session creation failed: "+err.Error())
+		return "", "", http.StatusInternalServerError, err
 	}
 
-	return token, userUID, nil
+	return token, refreshToken, http.StatusOK, nil
 }
@@ -1,50 +1,22 @@
 package client
 
 import (
-	"GoStore/auth"
 	l "GoStore/log"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
-// IsItUser checks if the provided token belongs to the given user.
-func IsItUser(usr, token string) (bool, error) {
-	db, err := sql.Open("sqlite3", "main.db")
-	if err != nil {
-		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
-		return false, err
-	}
-	defer db.Close()
-
-	// Authenticate the token
-	isValid, claims := auth.AuthenticateTokenJWT(token)
-	if !isValid {
-		return false, fmt.Errorf("invalid token")
-	}
-
-	// Check if the user in the token matches the provided user
-	if claims.Username != usr {
-		return false, fmt.Errorf("token does not match the user")
-	}
-
-	// Check if the user exists
-	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`
-	err = db.QueryRow(query, usr).Scan(&exists)
-	if err != nil {
-		l.LogMessage(l.ERROR, "Query error: "+err.Error())
-		return false, err
-	}
-
-	return exists, nil
-}
-
 // NewFolder creates a new folder for a user.
 func NewFolder(usr, name, parent string) (int, error) {
 	db, err := sql.Open("sqlite3", "main.db")
@@ -66,26 +38,30 @@ func NewFolder(usr, name, parent string) (int, error) {
 		return http.StatusNotFound, fmt.Errorf("user not found")
 	}
 
-	// Check if parent folder exists (if provided)
+	// Check if parent folder exists (if provided). Folders created in a
+	// shared folder belong to its owner, like everything else in it.
+	ownerUID := usr
 	if parent != "" {
-		var parentExists bool
-		query = `SELECT EXISTS(SELECT 1 FROM folders WHERE UID = ?)`
-		err = db.QueryRow(query, parent).Scan(&parentExists)
-		if err != nil {
+		level, parentOwner, err := folderAccess(db, usr, parent)
+		if err != nil && err != sql.ErrNoRows {
 			l.LogMessage(l.ERROR, "Parent folder check failed: "+err.Error())
 			return http.StatusInternalServerError, err
 		}
-		if !parentExists {
+		if level < accessViewer {
 			return http.StatusBadRequest, fmt.Errorf("parent folder not found")
 		}
+		if level < accessEditor {
+			return http.StatusForbidden, fmt.Errorf("insufficient permission on parent folder")
+		}
+		ownerUID = parentOwner
 	}
 
 	// Generate a new UID for the folder
 	folderUID := uuid.New().String()
 
 	// Insert the new folder
-	insertQuery := `INSERT INTO folders (UID, user_UID, name, parent_id) VALUES (?, ?, ?, ?)`
-	_, err = db.Exec(insertQuery, folderUID, usr, name, parent)
+	insertQuery := `INSERT INTO folders (UID, user_UID, name, parent_id, created_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)`
+	_, err = db.Exec(insertQuery, folderUID, ownerUID, name, parent)
 	if err != nil {
 		l.LogMessage(l.ERROR, "Folder creation failed: "+err.Error())
 		return http.StatusInternalServerError, err
@@ -94,64 +70,154 @@ func NewFolder(usr, name, parent string) (int, error) {
 	return http.StatusCreated, nil
 }
 
-// SaveFileMetadata stores file metadata in the database.
-func SaveFileMetadata(usr, folderID, fileName, hashedName string) (int, error) {
+// SaveFileMetadata stores file metadata in the database and returns the new file ID.
+// A file of the same name gets a new version only if canReplace is set, i.e.
+// the caller may change existing files and not just upload new ones.
+func SaveFileMetadata(usr, folderID, fileName, hashedName, contentType string, size int64, canReplace bool) (int64, int, error) {
 	db, err := sql.Open("sqlite3", "main.db")
 	if err != nil {
 		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
-		return http.StatusInternalServerError, err
+		return 0, http.StatusInternalServerError, err
 	}
 	defer db.Close()
 
-	// Check if the folder exists and belongs to the user
-	var folderExists bool
-	query := `SELECT EXISTS(SELECT 1 FROM folders WHERE UID = ? AND user_UID = ?);`
+	// Check if the folder exists and the user may upload to it
 	l.LogMessage(l.INFO, "USER_UID: "+usr)
 	l.LogMessage(l.INFO, "folderID: "+folderID)
-	err = db.QueryRow(query, folderID, usr).Scan(&folderExists)
-	l.LogMessage(l.INFO, folderExists)
-	if err != nil {
+	level, _, err := folderAccess(db, usr, folderID)
+	if err != nil && err != sql.ErrNoRows {
 		l.LogMessage(l.ERROR, "Folder existence check failed: "+err.Error())
-		return http.StatusInternalServerError, err
+		return 0, http.StatusInternalServerError, err
 	}
-	if !folderExists {
-		return http.StatusForbidden, fmt.Errorf("folder not found or unauthorized access")
+	if level < accessEditor {
+		return 0, http.StatusForbidden, fmt.Errorf("folder not found or unauthorized access")
+	}
+
+	// Uploading a name that already exists in the folder adds a new version
+	var existingID int64
+	var existingHash string
+	query := `SELECT id, hashed_name FROM files WHERE folder_id = ? AND name = ? AND trash_id IS NULL ORDER BY id LIMIT 1`
+	err = db.QueryRow(query, folderID, fileName).Scan(&existingID, &existingHash)
+	if err == nil {
+		if !canReplace {
+			return 0, http.StatusConflict, fmt.Errorf("a file with this name already exists")
+		}
+		if existingHash == hashedName {
+			// Same content as the current version, drop the extra reference
+			ReleaseBlob(hashedName)
+			return existingID, http.StatusOK, nil
+		}
+		if err := replaceFileContent(db, existingID, hashedName, contentType, size); err != nil {
+			l.LogMessage(l.ERROR, "File version creation failed: "+err.Error())
+			return 0, http.StatusInternalServerError, err
+		}
+		l.LogMessage(l.SUCS, "New file version saved successfully")
+		queueThumbnails(hashedName, contentType)
+		return existingID, http.StatusCreated, nil
+	} else if err != sql.ErrNoRows {
+		l.LogMessage(l.ERROR, "Existing file check failed: "+err.Error())
+		return 0, http.StatusInternalServerError, err
 	}
 
 	// Insert file metadata
-	insertQuery := `INSERT INTO files (folder_id, name, hashed_name) VALUES (?, ?, ?)`
-	_, err = db.Exec(insertQuery, folderID, fileName, hashedName)
+	insertQuery := `INSERT INTO files (folder_id, name, hashed_name, content_type, size, created_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`
+	res, err := db.Exec(insertQuery, folderID, fileName, hashedName, contentType, size)
 	if err != nil {
 		l.LogMessage(l.ERROR, "File metadata insertion failed: "+err.Error())
-		return http.StatusInternalServerError, err
+		return 0, http.StatusInternalServerError, err
+	}
+
+	fileID, err := res.LastInsertId()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to get file ID: "+err.Error())
+		return 0, http.StatusInternalServerError, err
 	}
 
 	l.LogMessage(l.SUCS, "File metadata saved successfully")
-	return http.StatusCreated, nil
+	queueThumbnails(hashedName, contentType)
+	return fileID, http.StatusCreated, nil
 }
 
-func ViewFile(c *gin.Context) {
-	// Extract user token from headers
-	token := c.GetHeader("token")
-	if token == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization token"})
-		return
+type fileRecord struct {
+	ID          int64
+	FolderID    string
+	Name        string
+	HashedName  string
+	ContentType string
+	Size        int64
+	CreatedAt   time.Time
+	Owner       string // username of the owner, empty for group owned files
+	OwnerUID    string
+}
+
+// lookupFile finds a file by its numeric ID. Clients from before content
+// addressing identify files by hashed name, which is no longer unique, so
+// those lookups are limited to the requesting user's own files.
+func lookupFile(db *sql.DB, fileID, usr string) (fileRecord, error) {
+	var file fileRecord
+	query := `SELECT f.id, f.folder_id, f.name, f.hashed_name, f.content_type, f.size, f.created_at, COALESCE(u.username, ''), fo.user_UID
+		FROM files f
+		JOIN folders fo ON f.folder_id = fo.UID
+		LEFT JOIN users u ON fo.user_UID = u.UID`
+
+	var row *sql.Row
+	if id, err := strconv.ParseInt(fileID, 10, 64); err == nil {
+		row = db.QueryRow(query+` WHERE f.id = ? AND f.trash_id IS NULL`, id)
+	} else {
+		row = db.QueryRow(query+` WHERE f.hashed_name = ? AND u.username = ? AND f.trash_id IS NULL LIMIT 1`, fileID, usr)
 	}
 
-	// Authenticate the token
-	isValid, claims := auth.AuthenticateTokenJWT(token)
-	if !isValid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
+	var createdAt sql.NullTime
+	err := row.Scan(&file.ID, &file.FolderID, &file.Name, &file.HashedName, &file.ContentType, &file.Size, &createdAt, &file.Owner, &file.OwnerUID)
+	file.CreatedAt = createdAt.Time
+	return file, err
+}
+
+// requestedFile looks up the file named by the fileID route parameter,
+// checking that the user signed in by the routes' Authorize owns it or can
+// view its folder. On failure it writes the error response and returns false.
+func requestedFile(c *gin.Context, db *sql.DB) (fileRecord, bool) {
+	usr := c.GetString("username")
+	if usr == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return fileRecord{}, false
 	}
 
 	// Extract file ID from URL
 	fileID := c.Param("fileID")
 	if fileID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File ID is required"})
-		return
+		return fileRecord{}, false
+	}
+
+	// Fetch file details from the database
+	file, err := lookupFile(db, fileID, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		} else {
+			l.LogMessage(l.ERROR, "Database query failed: "+err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
+		return file, false
+	}
+
+	// Ensure the requesting user owns the file or was granted access to it
+	level, err := fileAccess(db, usr, file)
+	if err != nil {
+		l.LogMessage(l.ERROR, "File access check failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return file, false
 	}
+	if level < accessViewer {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return file, false
+	}
+
+	return file, true
+}
 
+func ViewFile(c *gin.Context) {
 	// Connect to the SQLite database
 	db, err := sql.Open("sqlite3", "main.db")
 	if err != nil {
@@ -161,58 +227,111 @@ func ViewFile(c *gin.Context) {
 	}
 	defer db.Close()
 
-	// Fetch file details from the database
-	var fileName, hashedName, folderOwner string
-	query := `SELECT f.name, f.hashed_name, u.username
-		FROM files f
-		JOIN folders fo ON f.folder_id = fo.UID
-		JOIN users u ON fo.user_UID = u.UID
-		WHERE f.hashed_name = ?`
-	err = db.QueryRow(query, fileID).Scan(&fileName, &hashedName, &folderOwner)
+	file, ok := requestedFile(c, db)
+	if !ok {
+		return
+	}
+
+	// Serve a previous version if one was requested
+	if versionID := c.Query("version"); versionID != "" {
+		file, err = withVersion(db, file, versionID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			} else {
+				l.LogMessage(l.ERROR, "Database query failed: "+err.Error())
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			}
+			return
+		}
+	}
+
+	serveFile(c, file)
+}
+
+// serveFile streams a file's content. Files are sent as attachments unless the
+// request asks for ?inline=1 or ?disposition=inline, in which case browsers
+// render them directly using the content type detected at upload.
+func serveFile(c *gin.Context, file fileRecord) {
+	// Check if the file exists in storage
+	info, err := statBlob(file.HashedName)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found on disk"})
 		} else {
-			l.LogMessage(l.ERROR, "Database query failed: "+err.Error())
+			l.LogMessage(l.ERROR, "Storage stat failed: "+err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		}
 		return
 	}
 
-	// Ensure the requesting user is the owner of the file
-	if claims.Username != folderOwner {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
-		return
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(file.Name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
 
-	// Construct the file path
-	filePath := filepath.Join("uploads", hashedName)
+	disposition := "attachment"
+	if c.Query("inline") == "1" || c.Query("disposition") == "inline" {
+		disposition = "inline"
+		// Uploaded HTML or SVG must not run scripts on our origin
+		c.Header("Content-Security-Policy", "sandbox")
+	}
 
-	// Check if the file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found on disk"})
+	// Blobs are content addressed, so the digest is a strong validator
+	modTime := file.CreatedAt
+	if modTime.IsZero() {
+		modTime = info.ModTime
+	}
+	etag := `"` + file.HashedName + `"`
+
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, file.Name))
+
+	if !modTime.IsZero() {
+		c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	// Digests of the whole file, so clients can verify what they downloaded
+	if sums, err := blobChecksums(file.HashedName); err != nil {
+		l.LogMessage(l.WARNING, "Checksum lookup failed: "+err.Error())
+	} else if digest := sums.DigestHeader(); digest != "" {
+		c.Header("Digest", digest)
+	}
+	if match := c.GetHeader("If-None-Match"); match != "" && (match == etag || match == "*") {
+		c.Status(http.StatusNotModified)
 		return
 	}
 
+	reader, err := openBlob(file.HashedName)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Storage read failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer reader.Close()
+
 	// Serve the file securely with the original filename
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
-	c.File(filePath)
+	if rs, ok := reader.(io.ReadSeeker); ok {
+		// Seekable backends get range and conditional request support
+		http.ServeContent(c.Writer, c.Request, file.Name, modTime, rs)
+	} else {
+		c.DataFromReader(http.StatusOK, info.Size, contentType, reader, nil)
+	}
 
-	l.LogMessage(l.INFO, "File served: "+fileName)
+	l.LogMessage(l.INFO, "File served: "+file.Name)
 }
 
 func DeleteFile(c *gin.Context) {
-	// Extract user token
-	token := c.GetHeader("token")
-	if token == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization token"})
-		return
-	}
-
-	// Authenticate the token
-	isValid, claims := auth.AuthenticateTokenJWT(token)
-	if !isValid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+	// The user was signed in by the routes' Authorize
+	usr := c.GetString("username")
+	if usr == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
@@ -233,13 +352,7 @@ func DeleteFile(c *gin.Context) {
 	defer db.Close()
 
 	// Retrieve file details
-	var fileName, hashedName, folderOwner string
-	query := `SELECT f.name, f.hashed_name, u.username
-		FROM files f
-		JOIN folders fo ON f.folder_id = fo.UID
-		JOIN users u ON fo.user_UID = u.UID
-		WHERE f.hashed_name = ?`
-	err = db.QueryRow(query, fileID).Scan(&fileName, &hashedName, &folderOwner)
+	file, err := lookupFile(db, fileID, usr)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
@@ -250,32 +363,27 @@ func DeleteFile(c *gin.Context) {
 		return
 	}
 
-	// Ensure the requesting user is the owner of the file
-	if claims.Username != folderOwner {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+	// Ensure the requesting user owns the file or may edit its folder
+	level, err := fileAccess(db, usr, file)
+	if err != nil {
+		l.LogMessage(l.ERROR, "File access check failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
-
-	// Construct the file path
-	filePath := filepath.Join("uploads", hashedName)
-
-	// Delete the file from disk
-	if err := os.Remove(filePath); err != nil {
-		l.LogMessage(l.ERROR, "Failed to delete file from disk: "+err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+	if level < accessEditor {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
 		return
 	}
 
-	// Delete file record from the database
-	deleteQuery := `DELETE FROM files WHERE hashed_name = ?`
-	_, err = db.Exec(deleteQuery, fileID)
-	if err != nil {
-		l.LogMessage(l.ERROR, "Failed to delete file record: "+err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file record"})
+	// Move the file to its owner's trash, wherever the delete came from. It is
+	// only removed from storage once the trash is emptied.
+	if err := trashFile(db, file.OwnerUID, file); err != nil {
+		l.LogMessage(l.ERROR, "Failed to move file to trash: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
 		return
 	}
 
 	// Respond to client
-	l.LogMessage(l.INFO, "File deleted: "+fileName)
-	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+	l.LogMessage(l.INFO, "File moved to trash: "+file.Name)
+	c.JSON(http.StatusOK, gin.H{"message": "File moved to trash"})
 }
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"GoStore/auth"
+	"GoStore/jobs"
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Days trashed items are kept when TRASH_RETENTION_DAYS is not set. 0 keeps
+// them until the trash is emptied, as before trash was purged automatically;
+// operators opt in to purging by setting a number of days.
+const defaultTrashRetentionDays = 0
+
+// Hours an upload may sit without receiving data when UPLOAD_SESSION_TTL_HOURS
+// is not set.
+const defaultUploadSessionTTLHours = 24
+
+// Hours between scrubs when SCRUB_INTERVAL_HOURS is not set.
+const defaultScrubIntervalHours = 7 * 24
+
+// envInt reads a non-negative integer setting, falling back to def.
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// RegisterJobs registers the background jobs of the client package with the
+// scheduler. Trash is only purged when TRASH_RETENTION_DAYS is set, and
+// SCRUB_INTERVAL_HOURS=0 only scrubs on demand.
+func RegisterJobs() {
+	if envInt("TRASH_RETENTION_DAYS", defaultTrashRetentionDays) > 0 {
+		jobs.Register(jobs.Kind{Name: "purge_trash", Handler: func([]byte) error { return PurgeExpiredTrash() }, Every: time.Hour})
+	}
+	jobs.Register(jobs.Kind{Name: "expire_shares", Handler: func([]byte) error { return ExpireShares() }, Every: time.Hour})
+	jobs.Register(jobs.Kind{Name: "cleanup_orphans", Handler: func([]byte) error { return CleanupOrphans() }, Every: time.Hour})
+	jobs.Register(jobs.Kind{Name: "prune_sessions", Handler: func([]byte) error { return auth.PruneSessions() }, Every: time.Hour})
+
+	var scrubEvery time.Duration
+	if hours := envInt("SCRUB_INTERVAL_HOURS", defaultScrubIntervalHours); hours > 0 {
+		scrubEvery = time.Duration(hours) * time.Hour
+	}
+	jobs.Register(jobs.Kind{Name: "scrub", Handler: scrubJob, MaxAttempts: 1, Every: scrubEvery})
+
+	jobs.Register(jobs.Kind{Name: "thumbnails", Handler: thumbnailJob, Concurrency: 2})
+}
+
+// PurgeExpiredTrash permanently deletes trash entries older than
+// TRASH_RETENTION_DAYS.
+func PurgeExpiredTrash() error {
+	days := envInt("TRASH_RETENTION_DAYS", defaultTrashRetentionDays)
+	if days == 0 {
+		return nil
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id FROM trash WHERE deleted_at < datetime('now', ?)`, fmt.Sprintf("-%d days", days))
+	if err != nil {
+		l.LogMessage(l.ERROR, "Trash query failed: "+err.Error())
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := purgeTrashEntry(db, id); err != nil {
+			l.LogMessage(l.ERROR, "Trash purge failed: "+err.Error())
+			return err
+		}
+	}
+
+	if len(ids) > 0 {
+		l.LogMessage(l.INFO, fmt.Sprintf("Purged %d expired trash entries", len(ids)))
+	}
+	return nil
+}
+
+// ExpireShares deletes share links that are past their expiry date or have
+// used up their downloads.
+func ExpireShares() error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT token, expires_at, max_downloads, downloads FROM shares WHERE expires_at IS NOT NULL OR max_downloads > 0`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Share query failed: "+err.Error())
+		return err
+	}
+	var expired []string
+	for rows.Next() {
+		var share shareRecord
+		if err := rows.Scan(&share.Token, &share.ExpiresAt, &share.MaxDownloads, &share.Downloads); err != nil {
+			rows.Close()
+			return err
+		}
+		if (share.ExpiresAt.Valid && time.Now().After(share.ExpiresAt.Time)) ||
+			(share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads) {
+			expired = append(expired, share.Token)
+		}
+	}
+	rows.Close()
+
+	for _, token := range expired {
+		if _, err := db.Exec(`DELETE FROM shares WHERE token = ?`, token); err != nil {
+			l.LogMessage(l.ERROR, "Share deletion failed: "+err.Error())
+			return err
+		}
+	}
+
+	if len(expired) > 0 {
+		l.LogMessage(l.INFO, fmt.Sprintf("Deleted %d expired shares", len(expired)))
+	}
+	return nil
+}
+
+// CleanupOrphans discards resumable uploads that received no data for
+// UPLOAD_SESSION_TTL_HOURS, and partial upload files left without a session,
+// e.g. by a crash during a WebDAV upload.
+func CleanupOrphans() error {
+	ttl := time.Duration(envInt("UPLOAD_SESSION_TTL_HOURS", defaultUploadSessionTTLHours)) * time.Hour
+	if ttl == 0 {
+		return nil
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT UID, created_at FROM upload_sessions`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Upload session query failed: "+err.Error())
+		return err
+	}
+	sessions := map[string]time.Time{}
+	for rows.Next() {
+		var uid string
+		var createdAt sql.NullTime
+		if err := rows.Scan(&uid, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		sessions[uid] = createdAt.Time
+	}
+	rows.Close()
+
+	discarded := 0
+	for uid, createdAt := range sessions {
+		// Every chunk written touches the partial file
+		lastActive := createdAt
+		if info, err := os.Stat(filepath.Join(partialDir, uid)); err == nil {
+			lastActive = info.ModTime()
+		}
+		if time.Since(lastActive) < ttl {
+			continue
+		}
+
+		unlock := lockUpload(uid)
+		err := discardUpload(db, uid)
+		unlock()
+		if err != nil {
+			return err
+		}
+		discarded++
+	}
+
+	entries, err := os.ReadDir(partialDir)
+	if err != nil && !os.IsNotExist(err) {
+		l.LogMessage(l.ERROR, "Failed to read partial upload directory: "+err.Error())
+		return err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if _, ok := sessions[entry.Name()]; ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ttl {
+			continue
+		}
+		if err := os.Remove(filepath.Join(partialDir, entry.Name())); err != nil {
+			l.LogMessage(l.WARNING, "Failed to delete orphaned upload: "+err.Error())
+			continue
+		}
+		removed++
+	}
+
+	if discarded > 0 || removed > 0 {
+		l.LogMessage(l.INFO, fmt.Sprintf("Discarded %d stale upload sessions and %d orphaned partial files", discarded, removed))
+	}
+	return nil
+}
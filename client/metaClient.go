@@ -0,0 +1,365 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxTagLength      = 64
+	maxMetaKeyLength  = 128
+	maxMetaValueBytes = 4096
+)
+
+// ItemMeta holds the tags and key/value metadata of a file or folder.
+type ItemMeta struct {
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// normalizeTag trims and lowercases a tag so "Project-X" and "project-x " match.
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength || strings.ContainsAny(tag, ",\n\r\t") {
+		return "", fmt.Errorf("invalid tag %q", tag)
+	}
+	return tag, nil
+}
+
+func validMetaKey(key string) error {
+	if strings.TrimSpace(key) == "" || len(key) > maxMetaKeyLength {
+		return fmt.Errorf("invalid metadata key %q", key)
+	}
+	return nil
+}
+
+// SplitTags splits comma separated tag lists, e.g. from form fields.
+func SplitTags(values []string) []string {
+	var tags []string
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			if strings.TrimSpace(tag) != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// ValidateTags checks tags before they are attached to anything.
+func ValidateTags(tags []string) error {
+	for _, tag := range tags {
+		if _, err := normalizeTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedItem resolves a file or folder of the user and returns its canonical
+// item ID: the numeric file id or the folder UID.
+func ownedItem(db *sql.DB, usr, userUID, itemType, itemID string) (string, int, error) {
+	switch itemType {
+	case "file":
+		file, status, err := ownedFile(db, usr, itemID)
+		if err != nil {
+			return "", status, err
+		}
+		return strconv.FormatInt(file.ID, 10), http.StatusOK, nil
+	case "folder":
+		folder, err := resolveFolder(db, userUID, itemID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "", http.StatusNotFound, fmt.Errorf("folder not found or unauthorized access")
+			}
+			l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+			return "", http.StatusInternalServerError, err
+		}
+		return folder.UID, http.StatusOK, nil
+	}
+	return "", http.StatusBadRequest, fmt.Errorf("type must be file or folder")
+}
+
+func itemMeta(db *sql.DB, itemType, itemID string) (ItemMeta, error) {
+	meta := ItemMeta{Tags: []string{}, Metadata: map[string]string{}}
+
+	rows, err := db.Query(`SELECT tag FROM tags WHERE item_type = ? AND item_id = ? ORDER BY tag`, itemType, itemID)
+	if err != nil {
+		return meta, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return meta, err
+		}
+		meta.Tags = append(meta.Tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return meta, err
+	}
+
+	metaRows, err := db.Query(`SELECT key, value FROM metadata WHERE item_type = ? AND item_id = ?`, itemType, itemID)
+	if err != nil {
+		return meta, err
+	}
+	defer metaRows.Close()
+	for metaRows.Next() {
+		var key, value string
+		if err := metaRows.Scan(&key, &value); err != nil {
+			return meta, err
+		}
+		meta.Metadata[key] = value
+	}
+	return meta, metaRows.Err()
+}
+
+// addTags attaches tags to an item, ignoring tags it already has.
+func addTags(q dbExecer, userUID, itemType, itemID string, tags []string) error {
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return err
+		}
+		insertQuery := `INSERT OR IGNORE INTO tags (user_UID, item_type, item_id, tag) VALUES (?, ?, ?, ?)`
+		if _, err := q.Exec(insertQuery, userUID, itemType, itemID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetItemMeta returns the tags and metadata of a file or folder of the user.
+func GetItemMeta(usr, itemType, itemID string) (ItemMeta, int, error) {
+	var meta ItemMeta
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return meta, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return meta, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	itemID, status, err := ownedItem(db, usr, userUID, itemType, itemID)
+	if err != nil {
+		return meta, status, err
+	}
+
+	meta, err = itemMeta(db, itemType, itemID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Metadata query failed: "+err.Error())
+		return meta, http.StatusInternalServerError, err
+	}
+	return meta, http.StatusOK, nil
+}
+
+// UpdateItemMeta changes the tags and metadata of a file or folder. With
+// replace, the given tags and metadata replace the existing ones; otherwise
+// they are added, and metadata keys with an empty value are removed. A nil
+// tags slice or metadata map leaves that part untouched.
+func UpdateItemMeta(usr, itemType, itemID string, tags []string, metadata map[string]string, replace bool) (ItemMeta, int, error) {
+	var meta ItemMeta
+
+	for key, value := range metadata {
+		if err := validMetaKey(key); err != nil {
+			return meta, http.StatusBadRequest, err
+		}
+		if len(value) > maxMetaValueBytes {
+			return meta, http.StatusBadRequest, fmt.Errorf("metadata value for %q is too long", key)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return meta, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return meta, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	itemID, status, err := ownedItem(db, usr, userUID, itemType, itemID)
+	if err != nil {
+		return meta, status, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return meta, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	if tags != nil {
+		if replace {
+			if _, err := tx.Exec(`DELETE FROM tags WHERE item_type = ? AND item_id = ?`, itemType, itemID); err != nil {
+				l.LogMessage(l.ERROR, "Tag update failed: "+err.Error())
+				return meta, http.StatusInternalServerError, err
+			}
+		}
+		if err := addTags(tx, userUID, itemType, itemID, tags); err != nil {
+			return meta, http.StatusBadRequest, err
+		}
+	}
+
+	if metadata != nil {
+		if replace {
+			if _, err := tx.Exec(`DELETE FROM metadata WHERE item_type = ? AND item_id = ?`, itemType, itemID); err != nil {
+				l.LogMessage(l.ERROR, "Metadata update failed: "+err.Error())
+				return meta, http.StatusInternalServerError, err
+			}
+		}
+		for key, value := range metadata {
+			key = strings.TrimSpace(key)
+			var err error
+			if value == "" {
+				_, err = tx.Exec(`DELETE FROM metadata WHERE item_type = ? AND item_id = ? AND key = ?`, itemType, itemID, key)
+			} else {
+				upsertQuery := `INSERT INTO metadata (user_UID, item_type, item_id, key, value) VALUES (?, ?, ?, ?, ?)
+					ON CONFLICT(item_type, item_id, key) DO UPDATE SET value = excluded.value`
+				_, err = tx.Exec(upsertQuery, userUID, itemType, itemID, key, value)
+			}
+			if err != nil {
+				l.LogMessage(l.ERROR, "Metadata update failed: "+err.Error())
+				return meta, http.StatusInternalServerError, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return meta, http.StatusInternalServerError, err
+	}
+
+	meta, err = itemMeta(db, itemType, itemID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Metadata query failed: "+err.Error())
+		return meta, http.StatusInternalServerError, err
+	}
+	return meta, http.StatusOK, nil
+}
+
+// RemoveTag removes one tag from a file or folder of the user.
+func RemoveTag(usr, itemType, itemID, tag string) (int, error) {
+	tag, err := normalizeTag(tag)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	itemID, status, err := ownedItem(db, usr, userUID, itemType, itemID)
+	if err != nil {
+		return status, err
+	}
+
+	res, err := db.Exec(`DELETE FROM tags WHERE item_type = ? AND item_id = ? AND tag = ?`, itemType, itemID, tag)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Tag deletion failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return http.StatusNotFound, fmt.Errorf("tag not found")
+	}
+	return http.StatusOK, nil
+}
+
+// ListTags returns every tag the user has used with the number of live items
+// carrying it.
+func ListTags(usr string) ([]TagCount, int, error) {
+	counts := []TagCount{}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return counts, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return counts, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	query := `SELECT t.tag, COUNT(*) FROM tags t
+		LEFT JOIN files f ON t.item_type = 'file' AND f.id = t.item_id
+		LEFT JOIN folders fo ON t.item_type = 'folder' AND fo.UID = t.item_id
+		WHERE t.user_UID = ? AND (f.trash_id IS NULL AND f.id IS NOT NULL OR fo.trash_id IS NULL AND fo.UID IS NOT NULL)
+		GROUP BY t.tag ORDER BY t.tag`
+	rows, err := db.Query(query, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Tag query failed: "+err.Error())
+		return counts, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var count TagCount
+		if err := rows.Scan(&count.Tag, &count.Count); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return counts, http.StatusInternalServerError, err
+		}
+		counts = append(counts, count)
+	}
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return counts, http.StatusInternalServerError, err
+	}
+
+	return counts, http.StatusOK, nil
+}
+
+// TagFile adds tags to a newly uploaded file. Callers validate the tags with
+// ValidateTags before the upload is stored. The tags belong to the file's
+// owner, also when someone with access to a shared folder uploaded it.
+func TagFile(fileID int64, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	var ownerUID string
+	query := `SELECT fo.user_UID FROM files f JOIN folders fo ON f.folder_id = fo.UID WHERE f.id = ?`
+	if err := db.QueryRow(query, fileID).Scan(&ownerUID); err != nil {
+		return err
+	}
+
+	return addTags(db, ownerUID, "file", strconv.FormatInt(fileID, 10), tags)
+}
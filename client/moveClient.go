@@ -0,0 +1,422 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// validItemName rejects names that cannot be used for a file or folder.
+func validItemName(name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid name")
+	}
+	return nil
+}
+
+// copyName derives the name of a copy placed next to the original,
+// e.g. "report (copy).pdf".
+func copyName(name string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + " (copy)" + ext
+}
+
+// ownedFile looks up a live file and checks that it belongs to the user.
+func ownedFile(db *sql.DB, usr, fileID string) (fileRecord, int, error) {
+	file, err := lookupFile(db, fileID, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return file, http.StatusNotFound, fmt.Errorf("file not found")
+		}
+		l.LogMessage(l.ERROR, "Database query failed: "+err.Error())
+		return file, http.StatusInternalServerError, err
+	}
+	if file.Owner != usr {
+		return file, http.StatusForbidden, fmt.Errorf("unauthorized access")
+	}
+	return file, http.StatusOK, nil
+}
+
+// ownedFolder resolves a live, non-root folder of the user.
+func ownedFolder(db *sql.DB, userUID, folderID string) (FolderEntry, int, error) {
+	folder, err := resolveFolder(db, userUID, folderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return folder, http.StatusNotFound, fmt.Errorf("folder not found or unauthorized access")
+		}
+		l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+		return folder, http.StatusInternalServerError, err
+	}
+
+	var isRoot bool
+	err = db.QueryRow(`SELECT parent_id IS NULL FROM folders WHERE UID = ?`, folder.UID).Scan(&isRoot)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+		return folder, http.StatusInternalServerError, err
+	}
+	if isRoot {
+		return folder, http.StatusBadRequest, fmt.Errorf("the root folder cannot be changed")
+	}
+
+	return folder, http.StatusOK, nil
+}
+
+// targetFolder resolves the folder an item is moved or copied into.
+func targetFolder(db *sql.DB, userUID, folderID string) (FolderEntry, int, error) {
+	folder, err := resolveFolder(db, userUID, folderID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return folder, http.StatusForbidden, fmt.Errorf("target folder not found or unauthorized access")
+		}
+		l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+		return folder, http.StatusInternalServerError, err
+	}
+	return folder, http.StatusOK, nil
+}
+
+// RenameFile changes the name of a file owned by the user.
+func RenameFile(usr, fileID, name string) (int, error) {
+	if err := validItemName(name); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	file, status, err := ownedFile(db, usr, fileID)
+	if err != nil {
+		return status, err
+	}
+
+	if _, err := db.Exec(`UPDATE files SET name = ? WHERE id = ?`, strings.TrimSpace(name), file.ID); err != nil {
+		l.LogMessage(l.ERROR, "File rename failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// MoveFile moves a file into another folder owned by the user.
+func MoveFile(usr, fileID, folderID string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	file, status, err := ownedFile(db, usr, fileID)
+	if err != nil {
+		return status, err
+	}
+
+	target, status, err := targetFolder(db, userUID, folderID)
+	if err != nil {
+		return status, err
+	}
+
+	if _, err := db.Exec(`UPDATE files SET folder_id = ? WHERE id = ?`, target.UID, file.ID); err != nil {
+		l.LogMessage(l.ERROR, "File move failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// CopyFile copies a file into a folder owned by the user. The copy shares the
+// stored blob with the original, so no bytes are duplicated.
+func CopyFile(usr, fileID, folderID, name string) (FileEntry, int, error) {
+	var entry FileEntry
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return entry, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	file, status, err := ownedFile(db, usr, fileID)
+	if err != nil {
+		return entry, status, err
+	}
+
+	if folderID == "" {
+		folderID = file.FolderID
+	}
+	target, status, err := targetFolder(db, userUID, folderID)
+	if err != nil {
+		return entry, status, err
+	}
+
+	if name == "" {
+		name = file.Name
+		if target.UID == file.FolderID {
+			name = copyName(file.Name)
+		}
+	}
+	if err := validItemName(name); err != nil {
+		return entry, http.StatusBadRequest, err
+	}
+
+	if status, err := checkQuota(db, userUID, file.Size); err != nil {
+		return entry, status, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	entry, err = copyFileRow(tx, file, target.UID, strings.TrimSpace(name))
+	if err != nil {
+		l.LogMessage(l.ERROR, "File copy failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+
+	return entry, http.StatusCreated, nil
+}
+
+// copyFileRow inserts a copy of a file's metadata and references its blob.
+func copyFileRow(tx *sql.Tx, file fileRecord, folderUID, name string) (FileEntry, error) {
+	entry := FileEntry{Name: name, HashedName: file.HashedName, ContentType: file.ContentType, Size: file.Size}
+
+	insertQuery := `INSERT INTO files (folder_id, name, hashed_name, content_type, size, created_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`
+	res, err := tx.Exec(insertQuery, folderUID, name, file.HashedName, file.ContentType, file.Size)
+	if err != nil {
+		return entry, err
+	}
+	if entry.ID, err = res.LastInsertId(); err != nil {
+		return entry, err
+	}
+
+	return entry, acquireBlob(tx, file.HashedName, file.Size)
+}
+
+// RenameFolder changes the name of a folder owned by the user.
+func RenameFolder(usr, folderID, name string) (int, error) {
+	if err := validItemName(name); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	folder, status, err := ownedFolder(db, userUID, folderID)
+	if err != nil {
+		return status, err
+	}
+
+	if _, err := db.Exec(`UPDATE folders SET name = ? WHERE UID = ?`, strings.TrimSpace(name), folder.UID); err != nil {
+		l.LogMessage(l.ERROR, "Folder rename failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// MoveFolder re-parents a folder. A folder cannot be moved into itself or
+// into one of its own descendants.
+func MoveFolder(usr, folderID, parentID string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	folder, status, err := ownedFolder(db, userUID, folderID)
+	if err != nil {
+		return status, err
+	}
+
+	target, status, err := targetFolder(db, userUID, parentID)
+	if err != nil {
+		return status, err
+	}
+
+	var cycle bool
+	err = db.QueryRow(folderSubtree+`SELECT EXISTS(SELECT 1 FROM subtree WHERE UID = ?)`, folder.UID, target.UID).Scan(&cycle)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Cycle check failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if cycle {
+		return http.StatusBadRequest, fmt.Errorf("a folder cannot be moved into itself or one of its subfolders")
+	}
+
+	if _, err := db.Exec(`UPDATE folders SET parent_id = ? WHERE UID = ?`, target.UID, folder.UID); err != nil {
+		l.LogMessage(l.ERROR, "Folder move failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// CopyFolder copies a folder with all of its live subfolders and files into a
+// folder owned by the user. File contents are shared with the originals.
+func CopyFolder(usr, folderID, parentID, name string) (FolderEntry, int, error) {
+	var entry FolderEntry
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return entry, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	folder, status, err := ownedFolder(db, userUID, folderID)
+	if err != nil {
+		return entry, status, err
+	}
+
+	if parentID == "" {
+		parentID = folder.ParentID
+	}
+	target, status, err := targetFolder(db, userUID, parentID)
+	if err != nil {
+		return entry, status, err
+	}
+
+	if name == "" {
+		name = folder.Name
+		if target.UID == folder.ParentID {
+			name = folder.Name + " (copy)"
+		}
+	}
+	if err := validItemName(name); err != nil {
+		return entry, http.StatusBadRequest, err
+	}
+
+	// Collect the subtree before writing so the copy never includes itself
+	type folderRow struct{ uid, name, parent string }
+	rows, err := db.Query(folderSubtree+`SELECT f.UID, f.name, COALESCE(f.parent_id, '') FROM folders f JOIN subtree s ON f.UID = s.UID`, folder.UID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder query failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+	var subtree []folderRow
+	newUIDs := map[string]string{}
+	for rows.Next() {
+		var f folderRow
+		if err := rows.Scan(&f.uid, &f.name, &f.parent); err != nil {
+			rows.Close()
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return entry, http.StatusInternalServerError, err
+		}
+		subtree = append(subtree, f)
+		newUIDs[f.uid] = uuid.New().String()
+	}
+	rows.Close()
+
+	var files []fileRecord
+	for _, f := range subtree {
+		fileRows, err := db.Query(`SELECT id, folder_id, name, hashed_name, content_type, size FROM files WHERE folder_id = ? AND trash_id IS NULL`, f.uid)
+		if err != nil {
+			l.LogMessage(l.ERROR, "File query failed: "+err.Error())
+			return entry, http.StatusInternalServerError, err
+		}
+		for fileRows.Next() {
+			var file fileRecord
+			if err := fileRows.Scan(&file.ID, &file.FolderID, &file.Name, &file.HashedName, &file.ContentType, &file.Size); err != nil {
+				fileRows.Close()
+				l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+				return entry, http.StatusInternalServerError, err
+			}
+			files = append(files, file)
+		}
+		fileRows.Close()
+	}
+
+	var totalSize int64
+	for _, file := range files {
+		totalSize += file.Size
+	}
+	if status, err := checkQuota(db, userUID, totalSize); err != nil {
+		return entry, status, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	insertQuery := `INSERT INTO folders (UID, user_UID, name, parent_id, created_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)`
+	for _, f := range subtree {
+		folderName, parent := f.name, newUIDs[f.parent]
+		if f.uid == folder.UID {
+			folderName, parent = strings.TrimSpace(name), target.UID
+		}
+		if _, err := tx.Exec(insertQuery, newUIDs[f.uid], userUID, folderName, parent); err != nil {
+			l.LogMessage(l.ERROR, "Folder copy failed: "+err.Error())
+			return entry, http.StatusInternalServerError, err
+		}
+	}
+
+	for _, file := range files {
+		if _, err := copyFileRow(tx, file, newUIDs[file.FolderID], file.Name); err != nil {
+			l.LogMessage(l.ERROR, "File copy failed: "+err.Error())
+			return entry, http.StatusInternalServerError, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return entry, http.StatusInternalServerError, err
+	}
+
+	entry = FolderEntry{UID: newUIDs[folder.UID], Name: strings.TrimSpace(name), ParentID: target.UID}
+	return entry, http.StatusCreated, nil
+}
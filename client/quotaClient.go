@@ -0,0 +1,90 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+type Usage struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"` // 0 means unlimited
+}
+
+// userUsage sums the size of every file a user or group owns, including
+// previous versions. Files in the trash still count until the trash is emptied.
+func userUsage(db *sql.DB, userUID string) (Usage, error) {
+	var usage Usage
+	query := `SELECT u.quota, COALESCE((SELECT SUM(f.size) FROM files f
+			JOIN folders fo ON f.folder_id = fo.UID
+			WHERE fo.user_UID = u.UID), 0) + COALESCE((SELECT SUM(v.size) FROM file_versions v
+			JOIN files f ON v.file_id = f.id
+			JOIN folders fo ON f.folder_id = fo.UID
+			WHERE fo.user_UID = u.UID), 0)
+		FROM (SELECT UID, quota FROM users UNION ALL SELECT UID, quota FROM groups) u WHERE u.UID = ?`
+	err := db.QueryRow(query, userUID).Scan(&usage.Quota, &usage.Used)
+	return usage, err
+}
+
+// checkQuota reports whether extra bytes fit in the quota of a user.
+func checkQuota(db *sql.DB, userUID string, extra int64) (int, error) {
+	usage, err := userUsage(db, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Usage query failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	if usage.Quota > 0 && usage.Used+extra > usage.Quota {
+		return http.StatusInsufficientStorage, fmt.Errorf("storage quota exceeded: %d of %d bytes used, %d more requested", usage.Used, usage.Quota, extra)
+	}
+
+	return http.StatusOK, nil
+}
+
+// CheckQuota checks that a user may upload to a folder and that extra bytes
+// can be stored there without exceeding the quota of the folder's owner. It
+// runs before an upload is written to storage.
+func CheckQuota(userUID, folderID string, extra int64) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	// Only users who may upload there learn anything about the owner's usage
+	_, ownerUID, status, err := accessibleFolder(db, userUID, folderID, accessEditor)
+	if err != nil {
+		if status == http.StatusNotFound {
+			status = http.StatusForbidden
+		}
+		return status, err
+	}
+
+	return checkQuota(db, ownerUID, extra)
+}
+
+// GetUsage returns the storage used by a user and their quota.
+func GetUsage(usr string) (Usage, int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return Usage{}, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return Usage{}, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	usage, err := userUsage(db, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Usage query failed: "+err.Error())
+		return usage, http.StatusInternalServerError, err
+	}
+
+	return usage, http.StatusOK, nil
+}
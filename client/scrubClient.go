@@ -0,0 +1,248 @@
+package client
+
+import (
+	"GoStore/jobs"
+	l "GoStore/log"
+	"GoStore/storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ScrubIssue is a blob whose stored content no longer matches its checksums.
+type ScrubIssue struct {
+	Digest     string `json:"digest"`
+	Problem    string `json:"problem"`
+	References int    `json:"references"`
+}
+
+// ScrubReport is the outcome of a scrub, or its progress while it runs.
+type ScrubReport struct {
+	Running      bool         `json:"running"`
+	StartedAt    string       `json:"started_at,omitempty"`
+	FinishedAt   string       `json:"finished_at,omitempty"`
+	Checked      int          `json:"checked"`
+	Bytes        int64        `json:"bytes"`
+	Missing      int          `json:"missing"`
+	Corrupt      int          `json:"corrupt"`
+	Unreferenced []string     `json:"unreferenced"`
+	Issues       []ScrubIssue `json:"issues"`
+}
+
+type scrubBlob struct {
+	digest    string
+	size      int64
+	refCount  int
+	checksums Checksums
+}
+
+// ErrScrubRunning is returned when a scrub is started while one is running.
+var ErrScrubRunning = errors.New("a scrub is already running")
+
+var (
+	scrubMu     sync.Mutex
+	scrubReport ScrubReport
+)
+
+// StartScrub queues a scrub job and returns its ID. Progress and the result
+// are reported by ScrubStatus. If a scrub job is already queued or running
+// its ID is returned with ErrScrubRunning.
+func StartScrub() (int64, error) {
+	id, pending, err := jobs.EnqueueOnce("scrub")
+	if err != nil {
+		return 0, err
+	}
+	if pending {
+		return id, ErrScrubRunning
+	}
+	return id, nil
+}
+
+// scrubJob runs a scheduled scrub. Finding damaged blobs does not fail the
+// job, only being unable to check them does.
+func scrubJob([]byte) error {
+	_, err := ScrubBlobs()
+	return err
+}
+
+// ScrubStatus returns the report of the running or last finished scrub.
+func ScrubStatus() ScrubReport {
+	scrubMu.Lock()
+	defer scrubMu.Unlock()
+
+	report := scrubReport
+	report.Issues = append([]ScrubIssue{}, scrubReport.Issues...)
+	report.Unreferenced = append([]string{}, scrubReport.Unreferenced...)
+	return report
+}
+
+// ScrubBlobs re-reads every blob, decrypting it if needed, and compares it to
+// the checksums recorded when it was stored. Blobs stored before MD5 and
+// CRC32C were recorded get them filled in. Each blob's outcome is kept in the
+// blobs table and every problem is logged as an error.
+func ScrubBlobs() (ScrubReport, error) {
+	scrubMu.Lock()
+	if scrubReport.Running {
+		scrubMu.Unlock()
+		return ScrubStatus(), ErrScrubRunning
+	}
+	scrubReport = ScrubReport{Running: true, StartedAt: time.Now().UTC().Format(time.RFC3339)}
+	scrubMu.Unlock()
+
+	err := scrubBlobs()
+
+	scrubMu.Lock()
+	defer scrubMu.Unlock()
+	scrubReport.Running = false
+	scrubReport.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		scrubReport.Issues = append(scrubReport.Issues, ScrubIssue{Problem: "scrub aborted: " + err.Error()})
+	}
+	l.LogMessage(l.INFO, fmt.Sprintf("Scrub finished: %d blobs checked, %d corrupt, %d missing, %d unreferenced",
+		scrubReport.Checked, scrubReport.Corrupt, scrubReport.Missing, len(scrubReport.Unreferenced)))
+
+	report := scrubReport
+	report.Issues = append([]ScrubIssue{}, scrubReport.Issues...)
+	report.Unreferenced = append([]string{}, scrubReport.Unreferenced...)
+	return report, err
+}
+
+func scrubBlobs() error {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT digest, size, ref_count, md5, crc32c FROM blobs ORDER BY digest`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Scrub query failed: "+err.Error())
+		return err
+	}
+
+	var blobs []scrubBlob
+	for rows.Next() {
+		var b scrubBlob
+		var md5Sum, crc sql.NullString
+		if err := rows.Scan(&b.digest, &b.size, &b.refCount, &md5Sum, &crc); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			rows.Close()
+			return err
+		}
+		b.checksums = Checksums{SHA256: b.digest, MD5: md5Sum.String, CRC32C: crc.String}
+		blobs = append(blobs, b)
+	}
+	rows.Close()
+
+	known := map[string]bool{}
+	for _, b := range blobs {
+		known[b.digest] = true
+
+		problem, missing, n := verifyBlob(b)
+		if problem != "" {
+			// The blob may have been deleted while it was being read
+			var exists bool
+			if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM blobs WHERE digest = ?)`, b.digest).Scan(&exists); err == nil && !exists {
+				continue
+			}
+		}
+
+		var scrubError sql.NullString
+		if problem != "" {
+			scrubError = sql.NullString{String: problem, Valid: true}
+			l.LogMessage(l.ERROR, "Scrub: blob "+b.digest+" "+problem)
+		}
+		_, err := db.Exec(`UPDATE blobs SET verified_at = CURRENT_TIMESTAMP, scrub_error = ? WHERE digest = ?`, scrubError, b.digest)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Scrub result update failed: "+err.Error())
+		}
+
+		scrubMu.Lock()
+		scrubReport.Checked++
+		scrubReport.Bytes += n
+		if problem != "" {
+			if missing {
+				scrubReport.Missing++
+			} else {
+				scrubReport.Corrupt++
+			}
+			scrubReport.Issues = append(scrubReport.Issues, ScrubIssue{Digest: b.digest, Problem: problem, References: b.refCount})
+		}
+		scrubMu.Unlock()
+	}
+
+	// Files from before content addressing own their blobs without a row
+	legacyRows, err := db.Query(`SELECT hashed_name FROM files UNION SELECT hashed_name FROM file_versions`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Scrub query failed: "+err.Error())
+		return err
+	}
+	for legacyRows.Next() {
+		var name string
+		if err := legacyRows.Scan(&name); err != nil {
+			legacyRows.Close()
+			return err
+		}
+		known[name] = true
+	}
+	legacyRows.Close()
+
+	objects, err := storage.Store.List("")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Storage listing failed: "+err.Error())
+		return err
+	}
+	for _, obj := range objects {
+		if known[obj.Name] {
+			continue
+		}
+		l.LogMessage(l.WARNING, "Scrub: unreferenced object "+obj.Name)
+		scrubMu.Lock()
+		scrubReport.Unreferenced = append(scrubReport.Unreferenced, obj.Name)
+		scrubMu.Unlock()
+	}
+
+	return nil
+}
+
+// verifyBlob re-hashes one blob. It returns a description of what is wrong
+// with it, whether that is because it is missing, and how many bytes were read.
+func verifyBlob(b scrubBlob) (string, bool, int64) {
+	r, err := openBlob(b.digest)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "is missing from storage", true, 0
+		}
+		return "could not be opened: " + err.Error(), false, 0
+	}
+	sums, n, err := hashContent(r)
+	r.Close()
+	if err != nil {
+		// Encrypted blobs fail authentication here when they were altered
+		return "could not be read: " + err.Error(), false, n
+	}
+
+	if n != b.size {
+		return fmt.Sprintf("is %d bytes, expected %d", n, b.size), false, n
+	}
+	if err := sums.verify(b.checksums); err != nil {
+		return err.Error(), false, n
+	}
+
+	if b.checksums.MD5 == "" || b.checksums.CRC32C == "" {
+		db, err := sql.Open("sqlite3", "main.db")
+		if err == nil {
+			_, err = db.Exec(`UPDATE blobs SET md5 = COALESCE(md5, ?), crc32c = COALESCE(crc32c, ?) WHERE digest = ?`, sums.MD5, sums.CRC32C, b.digest)
+			db.Close()
+		}
+		if err != nil {
+			l.LogMessage(l.WARNING, "Checksum backfill failed for "+b.digest+": "+err.Error())
+		}
+	}
+
+	return "", false, n
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// SearchQuery filters a search. Zero values do not filter. Name is matched as
+// a case-insensitive substring, or as a glob when it contains * or ?. Type is
+// "file" or "folder" and ContentType matches a full type such as "image/png"
+// or a family such as "image". Items must carry all Tags and match every
+// Metadata key/value pair.
+type SearchQuery struct {
+	Name        string
+	Type        string
+	ContentType string
+	Tags        []string
+	Metadata    map[string]string
+	MinSize     int64
+	MaxSize     int64
+	After       time.Time
+	Before      time.Time
+	FolderID    string
+	Limit       int
+	Offset      int
+}
+
+type SearchResult struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	ParentID    string `json:"parent_id"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// escapeLike escapes the LIKE wildcards in a term, using \ as the escape
+// character.
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+}
+
+// likePattern turns a search term into a LIKE pattern: a substring match, or
+// a glob match when the term contains * or ?.
+func likePattern(term string) string {
+	escaped := escapeLike(term)
+	if strings.ContainsAny(term, "*?") {
+		return strings.NewReplacer("*", "%", "?", "_").Replace(escaped)
+	}
+	return "%" + escaped + "%"
+}
+
+// sqlTime formats a time the way CURRENT_TIMESTAMP stores it.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// Search finds the user's live files and folders matching the query, ordered
+// by name. Results carry their full path rebuilt from the folder hierarchy.
+func Search(usr string, q SearchQuery) ([]SearchResult, int, error) {
+	results := []SearchResult{}
+
+	if q.Type != "" && q.Type != "file" && q.Type != "folder" {
+		return results, http.StatusBadRequest, fmt.Errorf("type must be file or folder")
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultSearchLimit
+	}
+	if q.Limit > maxSearchLimit {
+		q.Limit = maxSearchLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return results, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return results, http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return results, http.StatusInternalServerError, err
+	}
+
+	var prefix, folderUID string
+	var args []interface{}
+	if q.FolderID != "" {
+		folder, err := resolveFolder(db, userUID, q.FolderID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return results, http.StatusNotFound, fmt.Errorf("folder not found or unauthorized access")
+			}
+			l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+			return results, http.StatusInternalServerError, err
+		}
+		folderUID = folder.UID
+		prefix = folderSubtree
+		args = append(args, folderUID)
+	}
+
+	var tags []string
+	for _, tag := range q.Tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return results, http.StatusBadRequest, err
+		}
+		tags = append(tags, tag)
+	}
+
+	// Filters shared by both halves of the query. idExpr is the item_id of
+	// the row in the tags and metadata tables.
+	common := func(alias, itemType, idExpr string) ([]string, []interface{}) {
+		var where []string
+		var whereArgs []interface{}
+		for _, tag := range tags {
+			where = append(where, `EXISTS(SELECT 1 FROM tags WHERE item_type = ? AND item_id = `+idExpr+` AND tag = ?)`)
+			whereArgs = append(whereArgs, itemType, tag)
+		}
+		for key, value := range q.Metadata {
+			where = append(where, `EXISTS(SELECT 1 FROM metadata WHERE item_type = ? AND item_id = `+idExpr+` AND key = ? AND value = ?)`)
+			whereArgs = append(whereArgs, itemType, key, value)
+		}
+		if q.Name != "" {
+			where = append(where, alias+`.name LIKE ? ESCAPE '\'`)
+			whereArgs = append(whereArgs, likePattern(q.Name))
+		}
+		if !q.After.IsZero() {
+			where = append(where, alias+".created_at >= ?")
+			whereArgs = append(whereArgs, sqlTime(q.After))
+		}
+		if !q.Before.IsZero() {
+			where = append(where, alias+".created_at < ?")
+			whereArgs = append(whereArgs, sqlTime(q.Before))
+		}
+		return where, whereArgs
+	}
+
+	var parts []string
+
+	// Folders have no content type or size, so those filters only match files
+	if q.Type != "file" && q.ContentType == "" && q.MinSize == 0 && q.MaxSize == 0 {
+		where := []string{"fo.user_UID = ?", "fo.trash_id IS NULL", "fo.parent_id IS NOT NULL"}
+		args = append(args, userUID)
+		if q.FolderID != "" {
+			// Descendants only, not the folder searched in
+			where = append(where, "fo.UID IN (SELECT UID FROM subtree)", "fo.UID != ?")
+			args = append(args, folderUID)
+		}
+		extra, extraArgs := common("fo", "folder", "fo.UID")
+		where = append(where, extra...)
+		args = append(args, extraArgs...)
+
+		parts = append(parts, `SELECT 'folder', fo.UID, fo.name, COALESCE(fo.parent_id, ''), '', 0, fo.created_at
+			FROM folders fo WHERE `+strings.Join(where, " AND "))
+	}
+
+	if q.Type != "folder" {
+		where := []string{"fo.user_UID = ?", "f.trash_id IS NULL"}
+		args = append(args, userUID)
+		if q.FolderID != "" {
+			where = append(where, "f.folder_id IN (SELECT UID FROM subtree)")
+		}
+		if q.ContentType != "" {
+			if strings.Contains(q.ContentType, "/") {
+				// Stored types may carry parameters, e.g. "text/plain; charset=utf-8"
+				where = append(where, `(f.content_type = ? OR f.content_type LIKE ? ESCAPE '\')`)
+				args = append(args, q.ContentType, escapeLike(q.ContentType+";")+"%")
+			} else {
+				where = append(where, `f.content_type LIKE ? ESCAPE '\'`)
+				args = append(args, escapeLike(q.ContentType+"/")+"%")
+			}
+		}
+		if q.MinSize > 0 {
+			where = append(where, "f.size >= ?")
+			args = append(args, q.MinSize)
+		}
+		if q.MaxSize > 0 {
+			where = append(where, "f.size <= ?")
+			args = append(args, q.MaxSize)
+		}
+		extra, extraArgs := common("f", "file", "CAST(f.id AS TEXT)")
+		where = append(where, extra...)
+		args = append(args, extraArgs...)
+
+		parts = append(parts, `SELECT 'file', CAST(f.id AS TEXT), f.name, f.folder_id, f.content_type, f.size, f.created_at
+			FROM files f JOIN folders fo ON f.folder_id = fo.UID WHERE `+strings.Join(where, " AND "))
+	}
+
+	query := prefix + strings.Join(parts, " UNION ALL ") + ` ORDER BY 3 COLLATE NOCASE, 1 DESC LIMIT ? OFFSET ?`
+	args = append(args, q.Limit, q.Offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Search query failed: "+err.Error())
+		return results, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result SearchResult
+		var createdAt sql.NullString
+		if err := rows.Scan(&result.Type, &result.ID, &result.Name, &result.ParentID, &result.ContentType, &result.Size, &createdAt); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return results, http.StatusInternalServerError, err
+		}
+		result.CreatedAt = createdAt.String
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return results, http.StatusInternalServerError, err
+	}
+	rows.Close()
+
+	// Rebuild paths once per parent folder
+	paths := map[string]string{"": "/"}
+	for i := range results {
+		parentPath, ok := paths[results[i].ParentID]
+		if !ok {
+			parentPath, err = folderPath(db, results[i].ParentID)
+			if err != nil {
+				l.LogMessage(l.ERROR, "Path lookup failed: "+err.Error())
+				return results, http.StatusInternalServerError, err
+			}
+			paths[results[i].ParentID] = parentPath
+		}
+		results[i].Path = path.Join(parentPath, results[i].Name)
+	}
+
+	return results, http.StatusOK, nil
+}
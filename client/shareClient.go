@@ -0,0 +1,427 @@
+package client
+
+import (
+	l "GoStore/log"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Share struct {
+	Token        string `json:"token"`
+	URL          string `json:"url"`
+	Type         string `json:"type"`
+	ItemID       string `json:"item_id"`
+	Name         string `json:"name"`
+	HasPassword  bool   `json:"has_password"`
+	ExpiresAt    string `json:"expires_at,omitempty"`
+	MaxDownloads int    `json:"max_downloads"`
+	Downloads    int    `json:"downloads"`
+	CreatedAt    string `json:"created_at"`
+}
+
+type shareRecord struct {
+	Token        string
+	UserUID      string
+	Type         string
+	ItemID       string
+	PasswordHash sql.NullString
+	ExpiresAt    sql.NullTime
+	MaxDownloads int
+	Downloads    int
+}
+
+// newShareToken returns a random URL-safe token with 256 bits of entropy.
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateShare creates a public link to a file or folder of the user. A zero
+// expiresAt never expires and maxDownloads 0 allows unlimited downloads.
+func CreateShare(usr, itemType, itemID, password string, expiresAt time.Time, maxDownloads int) (Share, int, error) {
+	var share Share
+
+	if itemType != "file" && itemType != "folder" {
+		return share, http.StatusBadRequest, fmt.Errorf("type must be file or folder")
+	}
+	if maxDownloads < 0 {
+		return share, http.StatusBadRequest, fmt.Errorf("max_downloads cannot be negative")
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		return share, http.StatusBadRequest, fmt.Errorf("expiry must be in the future")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return share, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return share, http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return share, http.StatusInternalServerError, err
+	}
+
+	// Resolve the item so the share always points at its canonical ID
+	if itemType == "file" {
+		file, status, err := ownedFile(db, usr, itemID)
+		if err != nil {
+			return share, status, err
+		}
+		itemID = strconv.FormatInt(file.ID, 10)
+		share.Name = file.Name
+	} else {
+		folder, err := resolveFolder(db, userUID, itemID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return share, http.StatusNotFound, fmt.Errorf("folder not found or unauthorized access")
+			}
+			l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+			return share, http.StatusInternalServerError, err
+		}
+		itemID = folder.UID
+		share.Name = folder.Name
+	}
+
+	var passwordHash sql.NullString
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Password hashing failed: "+err.Error())
+			return share, http.StatusInternalServerError, err
+		}
+		passwordHash = sql.NullString{String: string(hash), Valid: true}
+	}
+
+	var expires sql.NullTime
+	if !expiresAt.IsZero() {
+		expires = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Share token generation failed: "+err.Error())
+		return share, http.StatusInternalServerError, err
+	}
+
+	insertQuery := `INSERT INTO shares (token, user_UID, item_type, item_id, password_hash, expires_at, max_downloads, downloads, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP)`
+	if _, err := db.Exec(insertQuery, token, userUID, itemType, itemID, passwordHash, expires, maxDownloads); err != nil {
+		l.LogMessage(l.ERROR, "Share insertion failed: "+err.Error())
+		return share, http.StatusInternalServerError, err
+	}
+
+	share.Token = token
+	share.URL = "/share/" + token
+	share.Type = itemType
+	share.ItemID = itemID
+	share.HasPassword = passwordHash.Valid
+	share.MaxDownloads = maxDownloads
+	share.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	if expires.Valid {
+		share.ExpiresAt = expires.Time.Format(time.RFC3339)
+	}
+
+	l.LogMessage(l.SUCS, "Share created for "+itemType+" "+itemID)
+	return share, http.StatusCreated, nil
+}
+
+// ListShares returns the share links created by the user, newest first.
+func ListShares(usr string) ([]Share, int, error) {
+	shares := []Share{}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return shares, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return shares, http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return shares, http.StatusInternalServerError, err
+	}
+
+	query := `SELECT s.token, s.item_type, s.item_id, COALESCE(f.name, fo.name, ''), s.password_hash IS NOT NULL,
+			s.expires_at, s.max_downloads, s.downloads, s.created_at
+		FROM shares s
+		LEFT JOIN files f ON s.item_type = 'file' AND f.id = s.item_id
+		LEFT JOIN folders fo ON s.item_type = 'folder' AND fo.UID = s.item_id
+		WHERE s.user_UID = ? ORDER BY s.created_at DESC`
+	rows, err := db.Query(query, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Share query failed: "+err.Error())
+		return shares, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var share Share
+		var expiresAt sql.NullTime
+		var createdAt sql.NullString
+		if err := rows.Scan(&share.Token, &share.Type, &share.ItemID, &share.Name, &share.HasPassword,
+			&expiresAt, &share.MaxDownloads, &share.Downloads, &createdAt); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return shares, http.StatusInternalServerError, err
+		}
+		share.URL = "/share/" + share.Token
+		share.CreatedAt = createdAt.String
+		if expiresAt.Valid {
+			share.ExpiresAt = expiresAt.Time.UTC().Format(time.RFC3339)
+		}
+		shares = append(shares, share)
+	}
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return shares, http.StatusInternalServerError, err
+	}
+
+	return shares, http.StatusOK, nil
+}
+
+// RevokeShare deletes a share link of the user.
+func RevokeShare(usr, token string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	res, err := db.Exec(`DELETE FROM shares WHERE token = ? AND user_UID = ?`, token, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Share deletion failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return http.StatusNotFound, fmt.Errorf("share not found")
+	}
+
+	return http.StatusOK, nil
+}
+
+// openShare looks up a share by token and checks that it can still be used.
+// Password protected shares expect the password in the Share-Password header.
+func openShare(db *sql.DB, token, password string) (shareRecord, int, error) {
+	var share shareRecord
+	query := `SELECT token, user_UID, item_type, item_id, password_hash, expires_at, max_downloads, downloads FROM shares WHERE token = ?`
+	err := db.QueryRow(query, token).Scan(&share.Token, &share.UserUID, &share.Type, &share.ItemID,
+		&share.PasswordHash, &share.ExpiresAt, &share.MaxDownloads, &share.Downloads)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return share, http.StatusNotFound, fmt.Errorf("share not found")
+		}
+		l.LogMessage(l.ERROR, "Share lookup failed: "+err.Error())
+		return share, http.StatusInternalServerError, err
+	}
+
+	if share.ExpiresAt.Valid && time.Now().After(share.ExpiresAt.Time) {
+		return share, http.StatusGone, fmt.Errorf("share has expired")
+	}
+	if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		return share, http.StatusGone, fmt.Errorf("share download limit reached")
+	}
+
+	if share.PasswordHash.Valid {
+		if password == "" {
+			return share, http.StatusUnauthorized, fmt.Errorf("password required")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash.String), []byte(password)) != nil {
+			return share, http.StatusUnauthorized, fmt.Errorf("invalid password")
+		}
+	}
+
+	return share, http.StatusOK, nil
+}
+
+// sharedFolder resolves a folder inside a folder share. An empty folderID
+// resolves to the shared folder itself.
+func sharedFolder(db *sql.DB, share shareRecord, folderID string) (FolderEntry, int, error) {
+	var folder FolderEntry
+	if share.Type != "folder" {
+		return folder, http.StatusNotFound, fmt.Errorf("folder not found")
+	}
+	if folderID == "" {
+		folderID = share.ItemID
+	}
+
+	var parentID, createdAt sql.NullString
+	query := folderSubtree + `SELECT f.UID, f.name, f.parent_id, f.created_at FROM folders f JOIN subtree s ON f.UID = s.UID WHERE f.UID = ? AND f.trash_id IS NULL`
+	err := db.QueryRow(query, share.ItemID, folderID).Scan(&folder.UID, &folder.Name, &parentID, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return folder, http.StatusNotFound, fmt.Errorf("folder not found")
+		}
+		l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+		return folder, http.StatusInternalServerError, err
+	}
+	folder.CreatedAt = createdAt.String
+
+	// Do not reveal folders above the shared one
+	if folder.UID != share.ItemID {
+		folder.ParentID = parentID.String
+	}
+
+	return folder, http.StatusOK, nil
+}
+
+// sharedFile resolves the file of a file share, or a file anywhere below the
+// folder of a folder share.
+func sharedFile(db *sql.DB, share shareRecord, fileID string) (fileRecord, int, error) {
+	var file fileRecord
+	var err error
+
+	if share.Type == "file" {
+		file, err = lookupFile(db, share.ItemID, "")
+	} else {
+		if _, convErr := strconv.ParseInt(fileID, 10, 64); convErr != nil {
+			return file, http.StatusNotFound, fmt.Errorf("file not found")
+		}
+		file, err = lookupFile(db, fileID, "")
+		if err == nil {
+			var inside bool
+			query := folderSubtree + `SELECT EXISTS(SELECT 1 FROM subtree WHERE UID = ?)`
+			err = db.QueryRow(query, share.ItemID, file.FolderID).Scan(&inside)
+			if err == nil && !inside {
+				err = sql.ErrNoRows
+			}
+		}
+	}
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return file, http.StatusNotFound, fmt.Errorf("file not found")
+		}
+		l.LogMessage(l.ERROR, "Database query failed: "+err.Error())
+		return file, http.StatusInternalServerError, err
+	}
+	return file, http.StatusOK, nil
+}
+
+// countDownload records a download against the share's limit before the file
+// is streamed. The check and the increment are one statement, so concurrent
+// downloads cannot exceed the limit. Every request that is served counts,
+// range requests included: not every backend honours ranges, and skipping
+// some ranges would let the limit be bypassed.
+func countDownload(db *sql.DB, share shareRecord) (int, error) {
+	query := `UPDATE shares SET downloads = downloads + 1 WHERE token = ? AND (max_downloads = 0 OR downloads < max_downloads)`
+	res, err := db.Exec(query, share.Token)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Share download update failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return http.StatusGone, fmt.Errorf("share download limit reached")
+	}
+	return http.StatusOK, nil
+}
+
+// ViewShare describes a share without counting a download: the file of a file
+// share, or the contents of a folder of a folder share.
+func ViewShare(token, password, folderID string) (gin.H, int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	share, status, err := openShare(db, token, password)
+	if err != nil {
+		return nil, status, err
+	}
+
+	if share.Type == "file" {
+		file, status, err := sharedFile(db, share, "")
+		if err != nil {
+			return nil, status, err
+		}
+		entry := FileEntry{ID: file.ID, Name: file.Name, ContentType: file.ContentType, Size: file.Size}
+		if !file.CreatedAt.IsZero() {
+			entry.CreatedAt = file.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		return gin.H{"type": "file", "file": entry}, http.StatusOK, nil
+	}
+
+	listing := FolderListing{}
+	listing.Folder, status, err = sharedFolder(db, share, folderID)
+	if err != nil {
+		return nil, status, err
+	}
+	listing.Folders, listing.Files, err = folderContents(db, listing.Folder.UID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder listing failed: "+err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+	// Blob digests stay private to the owner
+	for i := range listing.Files {
+		listing.Files[i].HashedName = ""
+	}
+
+	return gin.H{"type": "folder", "folder": listing}, http.StatusOK, nil
+}
+
+// DownloadShare serves the file of a file share, or the file with the given ID
+// inside a folder share, without requiring a login.
+func DownloadShare(c *gin.Context, token, fileID string) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer db.Close()
+
+	share, status, err := openShare(db, token, c.GetHeader("Share-Password"))
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	file, status, err := sharedFile(db, share, fileID)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	// HEAD requests and revalidations answered with 304 send no content
+	match := c.GetHeader("If-None-Match")
+	notModified := match == "*" || match == `"`+file.HashedName+`"`
+	if c.Request.Method != http.MethodHead && !notModified {
+		if status, err := countDownload(db, share); err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	serveFile(c, file)
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"GoStore/jobs"
+	l "GoStore/log"
+	"GoStore/storage"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Longest edge in pixels of each thumbnail size.
+var thumbSizes = map[string]int{
+	"small":  128,
+	"medium": 512,
+}
+
+// Images with more pixels than this are not decoded, so a small file that
+// claims huge dimensions cannot exhaust memory.
+const maxThumbPixels = 50_000_000
+
+// thumbLocks makes concurrent requests for the same thumbnail wait for a
+// single generation.
+var thumbLocks sync.Map
+
+func lockThumb(name string) func() {
+	m, _ := thumbLocks.LoadOrStore(name, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// thumbnailable reports whether previews can be generated for a content type.
+func thumbnailable(contentType string) bool {
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// thumbFormat picks the preview encoding. JPEG sources stay JPEG, everything
+// else becomes PNG to keep transparency.
+func thumbFormat(contentType string) string {
+	if strings.HasPrefix(contentType, "image/jpeg") {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// thumbName is the name of a cached preview. Previews are cached per blob, so
+// identical uploads share them.
+func thumbName(digest, size, format string) string {
+	return digest + "-" + size + "." + format
+}
+
+// generateThumb decodes a blob and encodes a preview whose longest edge is at
+// most edge pixels. Smaller images are not scaled up.
+func generateThumb(digest, format string, edge int) ([]byte, error) {
+	reader, err := openBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Read the header first to reject oversized images before decoding
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(reader, &head))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbPixels {
+		return nil, fmt.Errorf("image too large for a thumbnail")
+	}
+	src, _, err := image.Decode(io.MultiReader(&head, reader))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > edge || height > edge {
+		if width >= height {
+			height = max(1, height*edge/width)
+			width = edge
+		} else {
+			width = max(1, width*edge/height)
+			height = edge
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
+
+// thumbnail returns the cached preview of a blob, generating it on first use.
+// Previews of encrypted blobs are cached encrypted as well, under a key
+// derived from the blob's data key.
+func thumbnail(digest, contentType, size string) ([]byte, string, error) {
+	format := thumbFormat(contentType)
+	name := thumbName(digest, size, format)
+
+	unlock := lockThumb(name)
+	defer unlock()
+
+	dataKey, err := blobDataKey(digest)
+	if err != nil {
+		return nil, format, err
+	}
+	var thumbKey []byte
+	if dataKey != nil {
+		thumbKey = storage.DeriveKey(dataKey, name)
+	}
+
+	if reader, err := storage.Thumbs.Get(name); err == nil {
+		if thumbKey != nil {
+			plain, err := storage.Decrypt(reader, thumbKey)
+			if err != nil {
+				reader.Close()
+				return nil, format, err
+			}
+			reader = plain
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		return data, format, err
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, format, err
+	}
+
+	data, err := generateThumb(digest, format, thumbSizes[size])
+	if err != nil {
+		return nil, format, err
+	}
+	var body io.Reader = bytes.NewReader(data)
+	storedSize := int64(len(data))
+	if thumbKey != nil {
+		if body, err = storage.Encrypt(body, thumbKey); err != nil {
+			return nil, format, err
+		}
+		storedSize = storage.EncryptedSize(storedSize)
+	}
+	if err := storage.Thumbs.Put(name, body, storedSize); err != nil {
+		// Still serve the preview, it is generated again next time
+		l.LogMessage(l.WARNING, "Failed to cache thumbnail: "+err.Error())
+	}
+
+	return data, format, nil
+}
+
+// thumbnailTask is the payload of a thumbnails job.
+type thumbnailTask struct {
+	Digest      string `json:"digest"`
+	ContentType string `json:"content_type"`
+}
+
+// queueThumbnails queues the previews of a new image upload for generation in
+// the background so the first listing that shows it does not have to wait.
+func queueThumbnails(digest, contentType string) {
+	if !thumbnailable(contentType) {
+		return
+	}
+	if _, err := jobs.Enqueue("thumbnails", thumbnailTask{Digest: digest, ContentType: contentType}); err != nil {
+		l.LogMessage(l.WARNING, "Failed to queue thumbnails for "+digest+": "+err.Error())
+	}
+}
+
+// thumbnailJob generates every preview size of an image.
+func thumbnailJob(payload []byte) error {
+	var task thumbnailTask
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return err
+	}
+	for size := range thumbSizes {
+		if _, _, err := thumbnail(task.Digest, task.ContentType, size); err != nil {
+			// The file may have been deleted since it was uploaded
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteThumbnails removes the cached previews of a blob once it is deleted
+// or stored again under a new data key.
+func deleteThumbnails(digest string) {
+	for size := range thumbSizes {
+		for _, format := range []string{"jpeg", "png"} {
+			err := storage.Thumbs.Delete(thumbName(digest, size, format))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				l.LogMessage(l.WARNING, "Failed to delete thumbnail: "+err.Error())
+			}
+		}
+	}
+}
+
+// ViewThumbnail serves a small (default) or medium preview of an image file,
+// with the same ownership checks as ViewFile.
+func ViewThumbnail(c *gin.Context) {
+	size := c.DefaultQuery("size", "small")
+	if _, ok := thumbSizes[size]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "size must be small or medium"})
+		return
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer db.Close()
+
+	file, ok := requestedFile(c, db)
+	if !ok {
+		return
+	}
+
+	if !thumbnailable(file.ContentType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "No thumbnail for this file type"})
+		return
+	}
+
+	etag := `"` + file.HashedName + "-" + size + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("X-Content-Type-Options", "nosniff")
+	if match := c.GetHeader("If-None-Match"); match != "" && (match == etag || match == "*") {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	data, format, err := thumbnail(file.HashedName, file.ContentType, size)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found on disk"})
+			return
+		}
+		l.LogMessage(l.ERROR, "Thumbnail generation failed: "+err.Error())
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Could not generate thumbnail"})
+		return
+	}
+
+	c.Data(http.StatusOK, "image/"+format, data)
+}
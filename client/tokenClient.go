@@ -0,0 +1,350 @@
+package client
+
+import (
+	"GoStore/auth"
+	l "GoStore/log"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Personal access tokens start with this prefix, which tells them apart from
+// session tokens and lets secret scanners find leaked ones.
+const accessTokenPrefix = "gsp_"
+
+// Scopes of personal access tokens. A token can do what its scopes allow and
+// its user is still permitted to do, never more.
+const (
+	ScopeRead   = "read"   // browse and download files
+	ScopeUpload = "upload" // create folders and upload files
+	ScopeWrite  = "write"  // everything the user can do with files
+)
+
+var scopePermissions = map[string][]auth.Permission{
+	ScopeRead:   {auth.PermFilesRead},
+	ScopeUpload: {auth.PermFilesUpload},
+	ScopeWrite:  {auth.PermFilesRead, auth.PermFilesUpload, auth.PermFilesWrite},
+}
+
+// ErrInvalidAccessToken is returned for unknown and expired access tokens.
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// AccessToken is a personal access token. Token is only set when the token is
+// created; afterwards only its hash is known.
+type AccessToken struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Token      string   `json:"token,omitempty"`
+	Scopes     []string `json:"scopes"`
+	FolderID   string   `json:"folder_id,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	Username   string   `json:"-"`
+}
+
+// TokenTarget is a file, folder or upload session a request acts on. Inside
+// targets must lie below a token's folder; the folder itself does not count.
+type TokenTarget struct {
+	Type   string
+	ID     string
+	Inside bool
+}
+
+// IsAccessToken reports whether a token presented by a client is a personal
+// access token rather than a session token.
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, accessTokenPrefix)
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Permissions returns the permissions of granted, the permissions of the
+// token's user, that the token's scopes allow.
+func (t AccessToken) Permissions(granted map[auth.Permission]bool) map[auth.Permission]bool {
+	perms := map[auth.Permission]bool{}
+	for _, scope := range t.Scopes {
+		for _, perm := range scopePermissions[scope] {
+			if granted[perm] {
+				perms[perm] = true
+			}
+		}
+	}
+	return perms
+}
+
+// CreateAccessToken creates a personal access token for the user. A zero
+// expiresAt never expires. folderID limits the token to a folder the user can
+// see and everything in it; "root" is the user's own top level folder.
+func CreateAccessToken(usr, name string, scopes []string, folderID string, expiresAt time.Time) (AccessToken, int, error) {
+	var token AccessToken
+
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return token, http.StatusBadRequest, fmt.Errorf("name must be between 1 and 100 characters")
+	}
+	if len(scopes) == 0 {
+		return token, http.StatusBadRequest, fmt.Errorf("at least one scope is required")
+	}
+	seen := map[string]bool{}
+	for _, scope := range scopes {
+		if _, ok := scopePermissions[scope]; !ok {
+			return token, http.StatusBadRequest, fmt.Errorf("unknown scope %q, use read, upload or write", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			token.Scopes = append(token.Scopes, scope)
+		}
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		return token, http.StatusBadRequest, fmt.Errorf("expiry must be in the future")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return token, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return token, http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return token, http.StatusInternalServerError, err
+	}
+
+	var folderUID sql.NullString
+	if folderID != "" {
+		folder, _, status, err := accessibleFolder(db, userUID, folderID, accessViewer)
+		if err != nil {
+			return token, status, err
+		}
+		folderUID = sql.NullString{String: folder.UID, Valid: true}
+	}
+
+	var expires sql.NullTime
+	if !expiresAt.IsZero() {
+		expires = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		l.LogMessage(l.ERROR, "Access token generation failed: "+err.Error())
+		return token, http.StatusInternalServerError, err
+	}
+	secret := accessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	token.ID = uuid.New().String()
+	insertQuery := `INSERT INTO access_tokens (id, user_UID, name, token_hash, scopes, folder_UID, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`
+	if _, err := db.Exec(insertQuery, token.ID, userUID, name, hashAccessToken(secret), strings.Join(token.Scopes, ","), folderUID, expires); err != nil {
+		l.LogMessage(l.ERROR, "Access token insertion failed: "+err.Error())
+		return token, http.StatusInternalServerError, err
+	}
+
+	token.Name = name
+	token.Token = secret
+	token.FolderID = folderUID.String
+	token.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	if expires.Valid {
+		token.ExpiresAt = expires.Time.Format(time.RFC3339)
+	}
+
+	l.LogMessage(l.INFO, "Access token "+name+" created for "+usr)
+	return token, http.StatusCreated, nil
+}
+
+// ListAccessTokens returns the personal access tokens of the user, newest
+// first, including expired ones.
+func ListAccessTokens(usr string) ([]AccessToken, int, error) {
+	tokens := []AccessToken{}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return tokens, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	query := `SELECT t.id, t.name, t.scopes, t.folder_UID, t.created_at, t.expires_at, t.last_used_at
+		FROM access_tokens t JOIN users u ON u.UID = t.user_UID
+		WHERE u.username = ? ORDER BY t.created_at DESC`
+	rows, err := db.Query(query, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Access token query failed: "+err.Error())
+		return tokens, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token AccessToken
+		var scopes string
+		var folderUID, createdAt, lastUsedAt sql.NullString
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&token.ID, &token.Name, &scopes, &folderUID, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return tokens, http.StatusInternalServerError, err
+		}
+		token.Scopes = strings.Split(scopes, ",")
+		token.FolderID = folderUID.String
+		token.CreatedAt = createdAt.String
+		token.LastUsedAt = lastUsedAt.String
+		if expiresAt.Valid {
+			token.ExpiresAt = expiresAt.Time.UTC().Format(time.RFC3339)
+		}
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return tokens, http.StatusInternalServerError, err
+	}
+
+	return tokens, http.StatusOK, nil
+}
+
+// RevokeAccessToken deletes a personal access token of the user. It stops
+// working immediately.
+func RevokeAccessToken(usr, tokenID string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM access_tokens WHERE id = ? AND user_UID IN (SELECT UID FROM users WHERE username = ?)`, tokenID, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Access token deletion failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return http.StatusNotFound, fmt.Errorf("access token not found")
+	}
+
+	l.LogMessage(l.INFO, "Access token "+tokenID+" revoked by "+usr)
+	return http.StatusOK, nil
+}
+
+// AuthenticateAccessToken looks up the personal access token a client
+// presented and records that it was used.
+func AuthenticateAccessToken(secret string) (AccessToken, error) {
+	var token AccessToken
+	if !IsAccessToken(secret) {
+		return token, ErrInvalidAccessToken
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return token, err
+	}
+	defer db.Close()
+
+	var scopes string
+	var folderUID sql.NullString
+	var expiresAt sql.NullTime
+	err = db.QueryRow(`SELECT t.id, t.name, t.scopes, t.folder_UID, t.expires_at, u.username
+		FROM access_tokens t JOIN users u ON u.UID = t.user_UID
+		WHERE t.token_hash = ?`, hashAccessToken(secret)).Scan(&token.ID, &token.Name, &scopes, &folderUID, &expiresAt, &token.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return token, ErrInvalidAccessToken
+		}
+		l.LogMessage(l.ERROR, "Access token query failed: "+err.Error())
+		return token, err
+	}
+	if expiresAt.Valid && time.Now().After(expiresAt.Time) {
+		return token, ErrInvalidAccessToken
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	token.FolderID = folderUID.String
+
+	if _, err := db.Exec(`UPDATE access_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`, token.ID); err != nil {
+		l.LogMessage(l.WARNING, "Access token last use update failed: "+err.Error())
+	}
+
+	return token, nil
+}
+
+// CheckTokenFolder checks that every target of a request lies in the folder a
+// personal access token is limited to. Requests without targets, such as a
+// search across all files, are refused as well.
+func CheckTokenFolder(token AccessToken, targets []TokenTarget) (int, error) {
+	if len(targets) == 0 {
+		return http.StatusForbidden, fmt.Errorf("this request is not available to tokens limited to a folder")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	for _, target := range targets {
+		folderUID, err := targetFolderUID(db, token.Username, target)
+		if err != nil && err != sql.ErrNoRows {
+			l.LogMessage(l.ERROR, "Access token target lookup failed: "+err.Error())
+			return http.StatusInternalServerError, err
+		}
+
+		inside := false
+		if err == nil && !(target.Inside && folderUID == token.FolderID) {
+			err = db.QueryRow(folderAncestors+`SELECT EXISTS(SELECT 1 FROM ancestors WHERE UID = ?)`, folderUID, token.FolderID).Scan(&inside)
+			if err != nil {
+				l.LogMessage(l.ERROR, "Access token folder check failed: "+err.Error())
+				return http.StatusInternalServerError, err
+			}
+		}
+		if !inside {
+			return http.StatusForbidden, fmt.Errorf("the access token is limited to another folder")
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// targetFolderUID returns the UID of the folder a target is or lies in, or
+// sql.ErrNoRows if there is no such target.
+func targetFolderUID(db *sql.DB, usr string, target TokenTarget) (string, error) {
+	var folderUID string
+	switch target.Type {
+	case "file":
+		fileID, err := strconv.ParseInt(target.ID, 10, 64)
+		if err != nil {
+			return "", sql.ErrNoRows
+		}
+		err = db.QueryRow(`SELECT folder_id FROM files WHERE id = ?`, fileID).Scan(&folderUID)
+		return folderUID, err
+	case "upload":
+		err := db.QueryRow(`SELECT folder_id FROM upload_sessions WHERE UID = ?`, target.ID).Scan(&folderUID)
+		return folderUID, err
+	case "folder":
+		if target.ID != "root" {
+			return target.ID, nil
+		}
+		userUID, err := getUserUID(db, usr)
+		if err != nil {
+			return "", err
+		}
+		folder, err := resolveFolder(db, userUID, "root")
+		return folder.UID, err
+	}
+	return "", sql.ErrNoRows
+}
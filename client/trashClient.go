@@ -0,0 +1,366 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type TrashEntry struct {
+	ID           int64  `json:"id"`
+	Type         string `json:"type"`
+	ItemID       string `json:"item_id"`
+	Name         string `json:"name"`
+	OriginalPath string `json:"original_path"`
+	DeletedAt    string `json:"deleted_at"`
+	Group        string `json:"group,omitempty"` // set for entries in a group's trash
+}
+
+// trashOwners selects the trash a user manages: their own and that of the
+// groups they manage. It takes the user UID twice.
+const trashOwners = `(SELECT ? UNION SELECT group_UID FROM group_members WHERE user_UID = ? AND role = 'manager')`
+
+// trashItem records a trash entry and returns its ID. The path is the path of
+// the parent folder the item was deleted from.
+func trashItem(tx *sql.Tx, userUID, itemType, itemID, name, parentUID, parentPath string) (int64, error) {
+	insertQuery := `INSERT INTO trash (user_UID, item_type, item_id, name, original_parent, original_path, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`
+	res, err := tx.Exec(insertQuery, userUID, itemType, itemID, name, parentUID, parentPath)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// trashFile moves a live file to the owner's trash.
+func trashFile(db *sql.DB, userUID string, file fileRecord) error {
+	parentPath, err := folderPath(db, file.FolderID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	trashID, err := trashItem(tx, userUID, "file", strconv.FormatInt(file.ID, 10), file.Name, file.FolderID, parentPath)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE files SET trash_id = ? WHERE id = ?`, trashID, file.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TrashFolder moves a folder and everything below it to the owner's trash.
+// Like deleting a file, it needs editor access to the folder.
+func TrashFolder(usr, folderID string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	folder, ownerUID, status, err := accessibleFolder(db, userUID, folderID, accessEditor)
+	if err != nil {
+		return status, err
+	}
+	var isRoot bool
+	err = db.QueryRow(`SELECT parent_id IS NULL FROM folders WHERE UID = ?`, folder.UID).Scan(&isRoot)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Folder lookup failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if isRoot {
+		return http.StatusBadRequest, fmt.Errorf("the root folder cannot be deleted")
+	}
+
+	parentPath, err := folderPath(db, folder.ParentID)
+	if err != nil {
+		parentPath = "/"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	// The folder goes to its owner's trash, wherever the delete came from
+	trashID, err := trashItem(tx, ownerUID, "folder", folder.UID, folder.Name, folder.ParentID, parentPath)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Trash entry creation failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	// Files first, the folder query below marks the subtree as trashed
+	_, err = tx.Exec(folderSubtree+`UPDATE files SET trash_id = ? WHERE trash_id IS NULL AND folder_id IN (SELECT UID FROM subtree)`, folder.UID, trashID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Trashing files failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	_, err = tx.Exec(folderSubtree+`UPDATE folders SET trash_id = ? WHERE UID IN (SELECT UID FROM subtree)`, folder.UID, trashID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Trashing folders failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	l.LogMessage(l.INFO, "Folder moved to trash: "+folder.Name)
+	return http.StatusOK, nil
+}
+
+// ListTrash returns the trash entries of a user and of the groups they
+// manage, newest first.
+func ListTrash(usr string) ([]TrashEntry, int, error) {
+	entries := []TrashEntry{}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return entries, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return entries, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	query := `SELECT t.id, t.item_type, t.item_id, t.name, t.original_path, t.deleted_at, COALESCE(g.name, '')
+		FROM trash t LEFT JOIN groups g ON t.user_UID = g.UID
+		WHERE t.user_UID IN ` + trashOwners + ` ORDER BY t.deleted_at DESC, t.id DESC`
+	rows, err := db.Query(query, userUID, userUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Trash query failed: "+err.Error())
+		return entries, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry TrashEntry
+		var deletedAt sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Type, &entry.ItemID, &entry.Name, &entry.OriginalPath, &deletedAt, &entry.Group); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return entries, http.StatusInternalServerError, err
+		}
+		entry.DeletedAt = deletedAt.String
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return entries, http.StatusInternalServerError, err
+	}
+
+	return entries, http.StatusOK, nil
+}
+
+// getTrashEntry returns a trash entry the user manages, the folder it was
+// deleted from and the UID of the user or group whose trash it is in.
+func getTrashEntry(db *sql.DB, userUID, trashID string) (TrashEntry, string, string, error) {
+	var entry TrashEntry
+	var originalParent, ownerUID string
+	query := `SELECT id, item_type, item_id, name, original_parent, original_path, user_UID FROM trash WHERE id = ? AND user_UID IN ` + trashOwners
+	err := db.QueryRow(query, trashID, userUID, userUID).Scan(&entry.ID, &entry.Type, &entry.ItemID, &entry.Name, &originalParent, &entry.OriginalPath, &ownerUID)
+	return entry, originalParent, ownerUID, err
+}
+
+// RestoreTrash puts a trashed item back where it was deleted from. If that
+// folder no longer exists the item is restored into the owner's root folder.
+func RestoreTrash(usr, trashID string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	entry, parentUID, ownerUID, err := getTrashEntry(db, userUID, trashID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return http.StatusNotFound, fmt.Errorf("trash entry not found")
+		}
+		l.LogMessage(l.ERROR, "Trash lookup failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	if _, err := resolveFolder(db, ownerUID, parentUID); err != nil {
+		root, err := resolveFolder(db, ownerUID, "root")
+		if err != nil {
+			l.LogMessage(l.ERROR, "Root folder lookup failed: "+err.Error())
+			return http.StatusInternalServerError, err
+		}
+		parentUID = root.UID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	// Re-attach the restored item to its (possibly new) parent
+	reparentQuery := `UPDATE folders SET parent_id = ? WHERE UID = ?`
+	if entry.Type == "file" {
+		reparentQuery = `UPDATE files SET folder_id = ? WHERE id = ?`
+	}
+	if _, err := tx.Exec(reparentQuery, parentUID, entry.ItemID); err != nil {
+		l.LogMessage(l.ERROR, "Restore failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	for _, query := range []string{
+		`UPDATE files SET trash_id = NULL WHERE trash_id = ?`,
+		`UPDATE folders SET trash_id = NULL WHERE trash_id = ?`,
+		`DELETE FROM trash WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, entry.ID); err != nil {
+			l.LogMessage(l.ERROR, "Restore failed: "+err.Error())
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	l.LogMessage(l.INFO, "Restored from trash: "+entry.Name)
+	return http.StatusOK, nil
+}
+
+// purgeTrashEntry permanently deletes everything belonging to a trash entry.
+func purgeTrashEntry(db *sql.DB, trashID int64) error {
+	rows, err := db.Query(`SELECT hashed_name FROM files WHERE trash_id = ?
+		UNION ALL
+		SELECT v.hashed_name FROM file_versions v JOIN files f ON v.file_id = f.id WHERE f.trash_id = ?`, trashID, trashID)
+	if err != nil {
+		return err
+	}
+	var blobs []string
+	for rows.Next() {
+		var hashedName string
+		if err := rows.Scan(&hashedName); err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, hashedName)
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM shares WHERE item_type = 'file' AND item_id IN (SELECT CAST(id AS TEXT) FROM files WHERE trash_id = ?)`,
+		`DELETE FROM shares WHERE item_type = 'folder' AND item_id IN (SELECT UID FROM folders WHERE trash_id = ?)`,
+		`DELETE FROM tags WHERE item_type = 'file' AND item_id IN (SELECT CAST(id AS TEXT) FROM files WHERE trash_id = ?)`,
+		`DELETE FROM tags WHERE item_type = 'folder' AND item_id IN (SELECT UID FROM folders WHERE trash_id = ?)`,
+		`DELETE FROM metadata WHERE item_type = 'file' AND item_id IN (SELECT CAST(id AS TEXT) FROM files WHERE trash_id = ?)`,
+		`DELETE FROM metadata WHERE item_type = 'folder' AND item_id IN (SELECT UID FROM folders WHERE trash_id = ?)`,
+		`DELETE FROM folder_acl WHERE folder_UID IN (SELECT UID FROM folders WHERE trash_id = ?)`,
+		`DELETE FROM file_versions WHERE file_id IN (SELECT id FROM files WHERE trash_id = ?)`,
+		`DELETE FROM files WHERE trash_id = ?`,
+		`DELETE FROM folders WHERE trash_id = ?`,
+		`DELETE FROM trash WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, trashID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	releaseBlobs(blobs)
+	return nil
+}
+
+// PurgeTrash permanently deletes a single trash entry of a user.
+func PurgeTrash(usr, trashID string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	entry, _, _, err := getTrashEntry(db, userUID, trashID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return http.StatusNotFound, fmt.Errorf("trash entry not found")
+		}
+		l.LogMessage(l.ERROR, "Trash lookup failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	if err := purgeTrashEntry(db, entry.ID); err != nil {
+		l.LogMessage(l.ERROR, "Trash purge failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// EmptyTrash permanently deletes everything in a user's own trash. Group
+// trash entries are purged one at a time.
+func EmptyTrash(usr string) (int, error) {
+	entries, status, err := ListTrash(usr)
+	if err != nil {
+		return status, err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	for _, entry := range entries {
+		if entry.Group != "" {
+			continue
+		}
+		if err := purgeTrashEntry(db, entry.ID); err != nil {
+			l.LogMessage(l.ERROR, "Trash purge failed: "+err.Error())
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	return http.StatusOK, nil
+}
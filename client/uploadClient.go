@@ -0,0 +1,327 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Partially received uploads live here until the last chunk arrives.
+const partialDir = "uploads/partial"
+
+type UploadSession struct {
+	UID      string `json:"upload_id"`
+	FolderID string `json:"folder_id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	expected Checksums
+}
+
+// uploadLocks serialises chunk writes per upload session.
+var uploadLocks sync.Map
+
+func lockUpload(uploadID string) func() {
+	m, _ := uploadLocks.LoadOrStore(uploadID, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func getUploadSession(db *sql.DB, userUID, uploadID string) (UploadSession, error) {
+	var session UploadSession
+	var sha, md5Sum, crc sql.NullString
+	query := `SELECT UID, folder_id, name, size, offset, expected_sha256, expected_md5, expected_crc32c FROM upload_sessions WHERE UID = ? AND user_UID = ?`
+	err := db.QueryRow(query, uploadID, userUID).Scan(&session.UID, &session.FolderID, &session.Name, &session.Size, &session.Offset, &sha, &md5Sum, &crc)
+	session.expected = Checksums{SHA256: sha.String, MD5: md5Sum.String, CRC32C: crc.String}
+	return session, err
+}
+
+// CreateUpload starts a resumable upload of size bytes into a folder the user
+// owns or may edit. The completed upload must match the expected checksums.
+func CreateUpload(usr, folderID, name string, size int64, expected Checksums) (UploadSession, int, error) {
+	var session UploadSession
+
+	if name == "" || size < 0 {
+		return session, http.StatusBadRequest, fmt.Errorf("filename and a non-negative size are required")
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return session, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return session, http.StatusNotFound, fmt.Errorf("user not found")
+		}
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return session, http.StatusInternalServerError, err
+	}
+
+	folder, ownerUID, status, err := accessibleFolder(db, userUID, folderID, accessEditor)
+	if err != nil {
+		if status == http.StatusNotFound {
+			status = http.StatusForbidden
+		}
+		return session, status, err
+	}
+
+	// Uploads count against the quota of the folder's owner
+	if status, err := checkQuota(db, ownerUID, size); err != nil {
+		return session, status, err
+	}
+
+	if err := os.MkdirAll(partialDir, 0755); err != nil {
+		l.LogMessage(l.ERROR, "Failed to create partial upload directory: "+err.Error())
+		return session, http.StatusInternalServerError, err
+	}
+
+	session = UploadSession{
+		UID:      uuid.New().String(),
+		FolderID: folder.UID,
+		Name:     name,
+		Size:     size,
+		expected: expected,
+	}
+
+	f, err := os.Create(filepath.Join(partialDir, session.UID))
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to create partial upload: "+err.Error())
+		return session, http.StatusInternalServerError, err
+	}
+	f.Close()
+
+	insertQuery := `INSERT INTO upload_sessions (UID, user_UID, folder_id, name, size, offset, expected_sha256, expected_md5, expected_crc32c, created_at)
+		VALUES (?, ?, ?, ?, ?, 0, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), CURRENT_TIMESTAMP)`
+	_, err = db.Exec(insertQuery, session.UID, userUID, session.FolderID, session.Name, session.Size, expected.SHA256, expected.MD5, expected.CRC32C)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Upload session creation failed: "+err.Error())
+		os.Remove(filepath.Join(partialDir, session.UID))
+		return session, http.StatusInternalServerError, err
+	}
+
+	return session, http.StatusCreated, nil
+}
+
+// GetUpload returns the state of an upload session owned by the user.
+func GetUpload(usr, uploadID string) (UploadSession, int, error) {
+	var session UploadSession
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return session, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	userUID, err := getUserUID(db, usr)
+	if err != nil {
+		l.LogMessage(l.ERROR, "User lookup failed: "+err.Error())
+		return session, http.StatusNotFound, fmt.Errorf("user not found")
+	}
+
+	session, err = getUploadSession(db, userUID, uploadID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return session, http.StatusNotFound, fmt.Errorf("upload not found")
+		}
+		l.LogMessage(l.ERROR, "Upload session lookup failed: "+err.Error())
+		return session, http.StatusInternalServerError, err
+	}
+
+	return session, http.StatusOK, nil
+}
+
+// WriteUploadChunk appends the body to an upload session at the given offset.
+// Whatever part of the chunk was received is kept even if the connection drops,
+// so the client can resume from the offset reported by GetUpload. Once the last
+// byte arrives the upload is finalized and the stored file is returned; it
+// replaces a file of the same name only if canReplace is set.
+func WriteUploadChunk(usr, uploadID string, offset int64, body io.Reader, canReplace bool) (UploadSession, *FileEntry, int, error) {
+	unlock := lockUpload(uploadID)
+	defer unlock()
+
+	session, status, err := GetUpload(usr, uploadID)
+	if err != nil {
+		return session, nil, status, err
+	}
+
+	if offset != session.Offset {
+		return session, nil, http.StatusConflict, fmt.Errorf("offset mismatch: expected %d", session.Offset)
+	}
+
+	// CreateUpload made the partial file. If it is gone, or shorter than the
+	// recorded offset, the data received so far is lost and resuming would
+	// store zeros in its place.
+	partialPath := filepath.Join(partialDir, session.UID)
+	info, err := os.Stat(partialPath)
+	if err != nil && !os.IsNotExist(err) {
+		l.LogMessage(l.ERROR, "Failed to stat partial upload: "+err.Error())
+		return session, nil, http.StatusInternalServerError, err
+	}
+	if err != nil || info.Size() < session.Offset {
+		l.LogMessage(l.WARNING, "Partial data of upload "+session.UID+" is missing, discarding it")
+		if db, err := sql.Open("sqlite3", "main.db"); err == nil {
+			discardUpload(db, session.UID)
+			db.Close()
+		}
+		return session, nil, http.StatusGone, fmt.Errorf("upload data is missing, start a new upload")
+	}
+
+	f, err := os.OpenFile(partialPath, os.O_WRONLY, 0644)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to open partial upload: "+err.Error())
+		return session, nil, http.StatusInternalServerError, err
+	}
+
+	// Drop anything written after the last recorded offset, e.g. by a crash
+	if err := f.Truncate(session.Offset); err != nil {
+		f.Close()
+		l.LogMessage(l.ERROR, "Failed to truncate partial upload: "+err.Error())
+		return session, nil, http.StatusInternalServerError, err
+	}
+	if _, err := f.Seek(session.Offset, io.SeekStart); err != nil {
+		f.Close()
+		l.LogMessage(l.ERROR, "Failed to seek partial upload: "+err.Error())
+		return session, nil, http.StatusInternalServerError, err
+	}
+
+	written, copyErr := io.Copy(f, io.LimitReader(body, session.Size-session.Offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return session, nil, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	session.Offset += written
+	_, err = db.Exec(`UPDATE upload_sessions SET offset = ? WHERE UID = ?`, session.Offset, session.UID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Upload offset update failed: "+err.Error())
+		return session, nil, http.StatusInternalServerError, err
+	}
+
+	if copyErr != nil {
+		l.LogMessage(l.WARNING, "Upload chunk interrupted: "+copyErr.Error())
+		return session, nil, http.StatusBadRequest, fmt.Errorf("chunk interrupted at offset %d", session.Offset)
+	}
+
+	if session.Offset < session.Size {
+		return session, nil, http.StatusNoContent, nil
+	}
+
+	file, status, err := finalizeUpload(db, session, canReplace)
+	if err != nil {
+		return session, nil, status, err
+	}
+
+	return session, file, http.StatusCreated, nil
+}
+
+// finalizeUpload moves a completed upload into the blob store and records its metadata.
+func finalizeUpload(db *sql.DB, session UploadSession, canReplace bool) (*FileEntry, int, error) {
+	var userUID string
+	var ownerUID sql.NullString
+	query := `SELECT s.user_UID, f.user_UID FROM upload_sessions s LEFT JOIN folders f ON s.folder_id = f.UID WHERE s.UID = ?`
+	err := db.QueryRow(query, session.UID).Scan(&userUID, &ownerUID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Upload session lookup failed: "+err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+	if !ownerUID.Valid {
+		return nil, http.StatusForbidden, fmt.Errorf("folder not found or unauthorized access")
+	}
+
+	// Other uploads may have used up the quota since this session was created
+	if status, err := checkQuota(db, ownerUID.String, session.Size); err != nil {
+		return nil, status, err
+	}
+
+	partialPath := filepath.Join(partialDir, session.UID)
+	sums, contentType, err := StoreBlob(func() (io.ReadCloser, error) { return os.Open(partialPath) }, session.Size, session.expected)
+	if errors.Is(err, ErrChecksumMismatch) {
+		// Resuming cannot fix corrupted content, the client has to start over
+		discardUpload(db, session.UID)
+		return nil, http.StatusBadRequest, fmt.Errorf("%w, upload discarded", err)
+	}
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to store completed upload: "+err.Error())
+		return nil, http.StatusInternalServerError, err
+	}
+	digest := sums.SHA256
+
+	// The partial file stays until the metadata is saved, so a failed attempt
+	// can be retried with an empty PATCH at the final offset
+	fileID, status, err := SaveFileMetadata(userUID, session.FolderID, session.Name, digest, contentType, session.Size, canReplace)
+	if err != nil {
+		ReleaseBlob(digest)
+		if status == http.StatusConflict {
+			// Retrying cannot succeed, the client has to pick another name
+			discardUpload(db, session.UID)
+		}
+		return nil, status, err
+	}
+	os.Remove(partialPath)
+
+	if _, err := db.Exec(`DELETE FROM upload_sessions WHERE UID = ?`, session.UID); err != nil {
+		l.LogMessage(l.ERROR, "Failed to delete upload session: "+err.Error())
+	}
+	uploadLocks.Delete(session.UID)
+
+	l.LogMessage(l.SUCS, "Upload completed: "+session.Name)
+	return &FileEntry{ID: fileID, Name: session.Name, HashedName: digest, ContentType: contentType, Size: session.Size, Checksums: &sums}, http.StatusCreated, nil
+}
+
+// AbortUpload discards an unfinished upload session and its data.
+func AbortUpload(usr, uploadID string) (int, error) {
+	unlock := lockUpload(uploadID)
+	defer unlock()
+
+	session, status, err := GetUpload(usr, uploadID)
+	if err != nil {
+		return status, err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	if err := discardUpload(db, session.UID); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusNoContent, nil
+}
+
+// discardUpload deletes an upload session and its partial data.
+func discardUpload(db *sql.DB, uploadID string) error {
+	if _, err := db.Exec(`DELETE FROM upload_sessions WHERE UID = ?`, uploadID); err != nil {
+		l.LogMessage(l.ERROR, "Failed to delete upload session: "+err.Error())
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(partialDir, uploadID)); err != nil && !os.IsNotExist(err) {
+		l.LogMessage(l.ERROR, "Failed to delete partial upload: "+err.Error())
+	}
+	uploadLocks.Delete(uploadID)
+	return nil
+}
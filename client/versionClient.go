@@ -0,0 +1,240 @@
+package client
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Previous versions kept per file when MAX_FILE_VERSIONS is not set.
+const defaultMaxVersions = 10
+
+type FileVersion struct {
+	ID          int64  `json:"id"`
+	HashedName  string `json:"hashed_name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	CreatedAt   string `json:"created_at"`
+	Current     bool   `json:"current"`
+}
+
+// versionLimits reads how many previous versions to keep per file and for how
+// long. MAX_FILE_VERSIONS=0 disables versioning, MAX_VERSION_AGE_DAYS=0 keeps
+// versions regardless of age.
+func versionLimits() (int, time.Duration) {
+	maxCount := defaultMaxVersions
+	if v, err := strconv.Atoi(os.Getenv("MAX_FILE_VERSIONS")); err == nil && v >= 0 {
+		maxCount = v
+	}
+
+	var maxAge time.Duration
+	if v, err := strconv.Atoi(os.Getenv("MAX_VERSION_AGE_DAYS")); err == nil && v > 0 {
+		maxAge = time.Duration(v) * 24 * time.Hour
+	}
+
+	return maxCount, maxAge
+}
+
+// archiveVersion copies the current content of a file into its version history.
+func archiveVersion(tx *sql.Tx, fileID int64) error {
+	archiveQuery := `INSERT INTO file_versions (file_id, hashed_name, content_type, size, created_at)
+		SELECT id, hashed_name, content_type, size, COALESCE(created_at, CURRENT_TIMESTAMP) FROM files WHERE id = ?`
+	_, err := tx.Exec(archiveQuery, fileID)
+	return err
+}
+
+// pruneVersions drops the versions of a file beyond the configured limits and
+// returns the blobs they referenced, which the caller must release once the
+// surrounding transaction is committed.
+func pruneVersions(tx *sql.Tx, fileID int64) ([]string, error) {
+	maxCount, maxAge := versionLimits()
+
+	rows, err := tx.Query(`SELECT id, hashed_name, created_at FROM file_versions WHERE file_id = ? ORDER BY created_at DESC, id DESC`, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []int64
+	var blobs []string
+	kept := 0
+	for rows.Next() {
+		var id int64
+		var hashedName string
+		var createdAt sql.NullTime
+		if err := rows.Scan(&id, &hashedName, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		tooOld := maxAge > 0 && createdAt.Valid && time.Since(createdAt.Time) > maxAge
+		if kept >= maxCount || tooOld {
+			expired = append(expired, id)
+			blobs = append(blobs, hashedName)
+			continue
+		}
+		kept++
+	}
+	rows.Close()
+
+	for _, id := range expired {
+		if _, err := tx.Exec(`DELETE FROM file_versions WHERE id = ?`, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return blobs, nil
+}
+
+func releaseBlobs(blobs []string) {
+	for _, hashedName := range blobs {
+		if err := ReleaseBlob(hashedName); err != nil {
+			l.LogMessage(l.WARNING, "Failed to release blob "+hashedName+": "+err.Error())
+		}
+	}
+}
+
+// replaceFileContent makes new content the current version of an existing
+// file, keeping the old content in its version history.
+func replaceFileContent(db *sql.DB, fileID int64, hashedName, contentType string, size int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := archiveVersion(tx, fileID); err != nil {
+		return err
+	}
+
+	updateQuery := `UPDATE files SET hashed_name = ?, content_type = ?, size = ?, created_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := tx.Exec(updateQuery, hashedName, contentType, size, fileID); err != nil {
+		return err
+	}
+
+	blobs, err := pruneVersions(tx, fileID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	releaseBlobs(blobs)
+	return nil
+}
+
+// ListVersions returns the current and previous versions of a file, newest first.
+func ListVersions(usr, fileID string) ([]FileVersion, int, error) {
+	versions := []FileVersion{}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return versions, http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	file, status, err := ownedFile(db, usr, fileID)
+	if err != nil {
+		return versions, status, err
+	}
+
+	current := FileVersion{HashedName: file.HashedName, ContentType: file.ContentType, Size: file.Size, Current: true}
+	if !file.CreatedAt.IsZero() {
+		current.CreatedAt = file.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	versions = append(versions, current)
+
+	rows, err := db.Query(`SELECT id, hashed_name, content_type, size, created_at FROM file_versions WHERE file_id = ? ORDER BY created_at DESC, id DESC`, file.ID)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Version query failed: "+err.Error())
+		return versions, http.StatusInternalServerError, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version FileVersion
+		var createdAt sql.NullString
+		if err := rows.Scan(&version.ID, &version.HashedName, &version.ContentType, &version.Size, &createdAt); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return versions, http.StatusInternalServerError, err
+		}
+		version.CreatedAt = createdAt.String
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		l.LogMessage(l.ERROR, "Rows iteration error: "+err.Error())
+		return versions, http.StatusInternalServerError, err
+	}
+
+	return versions, http.StatusOK, nil
+}
+
+// withVersion swaps the content of a file record for one of its previous versions.
+func withVersion(db *sql.DB, file fileRecord, versionID string) (fileRecord, error) {
+	var createdAt sql.NullTime
+	query := `SELECT hashed_name, content_type, size, created_at FROM file_versions WHERE id = ? AND file_id = ?`
+	err := db.QueryRow(query, versionID, file.ID).Scan(&file.HashedName, &file.ContentType, &file.Size, &createdAt)
+	file.CreatedAt = createdAt.Time
+	return file, err
+}
+
+// RestoreVersion makes a previous version the current content of a file. The
+// content it replaces becomes a previous version in turn.
+func RestoreVersion(usr, fileID, versionID string) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer db.Close()
+
+	file, status, err := ownedFile(db, usr, fileID)
+	if err != nil {
+		return status, err
+	}
+
+	version, err := withVersion(db, file, versionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return http.StatusNotFound, fmt.Errorf("version not found")
+		}
+		l.LogMessage(l.ERROR, "Version lookup failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Transaction start failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	defer tx.Rollback()
+
+	// The version's blob reference moves to the file and the file's to the new
+	// version row, so reference counts stay as they are.
+	if err := archiveVersion(tx, file.ID); err != nil {
+		l.LogMessage(l.ERROR, "Version archive failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	updateQuery := `UPDATE files SET hashed_name = ?, content_type = ?, size = ?, created_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := tx.Exec(updateQuery, version.HashedName, version.ContentType, version.Size, file.ID); err != nil {
+		l.LogMessage(l.ERROR, "Version restore failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+	if _, err := tx.Exec(`DELETE FROM file_versions WHERE id = ?`, versionID); err != nil {
+		l.LogMessage(l.ERROR, "Version restore failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, "Transaction commit failed: "+err.Error())
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
@@ -48,7 +48,14 @@ func (d *Database) createUserTable() {
 	createTableSQL := `CREATE TABLE IF NOT EXISTS users (
 		UID TEXT PRIMARY KEY,
 		username TEXT UNIQUE NOT NULL,
-		pwd TEXT NOT NULL
+		pwd TEXT NOT NULL,
+		quota INTEGER NOT NULL DEFAULT 0,
+		must_change_pwd BOOLEAN NOT NULL DEFAULT 0,
+		totp_secret TEXT NULL,
+		totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+		totp_last_step INTEGER NOT NULL DEFAULT 0,
+		mfa_failed_attempts INTEGER NOT NULL DEFAULT 0,
+		mfa_locked_until DATETIME NULL
 	);`
 
 	_, err := d.DB.Exec(createTableSQL)
@@ -67,6 +74,8 @@ func (d *Database) createfoldersTable() {
 		user_UID TEXT NOT NULL,
 		name TEXT NOT NULL,
 		parent_id TEXT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		trash_id INTEGER NULL,
 		FOREIGN KEY (user_UID) REFERENCES users(UID),
 		FOREIGN KEY (parent_id) REFERENCES folders(UID)
 	);`
@@ -87,6 +96,10 @@ func (d *Database) createfilesTable() {
 		folder_id TEXT NOT NULL,
 		name TEXT NOT NULL,
 		hashed_name TEXT NOT NULL,
+		content_type TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		trash_id INTEGER NULL,
 		FOREIGN KEY (folder_id) REFERENCES folders(UID)
 	);`
 
@@ -99,75 +112,577 @@ func (d *Database) createfilesTable() {
 	l.LogMessage(l.SUCS, "Files Table created")
 }
 
+func (d *Database) createUploadSessionsTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS upload_sessions (
+		UID TEXT PRIMARY KEY,
+		user_UID TEXT NOT NULL,
+		folder_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		offset INTEGER NOT NULL DEFAULT 0,
+		expected_sha256 TEXT NULL,
+		expected_md5 TEXT NULL,
+		expected_crc32c TEXT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_UID) REFERENCES users(UID),
+		FOREIGN KEY (folder_id) REFERENCES folders(UID)
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Upload Sessions Table created")
+
+	// Digests the client expects the completed upload to have
+	d.addColumn("upload_sessions", "expected_sha256", "TEXT NULL")
+	d.addColumn("upload_sessions", "expected_md5", "TEXT NULL")
+	d.addColumn("upload_sessions", "expected_crc32c", "TEXT NULL")
+}
+
+func (d *Database) createBlobsTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS blobs (
+		digest TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		md5 TEXT NULL,
+		crc32c TEXT NULL,
+		key_id TEXT NULL,
+		wrapped_key TEXT NULL,
+		verified_at DATETIME NULL,
+		scrub_error TEXT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Blobs Table created")
+
+	// Encrypted blobs keep their data key, wrapped by the master key key_id
+	d.addColumn("blobs", "key_id", "TEXT NULL")
+	d.addColumn("blobs", "wrapped_key", "TEXT NULL")
+
+	// Checksums besides the SHA-256 digest, and the outcome of the last scrub
+	d.addColumn("blobs", "md5", "TEXT NULL")
+	d.addColumn("blobs", "crc32c", "TEXT NULL")
+	d.addColumn("blobs", "verified_at", "DATETIME NULL")
+	d.addColumn("blobs", "scrub_error", "TEXT NULL")
+}
+
+// Previous versions of a file. The current version stays in the files table.
+func (d *Database) createFileVersionsTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id INTEGER NOT NULL,
+		hashed_name TEXT NOT NULL,
+		content_type TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (file_id) REFERENCES files(id)
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "File Versions Table created")
+}
+
+// Deleted files and folders keep their rows and point at an entry here
+// until the trash is emptied. A folder and all of its descendants share
+// the same trash entry.
+func (d *Database) createTrashTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS trash (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_UID TEXT NOT NULL,
+		item_type TEXT NOT NULL,
+		item_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		original_parent TEXT NOT NULL,
+		original_path TEXT NOT NULL,
+		deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_UID) REFERENCES users(UID)
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Trash Table created")
+}
+
+// Public links to a file or folder. The token is the secret part of the URL.
+func (d *Database) createSharesTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS shares (
+		token TEXT PRIMARY KEY,
+		user_UID TEXT NOT NULL,
+		item_type TEXT NOT NULL,
+		item_id TEXT NOT NULL,
+		password_hash TEXT NULL,
+		expires_at DATETIME NULL,
+		max_downloads INTEGER NOT NULL DEFAULT 0,
+		downloads INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_UID) REFERENCES users(UID)
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Shares Table created")
+}
+
+// createGroupsTables stores user groups and their members. A member's role is
+// the access they get to the folders the group owns.
+func (d *Database) createGroupsTables() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS groups (
+		UID TEXT PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		quota INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS group_members (
+		group_UID TEXT NOT NULL,
+		user_UID TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'editor',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (group_UID, user_UID),
+		FOREIGN KEY (group_UID) REFERENCES groups(UID),
+		FOREIGN KEY (user_UID) REFERENCES users(UID)
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Groups Tables created")
+}
+
+// createFolderACLTable stores the access other users and groups have been
+// granted to a folder. A grant applies to the folder and everything below it.
+func (d *Database) createFolderACLTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS folder_acl (
+		folder_UID TEXT NOT NULL,
+		grantee_type TEXT NOT NULL,
+		grantee_UID TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		granted_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (folder_UID, grantee_type, grantee_UID),
+		FOREIGN KEY (folder_UID) REFERENCES folders(UID)
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Folder ACL Table created")
+}
+
+// Background jobs run by the scheduler in the jobs package. Payload is JSON
+// and run_at is when a queued job becomes due, including retries.
+func (d *Database) createJobsTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'queued',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 3,
+		last_error TEXT NULL,
+		run_at DATETIME NOT NULL,
+		started_at DATETIME NULL,
+		finished_at DATETIME NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Jobs Table created")
+}
+
+// User defined tags and key/value metadata on files and folders. item_id is
+// the file id or folder UID, as in the trash table.
+func (d *Database) createTagsTables() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS tags (
+		user_UID TEXT NOT NULL,
+		item_type TEXT NOT NULL,
+		item_id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (item_type, item_id, tag),
+		FOREIGN KEY (user_UID) REFERENCES users(UID)
+	);
+	CREATE TABLE IF NOT EXISTS metadata (
+		user_UID TEXT NOT NULL,
+		item_type TEXT NOT NULL,
+		item_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (item_type, item_id, key),
+		FOREIGN KEY (user_UID) REFERENCES users(UID)
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Tags and Metadata Tables created")
+}
+
+// createIndexes adds the indexes used by folder listings, search and blob
+// lookups. Substring name searches cannot use an index, but the folder and
+// owner indexes narrow them down to one user's rows first.
+func (d *Database) createIndexes() {
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_folders_user ON folders(user_UID)`,
+		`CREATE INDEX IF NOT EXISTS idx_folders_parent ON folders(parent_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_files_folder ON files(folder_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_files_hashed_name ON files(hashed_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_files_created_at ON files(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_file_versions_file ON file_versions(file_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_tags_user_tag ON tags(user_UID, tag)`,
+		`CREATE INDEX IF NOT EXISTS idx_metadata_user_key ON metadata(user_UID, key, value)`,
+		`CREATE INDEX IF NOT EXISTS idx_folder_acl_grantee ON folder_acl(grantee_type, grantee_UID)`,
+		`CREATE INDEX IF NOT EXISTS idx_group_members_user ON group_members(user_UID)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_status_run_at ON jobs(status, run_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_kind ON jobs(kind, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(kind, username)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_roles_role ON user_roles(role)`,
+		`CREATE INDEX IF NOT EXISTS idx_access_tokens_user ON access_tokens(user_UID)`,
+	}
+
+	for _, index := range indexes {
+		if _, err := d.DB.Exec(index); err != nil {
+			l.LogMessage(l.ERROR, err.Error())
+			return
+		}
+	}
+	l.LogMessage(l.SUCS, "Indexes created")
+}
+
+// addColumn adds a column to a table created by an older version of GoStore.
+// SQLite does not allow CURRENT_TIMESTAMP defaults in ALTER TABLE, so the
+// definition passed here must only use constant defaults.
+func (d *Database) addColumn(table, column, definition string) {
+	rows, err := d.DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+
+	exists := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			l.LogMessage(l.ERROR, err.Error())
+			rows.Close()
+			return
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+
+	if exists {
+		return
+	}
+
+	_, err = d.DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, fmt.Sprintf("Column %s.%s added", table, column))
+}
+
+func (d *Database) migrateTables() {
+	d.addColumn("users", "quota", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("users", "must_change_pwd", "BOOLEAN NOT NULL DEFAULT 0")
+	d.addColumn("users", "totp_secret", "TEXT NULL")
+	d.addColumn("users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT 0")
+	d.addColumn("users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("users", "mfa_failed_attempts", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("users", "mfa_locked_until", "DATETIME NULL")
+	d.addColumn("folders", "created_at", "DATETIME")
+	d.addColumn("files", "size", "INTEGER NOT NULL DEFAULT 0")
+	d.addColumn("files", "created_at", "DATETIME")
+	d.addColumn("files", "content_type", "TEXT NOT NULL DEFAULT ''")
+	d.addColumn("folders", "trash_id", "INTEGER NULL")
+	d.addColumn("files", "trash_id", "INTEGER NULL")
+}
+
 //  -------------ADMIN start----------------
 
-func (d *Database) createAdminDetails() {
-	createTableSQL := `CREATE TABLE IF NOT EXISTS ADMIN (
-		user TEXT NOT NULL PRIMARY KEY,
-		pwd TEXT NOT NULL,
-		default_cred BOOLEAN NOT NULL
+// Roles of users. Admins are users with one of the administrative roles; the
+// permissions of each role are defined in the auth package.
+func (d *Database) createUserRolesTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS user_roles (
+		user_UID TEXT NOT NULL,
+		role TEXT NOT NULL,
+		granted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_UID, role),
+		FOREIGN KEY (user_UID) REFERENCES users(UID) ON DELETE CASCADE
 	);`
 
 	_, err := d.DB.Exec(createTableSQL)
+
 	if err != nil {
-		l.LogMessage(l.ERROR, "Failed to create admin table: "+err.Error())
+		l.LogMessage(l.ERROR, err.Error())
 		return
 	}
-	l.LogMessage(l.SUCS, "Admin Table created")
+	l.LogMessage(l.SUCS, "User Roles Table created")
+}
+
+// One-time recovery codes for users with two-factor authentication. Only
+// hashes of the codes are stored.
+func (d *Database) createRecoveryCodesTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_UID TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME NULL,
+		PRIMARY KEY (user_UID, code_hash),
+		FOREIGN KEY (user_UID) REFERENCES users(UID) ON DELETE CASCADE
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
 
-	// Hash the password
-	hashedPwd, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
 	if err != nil {
-		l.LogMessage(l.ERROR, "Password hashing failed: "+err.Error())
+		l.LogMessage(l.ERROR, err.Error())
 		return
 	}
+	l.LogMessage(l.SUCS, "Recovery Codes Table created")
+}
 
-	l.LogMessage(l.INFO, "ENV:FIRST_START = "+os.Getenv("FIRST_START"))
+// Server wide settings changed from the admin console, e.g. the two-factor
+// authentication policy.
+func (d *Database) createSettingsTable() {
 
-	if os.Getenv("FIRST_START") == "true" {
-		insertSQL := `INSERT OR REPLACE INTO ADMIN (user, pwd, default_cred) 
-			VALUES (?, ?, ?);`
+	createTableSQL := `CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`
 
-		l.LogMessage(l.INFO, "ENV:DEFAULT_CRED = "+os.Getenv("DEFAULT_CRED"))
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Settings Table created")
+}
+
+// migrateAdmins moves the accounts of the old ADMIN table into users with the
+// owner role, and gives users from before roles existed the user role. An
+// admin whose name is taken by a user is renamed to <name>-admin.
+func (d *Database) migrateAdmins() {
+	_, err := d.DB.Exec(`INSERT OR IGNORE INTO user_roles (user_UID, role)
+		SELECT UID, 'user' FROM users WHERE UID NOT IN (SELECT user_UID FROM user_roles)`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to assign default roles: "+err.Error())
+		return
+	}
 
-		defaultCred := 0 // Default to false
-		if os.Getenv("DEFAULT_CRED") == "true" {
-			defaultCred = 1
+	var exists bool
+	err = d.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'ADMIN')`).Scan(&exists)
+	if err != nil || !exists {
+		return
+	}
+
+	rows, err := d.DB.Query(`SELECT user, pwd, default_cred FROM ADMIN`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Failed to read admin table: "+err.Error())
+		return
+	}
+	type legacyAdmin struct {
+		user, pwd   string
+		defaultCred bool
+	}
+	var admins []legacyAdmin
+	for rows.Next() {
+		var a legacyAdmin
+		if err := rows.Scan(&a.user, &a.pwd, &a.defaultCred); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			rows.Close()
+			return
 		}
+		admins = append(admins, a)
+	}
+	rows.Close()
 
-		// Generate a dummy access token (in a real-world scenario, generate a secure token)
+	tx, err := d.DB.Begin()
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	defer tx.Rollback()
 
-		_, err = d.DB.Exec(insertSQL, "admin", string(hashedPwd), defaultCred)
+	for _, a := range admins {
+		name := a.user
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, name).Scan(&taken); err != nil {
+			l.LogMessage(l.ERROR, err.Error())
+			return
+		}
+		if taken {
+			name += "-admin"
+			l.LogMessage(l.WARNING, "Admin "+a.user+" shares its name with a user, migrated as "+name)
+		}
+
+		uid := uuid.New().String()
+		_, err := tx.Exec(`INSERT INTO users (UID, username, pwd, must_change_pwd) VALUES (?, ?, ?, ?)`, uid, name, a.pwd, a.defaultCred)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO user_roles (user_UID, role) VALUES (?, 'owner')`, uid)
+		}
 		if err != nil {
-			l.LogMessage(l.ERROR, "Failed to insert admin details: "+err.Error())
+			l.LogMessage(l.ERROR, "Failed to migrate admin "+a.user+": "+err.Error())
+			return
+		}
+	}
+
+	if _, err := tx.Exec(`DROP TABLE ADMIN`); err != nil {
+		l.LogMessage(l.ERROR, "Failed to drop admin table: "+err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, fmt.Sprintf("Migrated %d admins to owner accounts", len(admins)))
+}
+
+// createAdminDetails adds the first owner, admin/admin, on first start. With
+// DEFAULT_CRED=true the password has to be changed before logging in.
+func (d *Database) createAdminDetails() {
+	l.LogMessage(l.INFO, "ENV:FIRST_START = "+os.Getenv("FIRST_START"))
+	if os.Getenv("FIRST_START") != "true" {
+		return
+	}
+
+	var hasOwner bool
+	err := d.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_roles WHERE role = 'owner')`).Scan(&hasOwner)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return
+	}
+
+	if !hasOwner {
+		// Hash the password
+		hashedPwd, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Password hashing failed: "+err.Error())
 			return
 		}
 
-		updateEnv("FIRST_START", "false")
+		l.LogMessage(l.INFO, "ENV:DEFAULT_CRED = "+os.Getenv("DEFAULT_CRED"))
+		defaultCred := os.Getenv("DEFAULT_CRED") == "true"
+
+		uid := uuid.New().String()
+		_, err = d.DB.Exec(`INSERT INTO users (UID, username, pwd, must_change_pwd) VALUES (?, ?, ?, ?)`, uid, "admin", string(hashedPwd), defaultCred)
+		if err == nil {
+			_, err = d.DB.Exec(`INSERT INTO user_roles (user_UID, role) VALUES (?, 'owner')`, uid)
+		}
+		if err != nil {
+			l.LogMessage(l.ERROR, "Failed to insert admin details: "+err.Error())
+			return
+		}
 	}
 
+	updateEnv("FIRST_START", "false")
+
 	l.LogMessage(l.SUCS, "Admin details added")
 }
 
 //  -------------ADMIN end----------------
 
-// func (d *Database) createSessionTable() {
+// Login sessions of users and admins. kind is "user" or "admin". Only hashes
+// of refresh tokens are stored; previous_hash is the token replaced by the last
+// refresh, so that its reuse can be detected.
+func (d *Database) createSessionsTable() {
+
+	createTableSQL := `CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		username TEXT NOT NULL,
+		refresh_hash TEXT NOT NULL,
+		previous_hash TEXT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		revoked_at DATETIME NULL
+	);`
+
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Sessions Table created")
+}
 
-// 	createTableSQL := `CREATE TABLE IF NOT EXISTS SESSIONS (
-//     user TEXT NOT NULL,
-//     token TEXT NOT NULL,
-//     expires_at DATETIME NOT NULL,
-//     FOREIGN KEY (user) REFERENCES ADMIN(user) ON DELETE CASCADE
-// );`
+// Personal access tokens users create for scripts and CI. Only a hash of the
+// token is stored. scopes is a comma separated list; folder_UID limits the
+// token to a folder and everything in it.
+func (d *Database) createAccessTokensTable() {
 
-// 	_, err := d.DB.Exec(createTableSQL)
+	createTableSQL := `CREATE TABLE IF NOT EXISTS access_tokens (
+		id TEXT PRIMARY KEY,
+		user_UID TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		folder_UID TEXT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NULL,
+		last_used_at DATETIME NULL,
+		FOREIGN KEY (user_UID) REFERENCES users(UID)
+	);`
 
-// 	if err != nil {
-// 		l.LogMessage(l.ERROR, err.Error())
-// 		return
-// 	}
-// 	l.LogMessage(l.SUCS, "SESSIONS Table created")
-// }
+	_, err := d.DB.Exec(createTableSQL)
+
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	l.LogMessage(l.SUCS, "Access Tokens Table created")
+}
 
 func (db *Database) EnsureRootFolder(userUID string) error {
 	var count int
@@ -204,6 +719,23 @@ func InitDB() {
 	database.createUserTable()
 	database.createfoldersTable()
 	database.createfilesTable()
+	database.migrateTables()
+	database.createUploadSessionsTable()
+	database.createBlobsTable()
+	database.createTrashTable()
+	database.createFileVersionsTable()
+	database.createSharesTable()
+	database.createTagsTables()
+	database.createGroupsTables()
+	database.createFolderACLTable()
+	database.createJobsTable()
+	database.createSessionsTable()
+	database.createUserRolesTable()
+	database.createRecoveryCodesTable()
+	database.createSettingsTable()
+	database.createAccessTokensTable()
+	database.createIndexes()
+	database.migrateAdmins()
 	database.createAdminDetails()
 
 	database.DB.Close()
@@ -0,0 +1,123 @@
+package database
+
+import (
+	l "GoStore/log"
+	"GoStore/storage"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+type legacyFile struct {
+	id         int64
+	hashedName string
+	size       int64
+}
+
+// MigrateBlobs moves files uploaded before content addressing, which are
+// stored under a random UUID, to blobs named after their SHA-256 digest. It
+// must run after the storage backend is initialized and is a no-op once every
+// file has been migrated.
+func MigrateBlobs() {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, hashed_name, size FROM files
+		WHERE hashed_name NOT IN (SELECT digest FROM blobs)`)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Blob migration query failed: "+err.Error())
+		return
+	}
+
+	var files []legacyFile
+	for rows.Next() {
+		var f legacyFile
+		if err := rows.Scan(&f.id, &f.hashedName, &f.size); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			rows.Close()
+			return
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+
+	if len(files) == 0 {
+		return
+	}
+	l.LogMessage(l.INFO, fmt.Sprintf("Migrating %d files to content addressed storage", len(files)))
+
+	migrated := 0
+	for _, f := range files {
+		if err := migrateBlob(db, f); err != nil {
+			l.LogMessage(l.WARNING, "Blob migration failed for "+f.hashedName+": "+err.Error())
+			continue
+		}
+		migrated++
+	}
+
+	l.LogMessage(l.SUCS, fmt.Sprintf("Migrated %d of %d files", migrated, len(files)))
+}
+
+func migrateBlob(db *sql.DB, f legacyFile) error {
+	r, err := storage.Store.Get(f.hashedName)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM blobs WHERE digest = ?)`, digest).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		r, err = storage.Store.Get(f.hashedName)
+		if err != nil {
+			return err
+		}
+		err = storage.Store.Put(digest, r, size)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upsertQuery := `INSERT INTO blobs (digest, size, ref_count, created_at) VALUES (?, ?, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT(digest) DO UPDATE SET ref_count = ref_count + 1`
+	if _, err := tx.Exec(upsertQuery, digest, size); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE files SET hashed_name = ?, size = ? WHERE id = ?`, digest, size, f.id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if digest != f.hashedName {
+		if err := storage.Store.Delete(f.hashedName); err != nil {
+			l.LogMessage(l.WARNING, "Failed to remove migrated blob "+f.hashedName+": "+err.Error())
+		}
+	}
+
+	return nil
+}
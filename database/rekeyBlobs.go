@@ -0,0 +1,72 @@
+package database
+
+import (
+	l "GoStore/log"
+	"GoStore/storage"
+	"database/sql"
+	"fmt"
+)
+
+type wrappedBlobKey struct {
+	digest     string
+	keyID      string
+	wrappedKey string
+}
+
+// RekeyBlobs re-wraps the data key of every encrypted blob with the current
+// master key. Blob contents are left untouched. The previous master keys must
+// be listed in ENCRYPTION_OLD_KEYS; once this succeeds they can be removed.
+func RekeyBlobs() error {
+	if !storage.EncryptionEnabled() {
+		err := fmt.Errorf("no ENCRYPTION_KEY configured")
+		l.LogMessage(l.ERROR, "Rekey failed: "+err.Error())
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, err.Error())
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT digest, key_id, wrapped_key FROM blobs
+		WHERE wrapped_key IS NOT NULL AND key_id != ?`, storage.CurrentKeyID())
+	if err != nil {
+		l.LogMessage(l.ERROR, "Rekey query failed: "+err.Error())
+		return err
+	}
+
+	var keys []wrappedBlobKey
+	for rows.Next() {
+		var k wrappedBlobKey
+		if err := rows.Scan(&k.digest, &k.keyID, &k.wrappedKey); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	failed := 0
+	for _, k := range keys {
+		keyID, wrappedKey, err := storage.RewrapKey(k.keyID, k.wrappedKey, k.digest)
+		if err != nil {
+			l.LogMessage(l.WARNING, "Rekey failed for "+k.digest+": "+err.Error())
+			failed++
+			continue
+		}
+		_, err = db.Exec(`UPDATE blobs SET key_id = ?, wrapped_key = ? WHERE digest = ? AND key_id = ?`, keyID, wrappedKey, k.digest, k.keyID)
+		if err != nil {
+			l.LogMessage(l.WARNING, "Rekey update failed for "+k.digest+": "+err.Error())
+			failed++
+		}
+	}
+
+	l.LogMessage(l.SUCS, fmt.Sprintf("Rekeyed %d of %d blobs to key %s", len(keys)-failed, len(keys), storage.CurrentKeyID()))
+	if failed > 0 {
+		return fmt.Errorf("%d blobs could not be rekeyed", failed)
+	}
+	return nil
+}
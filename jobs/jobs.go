@@ -0,0 +1,551 @@
+package jobs
+
+import (
+	l "GoStore/log"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Job statuses. Failed attempts go back to queued until max_attempts is reached.
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Workers used when JOB_WORKERS is not set.
+const defaultWorkers = 4
+
+// Days finished jobs are kept when JOB_HISTORY_DAYS is not set.
+const defaultHistoryDays = 7
+
+// How often the scheduler looks for due jobs when nothing wakes it earlier.
+const pollInterval = 5 * time.Second
+
+// Handler runs one job with the payload it was queued with. Returning an error
+// fails the attempt.
+type Handler func(payload []byte) error
+
+// Kind describes a kind of job the scheduler can run.
+type Kind struct {
+	Name        string
+	Handler     Handler
+	Concurrency int           // jobs of this kind running at once, 1 if unset
+	MaxAttempts int           // attempts before a job is marked failed, 3 if unset
+	Every       time.Duration // queue a run this often, 0 to only run on demand
+}
+
+type Job struct {
+	ID          int64  `json:"id"`
+	Kind        string `json:"kind"`
+	Payload     string `json:"payload,omitempty"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"max_attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	RunAt       string `json:"run_at"`
+	StartedAt   string `json:"started_at,omitempty"`
+	FinishedAt  string `json:"finished_at,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// KindStatus summarises a registered kind for admins.
+type KindStatus struct {
+	Name        string `json:"name"`
+	Every       string `json:"every,omitempty"`
+	Concurrency int    `json:"concurrency"`
+	Running     int    `json:"running"`
+	Queued      int    `json:"queued"`
+	Failed      int    `json:"failed"`
+	LastRun     string `json:"last_run,omitempty"`
+}
+
+var (
+	mu      sync.Mutex
+	kinds   = map[string]Kind{}
+	running = map[string]int{}
+	active  int
+	started bool
+
+	// wake makes the scheduler look for work before the next poll
+	wake = make(chan struct{}, 1)
+)
+
+func init() {
+	Register(Kind{Name: "prune_jobs", Handler: func([]byte) error { return pruneJobs() }, Every: 24 * time.Hour})
+}
+
+// Register adds a kind of job. Kinds must be registered before Start.
+func Register(k Kind) {
+	if k.Concurrency < 1 {
+		k.Concurrency = 1
+	}
+	if k.MaxAttempts < 1 {
+		k.MaxAttempts = 3
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	kinds[k.Name] = k
+}
+
+// workers reads how many jobs may run at once across all kinds.
+func workers() int {
+	if v, err := strconv.Atoi(os.Getenv("JOB_WORKERS")); err == nil && v > 0 {
+		return v
+	}
+	return defaultWorkers
+}
+
+func notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue queues a job to run as soon as a worker is free. The payload is
+// stored as JSON; nil queues a job without one. Jobs queued before Start run
+// once the scheduler starts.
+func Enqueue(kind string, payload interface{}) (int64, error) {
+	mu.Lock()
+	k, ok := kinds[kind]
+	mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return 0, err
+		}
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 0, err
+	}
+	defer db.Close()
+
+	id, err := insertJob(db, k, string(data))
+	if err != nil {
+		l.LogMessage(l.ERROR, "Job insertion failed: "+err.Error())
+		return 0, err
+	}
+
+	notify()
+	return id, nil
+}
+
+// EnqueueOnce queues a job without a payload unless a job of the same kind is
+// already queued or running. It returns the ID of the new job, or of the
+// pending one along with true.
+func EnqueueOnce(kind string) (int64, bool, error) {
+	mu.Lock()
+	k, ok := kinds[kind]
+	mu.Unlock()
+	if !ok {
+		return 0, false, fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 0, false, err
+	}
+	defer db.Close()
+
+	// One statement, so two callers cannot both queue a job
+	insertQuery := `INSERT INTO jobs (kind, payload, status, attempts, max_attempts, run_at, created_at)
+		SELECT ?, '', ?, 0, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP
+		WHERE NOT EXISTS (SELECT 1 FROM jobs WHERE kind = ? AND status IN (?, ?))`
+	res, err := db.Exec(insertQuery, k.Name, StatusQueued, k.MaxAttempts, k.Name, StatusQueued, StatusRunning)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Job insertion failed: "+err.Error())
+		return 0, false, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		id, err := res.LastInsertId()
+		notify()
+		return id, false, err
+	}
+
+	var id int64
+	err = db.QueryRow(`SELECT id FROM jobs WHERE kind = ? AND status IN (?, ?) ORDER BY id LIMIT 1`,
+		k.Name, StatusQueued, StatusRunning).Scan(&id)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Job lookup failed: "+err.Error())
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+func insertJob(db *sql.DB, k Kind, payload string) (int64, error) {
+	insertQuery := `INSERT INTO jobs (kind, payload, status, attempts, max_attempts, run_at, created_at)
+		VALUES (?, ?, ?, 0, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`
+	res, err := db.Exec(insertQuery, k.Name, payload, StatusQueued, k.MaxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Start runs the scheduler in the background. Jobs left running by a previous
+// process are queued again.
+func Start() {
+	mu.Lock()
+	if started {
+		mu.Unlock()
+		return
+	}
+	started = true
+	mu.Unlock()
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return
+	}
+	res, err := db.Exec(`UPDATE jobs SET status = ?, run_at = CURRENT_TIMESTAMP WHERE status = ?`, StatusQueued, StatusRunning)
+	db.Close()
+	if err != nil {
+		l.LogMessage(l.ERROR, "Job recovery failed: "+err.Error())
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		l.LogMessage(l.WARNING, fmt.Sprintf("Requeued %d interrupted jobs", n))
+	}
+
+	go loop()
+	l.LogMessage(l.SUCS, fmt.Sprintf("Job scheduler started with %d workers", workers()))
+}
+
+func loop() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		db, err := sql.Open("sqlite3", "main.db")
+		if err != nil {
+			l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		} else {
+			schedulePeriodic(db)
+			dispatch(db)
+			db.Close()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// schedulePeriodic queues a run of every periodic kind that has no run queued
+// or started within its interval.
+func schedulePeriodic(db *sql.DB) {
+	mu.Lock()
+	var periodic []Kind
+	for _, k := range kinds {
+		if k.Every > 0 {
+			periodic = append(periodic, k)
+		}
+	}
+	mu.Unlock()
+
+	for _, k := range periodic {
+		var pending int
+		query := `SELECT COUNT(*) FROM jobs WHERE kind = ?
+			AND (status IN (?, ?) OR created_at > datetime('now', ?))`
+		err := db.QueryRow(query, k.Name, StatusQueued, StatusRunning, fmt.Sprintf("-%d seconds", int64(k.Every.Seconds()))).Scan(&pending)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Job schedule query failed: "+err.Error())
+			continue
+		}
+		if pending > 0 {
+			continue
+		}
+		if _, err := insertJob(db, k, ""); err != nil {
+			l.LogMessage(l.ERROR, "Job insertion failed: "+err.Error())
+		}
+	}
+}
+
+// dispatch starts due jobs while workers and the limits of their kind allow.
+func dispatch(db *sql.DB) {
+	limit := workers()
+
+	rows, err := db.Query(`SELECT id, kind, payload FROM jobs
+		WHERE status = ? AND run_at <= CURRENT_TIMESTAMP ORDER BY run_at, id LIMIT 100`, StatusQueued)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Job query failed: "+err.Error())
+		return
+	}
+	type dueJob struct {
+		id      int64
+		kind    string
+		payload string
+	}
+	var due []dueJob
+	for rows.Next() {
+		var j dueJob
+		if err := rows.Scan(&j.id, &j.kind, &j.payload); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			rows.Close()
+			return
+		}
+		due = append(due, j)
+	}
+	rows.Close()
+
+	for _, j := range due {
+		mu.Lock()
+		k, known := kinds[j.kind]
+		free := active < limit && (!known || running[j.kind] < k.Concurrency)
+		mu.Unlock()
+		if !free {
+			continue
+		}
+
+		res, err := db.Exec(`UPDATE jobs SET status = ?, attempts = attempts + 1, started_at = CURRENT_TIMESTAMP, finished_at = NULL
+			WHERE id = ? AND status = ?`, StatusRunning, j.id, StatusQueued)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Job claim failed: "+err.Error())
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		if !known {
+			// Queued by a build that registered kinds this one does not have
+			finish(db, j.id, fmt.Errorf("unknown job kind %q", j.kind), true)
+			continue
+		}
+
+		mu.Lock()
+		active++
+		running[j.kind]++
+		mu.Unlock()
+
+		go run(k, j.id, j.payload)
+	}
+}
+
+// run executes one attempt of a job and records the outcome.
+func run(k Kind, id int64, payload string) {
+	defer func() {
+		mu.Lock()
+		active--
+		running[k.Name]--
+		mu.Unlock()
+		notify()
+	}()
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return k.Handler([]byte(payload))
+	}()
+
+	db, dbErr := sql.Open("sqlite3", "main.db")
+	if dbErr != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+dbErr.Error())
+		return
+	}
+	defer db.Close()
+
+	finish(db, id, err, false)
+}
+
+// finish records the outcome of an attempt. Failed attempts are retried with
+// a growing delay until the job runs out of attempts, unless final is set.
+func finish(db *sql.DB, id int64, err error, final bool) {
+	if err == nil {
+		_, err := db.Exec(`UPDATE jobs SET status = ?, last_error = NULL, finished_at = CURRENT_TIMESTAMP WHERE id = ?`, StatusDone, id)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Job update failed: "+err.Error())
+		}
+		return
+	}
+
+	var kind string
+	var attempts, maxAttempts int
+	if err := db.QueryRow(`SELECT kind, attempts, max_attempts FROM jobs WHERE id = ?`, id).Scan(&kind, &attempts, &maxAttempts); err != nil {
+		l.LogMessage(l.ERROR, "Job lookup failed: "+err.Error())
+		return
+	}
+
+	if final || attempts >= maxAttempts {
+		l.LogMessage(l.ERROR, fmt.Sprintf("Job %d (%s) failed: %s", id, kind, err.Error()))
+		_, err = db.Exec(`UPDATE jobs SET status = ?, last_error = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?`, StatusFailed, err.Error(), id)
+	} else {
+		// 30s, 2m, 4m30s, ... after the first, second and third failure
+		delay := 30 * attempts * attempts
+		l.LogMessage(l.WARNING, fmt.Sprintf("Job %d (%s) attempt %d failed, retrying in %ds: %s", id, kind, attempts, delay, err.Error()))
+		_, err = db.Exec(`UPDATE jobs SET status = ?, last_error = ?, run_at = datetime('now', ?), finished_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			StatusQueued, err.Error(), fmt.Sprintf("+%d seconds", delay), id)
+	}
+	if err != nil {
+		l.LogMessage(l.ERROR, "Job update failed: "+err.Error())
+	}
+}
+
+// pruneJobs deletes jobs that finished more than JOB_HISTORY_DAYS ago.
+func pruneJobs() error {
+	days := defaultHistoryDays
+	if v, err := strconv.Atoi(os.Getenv("JOB_HISTORY_DAYS")); err == nil && v > 0 {
+		days = v
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM jobs WHERE status IN (?, ?) AND finished_at < datetime('now', ?)`,
+		StatusDone, StatusFailed, fmt.Sprintf("-%d days", days))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		l.LogMessage(l.INFO, fmt.Sprintf("Pruned %d finished jobs", n))
+	}
+	return nil
+}
+
+// List returns the most recent jobs, optionally only those with a status or kind.
+func List(status, kind string, limit int) ([]Job, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, kind, payload, status, attempts, max_attempts, last_error, run_at, started_at, finished_at, created_at
+		FROM jobs WHERE (? = '' OR status = ?) AND (? = '' OR kind = ?) ORDER BY id DESC LIMIT ?`,
+		status, status, kind, kind, limit)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Query error: "+err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var j Job
+		var lastError, startedAt, finishedAt, createdAt sql.NullString
+		if err := rows.Scan(&j.ID, &j.Kind, &j.Payload, &j.Status, &j.Attempts, &j.MaxAttempts, &lastError, &j.RunAt, &startedAt, &finishedAt, &createdAt); err != nil {
+			l.LogMessage(l.ERROR, "Row scan failed: "+err.Error())
+			return nil, err
+		}
+		j.LastError = lastError.String
+		j.StartedAt = startedAt.String
+		j.FinishedAt = finishedAt.String
+		j.CreatedAt = createdAt.String
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// Kinds returns every registered kind with its queue counts.
+func Kinds() ([]KindStatus, error) {
+	mu.Lock()
+	statuses := make([]KindStatus, 0, len(kinds))
+	for _, k := range kinds {
+		s := KindStatus{Name: k.Name, Concurrency: k.Concurrency, Running: running[k.Name]}
+		if k.Every > 0 {
+			s.Every = k.Every.String()
+		}
+		statuses = append(statuses, s)
+	}
+	mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return nil, err
+	}
+	defer db.Close()
+
+	for i := range statuses {
+		var lastRun sql.NullString
+		query := `SELECT COALESCE(SUM(status = ?), 0), COALESCE(SUM(status = ?), 0), strftime('%Y-%m-%dT%H:%M:%SZ', MAX(finished_at))
+			FROM jobs WHERE kind = ?`
+		err := db.QueryRow(query, StatusQueued, StatusFailed, statuses[i].Name).Scan(&statuses[i].Queued, &statuses[i].Failed, &lastRun)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Query error: "+err.Error())
+			return nil, err
+		}
+		statuses[i].LastRun = lastRun.String
+	}
+
+	return statuses, nil
+}
+
+// RunNow queues a run of a registered kind without a payload.
+func RunNow(kind string) (int64, int, error) {
+	mu.Lock()
+	_, ok := kinds[kind]
+	mu.Unlock()
+	if !ok {
+		return 0, 404, fmt.Errorf("unknown job kind")
+	}
+
+	id, err := Enqueue(kind, nil)
+	if err != nil {
+		return 0, 500, err
+	}
+	return id, 200, nil
+}
+
+// Retry queues a failed job again with a fresh set of attempts.
+func Retry(id int64) (int, error) {
+	db, err := sql.Open("sqlite3", "main.db")
+	if err != nil {
+		l.LogMessage(l.ERROR, "Database connection failed: "+err.Error())
+		return 500, err
+	}
+	defer db.Close()
+
+	var status string
+	err = db.QueryRow(`SELECT status FROM jobs WHERE id = ?`, id).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 404, fmt.Errorf("job not found")
+		}
+		l.LogMessage(l.ERROR, "Job lookup failed: "+err.Error())
+		return 500, err
+	}
+	if status != StatusFailed {
+		return 409, fmt.Errorf("only failed jobs can be retried")
+	}
+
+	_, err = db.Exec(`UPDATE jobs SET status = ?, attempts = 0, run_at = CURRENT_TIMESTAMP, finished_at = NULL WHERE id = ? AND status = ?`,
+		StatusQueued, id, StatusFailed)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Update query failed: "+err.Error())
+		return 500, err
+	}
+
+	notify()
+	return 200, nil
+}
@@ -1,14 +1,67 @@
 package main
 
 import (
+	"GoStore/auth"
+	"GoStore/client"
 	db "GoStore/database"
+	"GoStore/jobs"
 	l "GoStore/log"
 	server "GoStore/routes"
+	"GoStore/storage"
+	"os"
 )
 
 func main() {
 	l.LogMessage(l.INFO, "----> \033[1mStarting Server\033[0m <----")
 	db.InitDB()
+	if err := auth.InitJWTKeys(); err != nil {
+		os.Exit(1)
+	}
+	if err := storage.InitStorage(); err != nil {
+		os.Exit(1)
+	}
+	if err := storage.InitEncryption(); err != nil {
+		os.Exit(1)
+	}
+
+	// "gostore rekey" re-wraps the data keys of encrypted blobs with the
+	// current master key after ENCRYPTION_KEY is rotated, then exits.
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		if err := db.RekeyBlobs(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// "gostore rotate-jwt-key [HS256|RS256|EdDSA]" switches to a new token
+	// signing key. Tokens signed by the old key stay valid until they expire.
+	if len(os.Args) > 1 && os.Args[1] == "rotate-jwt-key" {
+		alg := ""
+		if len(os.Args) > 2 {
+			alg = os.Args[2]
+		}
+		if _, _, err := auth.RotateJWTKey(alg); err != nil {
+			l.LogMessage(l.ERROR, "JWT key rotation failed: "+err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	// "gostore scrub" verifies every stored blob against its checksums and
+	// exits non-zero if any is missing or corrupt.
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		report, err := client.ScrubBlobs()
+		if err != nil || len(report.Issues) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	db.MigrateBlobs()
+
+	// Maintenance runs in the background next to the HTTP server
+	client.RegisterJobs()
+	jobs.Start()
 	server.StartServer()
 
 }
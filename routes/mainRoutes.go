@@ -2,15 +2,22 @@ package routes
 
 import (
 	admindb "GoStore/admin"
+	"GoStore/auth"
 	"GoStore/client"
 	user "GoStore/client"
+	"GoStore/jobs"
 	l "GoStore/log"
-	"fmt"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 type Credentials struct {
@@ -21,6 +28,139 @@ type Credentials_user struct {
 	Username string `json:"username"`
 }
 
+// NewUserData is a user to add. Roles defaults to the user role; granting
+// any other role needs the roles.manage permission.
+type NewUserData struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// MFAData finishes a login with a TOTP or recovery code. Code is not needed
+// to start enrollment.
+type MFAData struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code"`
+}
+
+// CodeData is a TOTP or recovery code confirming a two-factor change.
+type CodeData struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// RoleData names a role to grant to or revoke from a user.
+type RoleData struct {
+	Username string `json:"username" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+}
+
+// RefreshData carries the refresh token exchanged for new tokens.
+type RefreshData struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// AccessTokenData creates a personal access token. Scopes are read, upload
+// and write; Folder_id and Expires_at are optional.
+type AccessTokenData struct {
+	Name       string    `json:"name" binding:"required"`
+	Scopes     []string  `json:"scopes" binding:"required"`
+	Folder_id  string    `json:"folder_id"`
+	Expires_at time.Time `json:"expires_at"`
+}
+
+// PasswordChangeData is a user's current and new password.
+type PasswordChangeData struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+type NewUploadData struct {
+	Folder_id string `json:"folder_id"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Md5       string `json:"md5"`
+	Crc32c    string `json:"crc32c"`
+}
+
+// JWTRotateData picks the algorithm of the new signing key: HS256, RS256 or
+// EdDSA. It defaults to JWT_ALGORITHM.
+type JWTRotateData struct {
+	Algorithm string `json:"algorithm"`
+}
+
+// JobData names a kind of background job to run now.
+type JobData struct {
+	Kind string `json:"kind"`
+}
+
+// QuotaData sets the storage quota of a user in bytes, 0 for unlimited.
+type QuotaData struct {
+	Username string `json:"username"`
+	Quota    int64  `json:"quota"`
+}
+
+// GroupData names a group. Quota is in bytes, 0 for unlimited.
+type GroupData struct {
+	Name  string `json:"name"`
+	Quota int64  `json:"quota"`
+}
+
+// GroupMemberData adds a user to a group. Role is viewer, editor (the
+// default) or manager and applies to the group's team folder.
+type GroupMemberData struct {
+	Group    string `json:"group"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type RestoreVersionData struct {
+	Version_id int64 `json:"version_id"`
+}
+
+// ShareData creates a share link. Expires_at and Max_downloads are optional,
+// Max_downloads 0 allows unlimited downloads.
+type ShareData struct {
+	Type          string    `json:"type"`
+	Item_id       string    `json:"item_id"`
+	Password      string    `json:"password"`
+	Expires_at    time.Time `json:"expires_at"`
+	Max_downloads int       `json:"max_downloads"`
+}
+
+// ArchiveData selects the files and folders to download as one archive.
+type ArchiveData struct {
+	Files   []string `json:"files"`
+	Folders []string `json:"folders"`
+	Format  string   `json:"format"`
+}
+
+// MetaData sets the tags and key/value metadata of a file or folder. A field
+// left out is not changed.
+type MetaData struct {
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// GrantData gives a user viewer, editor or manager access to a folder.
+type GrantData struct {
+	Grantee_type string `json:"grantee_type"`
+	Grantee      string `json:"grantee"`
+	Permission   string `json:"permission"`
+}
+
+type RenameData struct {
+	Name string `json:"name"`
+}
+
+// TargetData describes where a file (folder_id) or folder (parent) is moved
+// or copied to, optionally under a new name.
+type TargetData struct {
+	Folder_id string `json:"folder_id"`
+	Parent_id string `json:"parent"`
+	Name      string `json:"name"`
+}
+
 type NewFolderData struct {
 	Name      string `json:"name"`
 	Parent_id string `json:"parent"`
@@ -30,44 +170,188 @@ type NewFolderData struct {
 func CORSMiddleware() gin.HandlerFunc {
 	return cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // Allow all origins (change if needed)
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "usr", "token"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "usr", "token", "Authorization", "Upload-Offset", "Share-Password", "Range"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Type", "Content-Disposition", "ETag", "Last-Modified", "Location", "Upload-Offset", "Upload-Length"},
 		AllowCredentials: true,
 	})
 }
 
-// Middleware to check if the user is an admin
-func AdminMiddleware() gin.HandlerFunc {
+// Authorize checks the usr and token headers and that the user's roles grant
+// all of perms. Without perms any signed in user is let through. A personal
+// access token may be sent instead, in the token header or as a bearer token.
+// The validated session token is kept in the context as "token".
+func Authorize(perms ...auth.Permission) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		usr := c.GetHeader("usr")
 		token := c.GetHeader("token")
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			token = bearer
+		}
+
+		if client.IsAccessToken(token) {
+			authorizeAccessToken(c, usr, token, perms)
+			return
+		}
 
-		isAdmin, err := admindb.IsItAdmin(usr, token)
-		if err != nil || !isAdmin {
+		isValid, claims := auth.AuthenticateTokenJWT(token)
+		if !isValid || claims.Username != usr {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
 
+		granted, err := auth.UserPermissions(usr)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission lookup failed"})
+			c.Abort()
+			return
+		}
+		for _, perm := range perms {
+			if !granted[perm] {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden", "permission": perm})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Set("username", usr)
+		c.Set("token", token)
+		c.Set("permissions", granted)
 		c.Next()
 	}
 }
 
-func UserMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		usr := c.GetHeader("usr")
-		token := c.GetHeader("token")
+// authorizeAccessToken is Authorize for personal access tokens. The usr header
+// is optional. A token only gets the permissions of its scopes that its user
+// still has, and routes that need no permission, such as changing the
+// password, do not accept tokens at all.
+func authorizeAccessToken(c *gin.Context, usr, token string, perms []auth.Permission) {
+	pat, err := client.AuthenticateAccessToken(token)
+	if err != nil || (usr != "" && pat.Username != usr) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		c.Abort()
+		return
+	}
+	if len(perms) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access tokens cannot be used here"})
+		c.Abort()
+		return
+	}
 
-		isUser, err := client.IsItUser(usr, token)
-		if err != nil || !isUser {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	userPerms, err := auth.UserPermissions(pat.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Permission lookup failed"})
+		c.Abort()
+		return
+	}
+	granted := pat.Permissions(userPerms)
+	for _, perm := range perms {
+		if !granted[perm] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden", "permission": perm})
 			c.Abort()
 			return
 		}
+	}
 
-		c.Next()
+	if pat.FolderID != "" {
+		targets, err := requestTargets(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			c.Abort()
+			return
+		}
+		if code, err := client.CheckTokenFolder(pat, targets); err != nil {
+			c.JSON(code, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+	}
+
+	c.Set("username", pat.Username)
+	c.Set("permissions", granted)
+	c.Next()
+}
+
+// Largest JSON body read to find the targets of a request made with a token
+// limited to a folder.
+const maxTargetBody = 1 << 20
+
+// requestTargets returns the files, folders and upload sessions a request
+// names in its route, JSON body or upload form, so that tokens limited to a
+// folder can be checked against them. Folders named in the route of a change
+// must lie inside the token's folder, so the folder itself cannot be moved,
+// copied or deleted with it. Only POST requests name targets in their body.
+func requestTargets(c *gin.Context) ([]client.TokenTarget, error) {
+	var targets []client.TokenTarget
+	add := func(itemType, id string, inside bool) {
+		if id != "" {
+			targets = append(targets, client.TokenTarget{Type: itemType, ID: id, Inside: inside})
+		}
+	}
+
+	change := c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead
+	add("folder", c.Param("folderID"), change)
+	add("file", c.Param("fileID"), false)
+	add("upload", c.Param("uploadID"), false)
+	if itemType := c.Param("type"); itemType == "file" || itemType == "folder" {
+		add(itemType, c.Param("itemID"), change && itemType == "folder")
+	}
+
+	if c.Request.Method != http.MethodPost {
+		return targets, nil
 	}
+	if c.ContentType() == "multipart/form-data" {
+		if _, err := c.MultipartForm(); err != nil {
+			return nil, err
+		}
+		add("folder", c.PostForm("folder_id"), false)
+		return targets, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxTargetBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxTargetBody {
+		return nil, errors.New("request body too large")
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Decoded the way the route handlers bind JSON
+	var data struct {
+		Folder_id string   `json:"folder_id"`
+		Parent_id string   `json:"parent"`
+		Type      string   `json:"type"`
+		Item_id   string   `json:"item_id"`
+		Files     []string `json:"files"`
+		Folders   []string `json:"folders"`
+	}
+	if len(body) > 0 {
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&data); err != nil {
+			return nil, err
+		}
+	}
+	add("folder", data.Folder_id, false)
+	add("folder", data.Parent_id, false)
+	if data.Type == "file" || data.Type == "folder" {
+		add(data.Type, data.Item_id, false)
+	}
+	for _, id := range data.Files {
+		add("file", id, false)
+	}
+	for _, id := range data.Folders {
+		add("folder", id, false)
+	}
+
+	return targets, nil
+}
+
+// hasPermission reports whether the user let through by Authorize has perm.
+func hasPermission(c *gin.Context, perm auth.Permission) bool {
+	granted, _ := c.Get("permissions")
+	perms, _ := granted.(map[auth.Permission]bool)
+	return perms[perm]
 }
 
 func StartServer() {
@@ -82,6 +366,12 @@ func StartServer() {
 		})
 	})
 
+	// Public keys of asymmetric token signing keys, for services that verify
+	// GoStore tokens themselves
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, auth.JWKS())
+	})
+
 	adminRoutes := r.Group("/admin")
 	{
 		adminRoutes.POST("/", func(c *gin.Context) {
@@ -93,7 +383,11 @@ func StartServer() {
 				return
 			}
 
-			status, DEFAULT_CRED, token := admindb.AdminLoginCred(creds.Username, creds.Password)
+			status, DEFAULT_CRED, result, err := admindb.AdminLoginCred(creds.Username, creds.Password)
+			if errors.Is(err, auth.ErrSecondFactorLocked) {
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+				return
+			}
 			if DEFAULT_CRED {
 				l.LogMessage(l.INFO, "true")
 			} else {
@@ -104,9 +398,132 @@ func StartServer() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "CREDS ERROR"})
 			case status && DEFAULT_CRED:
 				c.JSON(http.StatusOK, gin.H{"action": "/newcred"})
+			case status && result.MFAToken != "":
+				c.JSON(http.StatusOK, gin.H{"action": "/2fa", "mfa_token": result.MFAToken, "enrollment_required": result.EnrollmentRequired})
 			case status && !DEFAULT_CRED:
-				c.JSON(http.StatusOK, gin.H{"action": "CRED CORRT", "token": token})
+				roles, _ := auth.UserRoles(creds.Username)
+				c.JSON(http.StatusOK, gin.H{"action": "CRED CORRT", "token": result.Token, "refresh_token": result.RefreshToken, "roles": roles})
+			}
+		})
+
+		// Second login step for admins with two-factor authentication.
+		// Admins who have to enroll first get their secret from /2fa/enroll.
+		adminRoutes.POST("/2fa", func(c *gin.Context) {
+			var data MFAData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			result, recoveryCodes, code, err := auth.CompleteLogin(auth.SessionAdmin, data.MFAToken, data.Code)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			response := gin.H{"action": "CRED CORRT", "token": result.Token, "refresh_token": result.RefreshToken}
+			if len(recoveryCodes) > 0 {
+				response["recovery_codes"] = recoveryCodes
+			}
+			c.JSON(http.StatusOK, response)
+		})
+
+		adminRoutes.POST("/2fa/enroll", func(c *gin.Context) {
+			var data MFAData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			secret, uri, code, err := auth.BeginLoginEnrollment(auth.SessionAdmin, data.MFAToken)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": uri})
+		})
+
+		// Two-factor policy: whether admins and users have to use it. GET also
+		// lists the users who have it enabled.
+		adminRoutes.GET("/2fa/policy", Authorize(auth.PermSystemRead), func(c *gin.Context) {
+			policy, err := auth.GetMFAPolicy()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve policy"})
+				return
+			}
+			enrolled, err := auth.TOTPEnrolledUsers()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve enrolled users"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"policy": policy, "enrolled": enrolled})
+		})
+
+		adminRoutes.PUT("/2fa/policy", Authorize(auth.PermSystemManage), func(c *gin.Context) {
+			var policy auth.MFAPolicy
+			if err := c.ShouldBindJSON(&policy); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			if err := auth.SetMFAPolicy(policy); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update policy"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"policy": policy})
+		})
+
+		// Resetting removes a user's two-factor authentication, e.g. after
+		// they lost their device. They can enroll again at their next login.
+		adminRoutes.POST("/2fa/reset", Authorize(auth.PermUsersManage), func(c *gin.Context) {
+			var creds Credentials_user
+			if err := c.ShouldBindJSON(&creds); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			privileged, err := admindb.IsPrivileged(creds.Username)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"action": "err"})
+				return
+			}
+			if privileged && !hasPermission(c, auth.PermRolesManage) {
+				c.JSON(http.StatusForbidden, gin.H{"action": "err", "error": "resetting an admin needs " + string(auth.PermRolesManage)})
+				return
+			}
+
+			code, err := auth.ResetTOTP(creds.Username)
+			if code == 200 {
+				c.JSON(http.StatusOK, gin.H{"action": "reset"})
+			} else if code == 404 {
+				c.JSON(http.StatusNotFound, gin.H{"action": "not found"})
+			} else {
+				l.LogMessage(l.ERROR, "mainRoutes :"+err.Error())
+				c.JSON(http.StatusInternalServerError, gin.H{"action": "err"})
+			}
+		})
+
+		adminRoutes.POST("/refresh", func(c *gin.Context) {
+			var data RefreshData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			token, refreshToken, code, err := auth.RefreshSession(auth.SessionAdmin, data.RefreshToken)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"token": token, "refresh_token": refreshToken})
+		})
+
+		adminRoutes.POST("/logout", Authorize(), func(c *gin.Context) {
+			code, err := auth.RevokeSession(c.GetString("token"))
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
 			}
+			c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
 		})
 
 		adminRoutes.POST("/newcred", func(c *gin.Context) {
@@ -133,32 +550,51 @@ func StartServer() {
 			}
 		})
 
-		adminRoutes.POST("/newuser", AdminMiddleware(), func(c *gin.Context) {
-			var creds Credentials
+		adminRoutes.POST("/newuser", Authorize(auth.PermUsersManage), func(c *gin.Context) {
+			var creds NewUserData
 			if err := c.ShouldBindJSON(&creds); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
+			for _, role := range creds.Roles {
+				if role != auth.DefaultRole && role != "read-only" && !hasPermission(c, auth.PermRolesManage) {
+					c.JSON(http.StatusForbidden, gin.H{"action": "err", "error": "granting role " + role + " needs " + string(auth.PermRolesManage)})
+					return
+				}
+			}
 
-			code, err := admindb.AddUser(creds.Username, creds.Password)
+			code, err := admindb.AddUser(creds.Username, creds.Password, creds.Roles)
 
 			if err != nil {
 				l.LogMessage(l.ERROR, "mainRoutes :"+err.Error())
 			}
 			if code == 200 {
 				c.JSON(http.StatusOK, gin.H{"action": "added"})
+			} else if code == 400 {
+				c.JSON(http.StatusBadRequest, gin.H{"action": "err", "error": err.Error()})
 			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"action": "err"})
 			}
 		})
 
-		adminRoutes.DELETE("/deluser", AdminMiddleware(), func(c *gin.Context) {
+		adminRoutes.DELETE("/deluser", Authorize(auth.PermUsersManage), func(c *gin.Context) {
 			var creds Credentials_user
 			if err := c.ShouldBindJSON(&creds); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
+			// Admins can only be removed by someone who could have made them admins
+			privileged, err := admindb.IsPrivileged(creds.Username)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"action": "err"})
+				return
+			}
+			if privileged && !hasPermission(c, auth.PermRolesManage) {
+				c.JSON(http.StatusForbidden, gin.H{"action": "err", "error": "deleting an admin needs " + string(auth.PermRolesManage)})
+				return
+			}
+
 			code, err := admindb.DelUser(creds.Username)
 
 			if err != nil {
@@ -168,96 +604,1108 @@ func StartServer() {
 				c.JSON(http.StatusOK, gin.H{"action": "deleted"})
 			} else if code == 404 {
 				c.JSON(http.StatusNotFound, gin.H{"action": "not found"})
+			} else if code == 409 {
+				c.JSON(http.StatusConflict, gin.H{"action": "err", "error": err.Error()})
 			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"action": "err"})
 			}
 		})
 
-		adminRoutes.GET("/dashboard", AdminMiddleware(), func(c *gin.Context) {
-			users, err := admindb.ListUsers()
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+		adminRoutes.POST("/quota", Authorize(auth.PermUsersManage), func(c *gin.Context) {
+			var data QuotaData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"users": users})
+
+			code, err := admindb.SetQuota(data.Username, data.Quota)
+
+			if err != nil {
+				l.LogMessage(l.ERROR, "mainRoutes :"+err.Error())
+			}
+			if code == 200 {
+				c.JSON(http.StatusOK, gin.H{"action": "updated"})
+			} else if code == 404 {
+				c.JSON(http.StatusNotFound, gin.H{"action": "not found"})
+			} else if code == 400 {
+				c.JSON(http.StatusBadRequest, gin.H{"action": "err", "error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"action": "err"})
+			}
 		})
-	}
 
-	adminClient := r.Group("/client")
-	{
-		adminClient.POST("/login", func(c *gin.Context) {
-			var creds Credentials
+		// groupAction reports the result of a group or role change in the
+		// same shape as the user routes above.
+		groupAction := func(c *gin.Context, action string, code int, err error) {
+			if err != nil {
+				l.LogMessage(l.ERROR, "mainRoutes :"+err.Error())
+			}
+			switch code {
+			case 200:
+				c.JSON(http.StatusOK, gin.H{"action": action})
+			case 400, 409:
+				c.JSON(code, gin.H{"action": "err", "error": err.Error()})
+			case 404:
+				c.JSON(http.StatusNotFound, gin.H{"action": "not found", "error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"action": "err"})
+			}
+		}
 
-			// Bind JSON to struct
-			if err := c.ShouldBindJSON(&creds); err != nil {
+		adminRoutes.POST("/group", Authorize(auth.PermGroupsManage), func(c *gin.Context) {
+			var data GroupData
+			if err := c.ShouldBindJSON(&data); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
-			token, UID, err := user.Login(creds.Username, creds.Password)
-			if err != nil {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			code, err := admindb.CreateGroup(data.Name, data.Quota)
+			groupAction(c, "added", code, err)
+		})
+
+		adminRoutes.DELETE("/group", Authorize(auth.PermGroupsManage), func(c *gin.Context) {
+			var data GroupData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
-			c.JSON(http.StatusOK, gin.H{"token": token, "UID": UID})
+			code, err := admindb.DelGroup(data.Name)
+			groupAction(c, "deleted", code, err)
 		})
-		adminClient.POST("/newfolder", UserMiddleware(), func(c *gin.Context) {
-			var folder_data NewFolderData
 
-			if err := c.ShouldBindJSON(&folder_data); err != nil {
+		adminRoutes.POST("/group/quota", Authorize(auth.PermGroupsManage), func(c *gin.Context) {
+			var data GroupData
+			if err := c.ShouldBindJSON(&data); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
-			status, err := client.NewFolder(folder_data.User_uid, folder_data.Name, folder_data.Parent_id)
-			if err != nil {
-				c.JSON(status, gin.H{"error": err.Error()})
+			code, err := admindb.SetGroupQuota(data.Name, data.Quota)
+			groupAction(c, "updated", code, err)
+		})
+
+		adminRoutes.POST("/group/member", Authorize(auth.PermGroupsManage), func(c *gin.Context) {
+			var data GroupMemberData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
-			c.JSON(http.StatusCreated, gin.H{"message": "Folder created successfully"})
+			code, err := admindb.AddGroupMember(data.Group, data.Username, data.Role)
+			groupAction(c, "added", code, err)
 		})
 
-		adminClient.POST("/newfile", UserMiddleware(), func(ctx *gin.Context) {
-			file, err := ctx.FormFile("file")
-			if err != nil {
-				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to retrieve file"})
+		adminRoutes.DELETE("/group/member", Authorize(auth.PermGroupsManage), func(c *gin.Context) {
+			var data GroupMemberData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
-			hashedName := uuid.New().String()
-			dst := fmt.Sprintf("uploads/%s", hashedName)
+			code, err := admindb.RemoveGroupMember(data.Group, data.Username)
+			groupAction(c, "removed", code, err)
+		})
 
-			if err := ctx.SaveUploadedFile(file, dst); err != nil {
-				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		adminRoutes.GET("/groups", Authorize(auth.PermUsersRead), func(c *gin.Context) {
+			groups, err := admindb.ListGroups()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve groups"})
 				return
 			}
+			c.JSON(http.StatusOK, gin.H{"groups": groups})
+		})
 
-			folderID := ctx.PostForm("folder_id")
-			userUID := ctx.PostForm("user_uid")
-			customFileName := ctx.PostForm("filename")
-			if customFileName == "" {
-				customFileName = file.Filename // Default to the original filename
+		adminRoutes.GET("/dashboard", Authorize(auth.PermUsersRead), func(c *gin.Context) {
+			users, err := admindb.ListUsers()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+				return
 			}
-			code, err := client.SaveFileMetadata(userUID, folderID, customFileName, hashedName)
+			usage, err := admindb.ListUsage()
 			if err != nil {
-				if code == http.StatusForbidden {
-					ctx.JSON(http.StatusForbidden, gin.H{"error": "Folder not found or unauthorized access"})
-				} else {
-					ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
-				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage"})
 				return
 			}
-
-			ctx.JSON(http.StatusCreated, gin.H{"message": "File uploaded successfully", "hashed_name": hashedName})
+			groups, err := admindb.ListGroups()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve groups"})
+				return
+			}
+			roles, err := admindb.ListUserRoles()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve roles"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"users": users, "usage": usage, "groups": groups, "roles": roles})
 		})
 
-		adminClient.GET("/file/view/:fileID", UserMiddleware(), func(c *gin.Context) {
-			client.ViewFile(c) // Pass the Gin context
+		// Roles: GET lists every role with its permissions and the roles of
+		// each user, POST grants a role and DELETE revokes it.
+		adminRoutes.GET("/roles", Authorize(auth.PermUsersRead), func(c *gin.Context) {
+			users, err := admindb.ListUserRoles()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve roles"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"roles": auth.ListRoles(), "users": users})
 		})
-		adminClient.DELETE("/file/delete/:fileID", UserMiddleware(), func(c *gin.Context) {
-			client.DeleteFile(c) // Pass the Gin context
+
+		adminRoutes.POST("/roles", Authorize(auth.PermRolesManage), func(c *gin.Context) {
+			var data RoleData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			code, err := admindb.GrantRole(data.Username, data.Role)
+			groupAction(c, "granted", code, err)
+		})
+
+		adminRoutes.DELETE("/roles", Authorize(auth.PermRolesManage), func(c *gin.Context) {
+			var data RoleData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			code, err := admindb.RevokeRole(data.Username, data.Role)
+			groupAction(c, "revoked", code, err)
+		})
+
+		adminRoutes.GET("/jwt/keys", Authorize(auth.PermSystemRead), func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"keys": auth.JWTKeys()})
+		})
+
+		// Rotating switches token signing to a new key. Tokens signed by the
+		// previous keys stay valid until they expire.
+		adminRoutes.POST("/jwt/rotate", Authorize(auth.PermSystemManage), func(c *gin.Context) {
+			var data JWTRotateData
+			if c.Request.ContentLength > 0 {
+				if err := c.ShouldBindJSON(&data); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+
+			kid, code, err := auth.RotateJWTKey(data.Algorithm)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"kid": kid})
+		})
+
+		// Scrubs re-verify every stored blob against its checksums as a
+		// background job; GET reports progress and the last result.
+		adminRoutes.POST("/scrub", Authorize(auth.PermSystemManage), func(c *gin.Context) {
+			jobID, err := client.StartScrub()
+			if errors.Is(err, client.ErrScrubRunning) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "job_id": jobID})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusAccepted, gin.H{"job_id": jobID})
+		})
+
+		adminRoutes.GET("/scrub", Authorize(auth.PermSystemRead), func(c *gin.Context) {
+			c.JSON(http.StatusOK, client.ScrubStatus())
+		})
+
+		// Background jobs: GET lists the registered kinds and recent jobs,
+		// optionally filtered by ?status= and ?kind=.
+		adminRoutes.GET("/jobs", Authorize(auth.PermSystemRead), func(c *gin.Context) {
+			kinds, err := jobs.Kinds()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job kinds"})
+				return
+			}
+			limit, _ := strconv.Atoi(c.Query("limit"))
+			list, err := jobs.List(c.Query("status"), c.Query("kind"), limit)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve jobs"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"kinds": kinds, "jobs": list})
+		})
+
+		adminRoutes.POST("/jobs", Authorize(auth.PermSystemManage), func(c *gin.Context) {
+			var data JobData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			jobID, code, err := jobs.RunNow(data.Kind)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusAccepted, gin.H{"job_id": jobID})
+		})
+
+		adminRoutes.POST("/jobs/:jobID/retry", Authorize(auth.PermSystemManage), func(c *gin.Context) {
+			jobID, err := strconv.ParseInt(c.Param("jobID"), 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+				return
+			}
+
+			code, err := jobs.Retry(jobID)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusAccepted, gin.H{"job_id": jobID})
+		})
+	}
+
+	adminClient := r.Group("/client")
+	{
+		adminClient.POST("/login", func(c *gin.Context) {
+			var creds Credentials
+
+			// Bind JSON to struct
+			if err := c.ShouldBindJSON(&creds); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			result, UID, err := user.Login(creds.Username, creds.Password)
+			if errors.Is(err, auth.ErrSecondFactorLocked) {
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+
+			if result.MFAToken != "" {
+				c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": result.MFAToken, "enrollment_required": result.EnrollmentRequired, "UID": UID})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"token": result.Token, "refresh_token": result.RefreshToken, "UID": UID})
+		})
+
+		// Second login step for users with two-factor authentication. Users
+		// who have to enroll first get their secret from /login/2fa/enroll.
+		adminClient.POST("/login/2fa", func(c *gin.Context) {
+			var data MFAData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			result, recoveryCodes, code, err := auth.CompleteLogin(auth.SessionUser, data.MFAToken, data.Code)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			response := gin.H{"token": result.Token, "refresh_token": result.RefreshToken}
+			if len(recoveryCodes) > 0 {
+				response["recovery_codes"] = recoveryCodes
+			}
+			c.JSON(http.StatusOK, response)
+		})
+
+		adminClient.POST("/login/2fa/enroll", func(c *gin.Context) {
+			var data MFAData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			secret, uri, code, err := auth.BeginLoginEnrollment(auth.SessionUser, data.MFAToken)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": uri})
+		})
+
+		// Two-factor authentication of the signed in user: enroll starts
+		// setting it up, confirm finishes it with a code from the app.
+		adminClient.GET("/2fa", Authorize(), func(c *gin.Context) {
+			status, err := auth.GetTOTPStatus(c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve two-factor status"})
+				return
+			}
+			c.JSON(http.StatusOK, status)
+		})
+
+		adminClient.POST("/2fa/enroll", Authorize(), func(c *gin.Context) {
+			secret, uri, code, err := auth.BeginTOTPEnrollment(c.GetString("username"))
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": uri})
+		})
+
+		adminClient.POST("/2fa/confirm", Authorize(), func(c *gin.Context) {
+			var data CodeData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			recoveryCodes, code, err := auth.ConfirmTOTPEnrollment(c.GetString("username"), data.Code)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+		})
+
+		adminClient.POST("/2fa/recovery-codes", Authorize(), func(c *gin.Context) {
+			var data CodeData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			recoveryCodes, code, err := auth.RegenerateRecoveryCodes(c.GetString("username"), data.Code)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+		})
+
+		adminClient.DELETE("/2fa", Authorize(), func(c *gin.Context) {
+			var data CodeData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			code, err := auth.DisableTOTP(c.GetString("username"), data.Code)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+		})
+
+		adminClient.POST("/refresh", func(c *gin.Context) {
+			var data RefreshData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			token, refreshToken, code, err := auth.RefreshSession(auth.SessionUser, data.RefreshToken)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"token": token, "refresh_token": refreshToken})
+		})
+
+		adminClient.POST("/logout", Authorize(), func(c *gin.Context) {
+			code, err := auth.RevokeSession(c.GetString("token"))
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+		})
+
+		adminClient.POST("/password", Authorize(), func(c *gin.Context) {
+			var data PasswordChangeData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			token, refreshToken, code, err := client.ChangePassword(c.GetString("username"), data.OldPassword, data.NewPassword)
+			if err != nil {
+				c.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"token": token, "refresh_token": refreshToken})
+		})
+		// Personal access tokens for scripts and CI. They are managed from a
+		// signed in session only; the token is shown once, when created.
+		adminClient.POST("/tokens", Authorize(), func(c *gin.Context) {
+			var data AccessTokenData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			token, status, err := client.CreateAccessToken(c.GetString("username"), data.Name, data.Scopes, data.Folder_id, data.Expires_at)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusCreated, token)
+		})
+
+		adminClient.GET("/tokens", Authorize(), func(c *gin.Context) {
+			tokens, status, err := client.ListAccessTokens(c.GetString("username"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+		})
+
+		adminClient.DELETE("/tokens/:tokenID", Authorize(), func(c *gin.Context) {
+			status, err := client.RevokeAccessToken(c.GetString("username"), c.Param("tokenID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Access token revoked"})
+		})
+
+		adminClient.POST("/newfolder", Authorize(auth.PermFilesUpload), func(c *gin.Context) {
+			var folder_data NewFolderData
+
+			if err := c.ShouldBindJSON(&folder_data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			// Folders are created as the authenticated user
+			userUID, err := client.UserUID(c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "User lookup failed"})
+				return
+			}
+			if folder_data.User_uid != "" && folder_data.User_uid != userUID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "user_uid does not match the authenticated user"})
+				return
+			}
+
+			status, err := client.NewFolder(userUID, folder_data.Name, folder_data.Parent_id)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusCreated, gin.H{"message": "Folder created successfully"})
+		})
+
+		adminClient.POST("/newfile", Authorize(auth.PermFilesUpload), func(ctx *gin.Context) {
+			file, err := ctx.FormFile("file")
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to retrieve file"})
+				return
+			}
+
+			folderID := ctx.PostForm("folder_id")
+
+			// Files are uploaded as the authenticated user
+			userUID, err := client.UserUID(ctx.GetString("username"))
+			if err != nil {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User lookup failed"})
+				return
+			}
+			if formUID := ctx.PostForm("user_uid"); formUID != "" && formUID != userUID {
+				ctx.JSON(http.StatusForbidden, gin.H{"error": "user_uid does not match the authenticated user"})
+				return
+			}
+
+			// Tags may be sent as repeated fields or a comma separated list
+			tags := client.SplitTags(ctx.PostFormArray("tags"))
+			if err := client.ValidateTags(tags); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			// The expected digest may come from headers or form fields
+			expected, err := client.ExpectedChecksums(ctx.GetHeader("Digest"), ctx.GetHeader("Content-MD5"), client.Checksums{
+				SHA256: ctx.PostForm("sha256"),
+				MD5:    ctx.PostForm("md5"),
+				CRC32C: ctx.PostForm("crc32c"),
+			})
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			// Reject uploads to inaccessible folders or over quota before anything
+			// is written to storage
+			if code, err := client.CheckQuota(userUID, folderID, file.Size); err != nil {
+				ctx.JSON(code, gin.H{"error": err.Error()})
+				return
+			}
+
+			checksums, contentType, err := client.StoreBlob(func() (io.ReadCloser, error) { return file.Open() }, file.Size, expected)
+			if errors.Is(err, client.ErrChecksumMismatch) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				l.LogMessage(l.ERROR, "mainRoutes :"+err.Error())
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+				return
+			}
+			hashedName := checksums.SHA256
+
+			customFileName := ctx.PostForm("filename")
+			if customFileName == "" {
+				customFileName = file.Filename // Default to the original filename
+			}
+			// Upload-only callers may add files but not replace existing ones
+			canReplace := hasPermission(ctx, auth.PermFilesWrite)
+			fileID, code, err := client.SaveFileMetadata(userUID, folderID, customFileName, hashedName, contentType, file.Size, canReplace)
+			if err != nil {
+				client.ReleaseBlob(hashedName)
+				if code == http.StatusForbidden {
+					ctx.JSON(http.StatusForbidden, gin.H{"error": "Folder not found or unauthorized access"})
+				} else if code == http.StatusConflict {
+					ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				} else {
+					ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+				}
+				return
+			}
+
+			if err := client.TagFile(fileID, tags); err != nil {
+				l.LogMessage(l.WARNING, "Failed to tag uploaded file: "+err.Error())
+			}
+
+			ctx.Header("Digest", checksums.DigestHeader())
+			ctx.JSON(http.StatusCreated, gin.H{"message": "File uploaded successfully", "id": fileID, "hashed_name": hashedName, "checksums": checksums})
+		})
+
+		// Resumable uploads: create a session, PATCH chunks at Upload-Offset
+		// and HEAD to find where to resume after a dropped connection.
+		adminClient.POST("/upload", Authorize(auth.PermFilesUpload), func(c *gin.Context) {
+			var upload_data NewUploadData
+			if err := c.ShouldBindJSON(&upload_data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			expected, err := client.ExpectedChecksums(c.GetHeader("Digest"), c.GetHeader("Content-MD5"), client.Checksums{
+				SHA256: upload_data.Sha256,
+				MD5:    upload_data.Md5,
+				CRC32C: upload_data.Crc32c,
+			})
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			session, status, err := client.CreateUpload(c.GetString("username"), upload_data.Folder_id, upload_data.Filename, upload_data.Size, expected)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.Header("Location", "/client/upload/"+session.UID)
+			c.Header("Upload-Offset", "0")
+			c.JSON(http.StatusCreated, session)
+		})
+
+		adminClient.HEAD("/upload/:uploadID", Authorize(auth.PermFilesUpload), func(c *gin.Context) {
+			session, status, err := client.GetUpload(c.GetString("username"), c.Param("uploadID"))
+			if err != nil {
+				c.Status(status)
+				return
+			}
+
+			c.Header("Cache-Control", "no-store")
+			c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+			c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+			c.Status(http.StatusOK)
+		})
+
+		adminClient.PATCH("/upload/:uploadID", Authorize(auth.PermFilesUpload), func(c *gin.Context) {
+			offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset header"})
+				return
+			}
+
+			session, file, status, err := client.WriteUploadChunk(c.GetString("username"), c.Param("uploadID"), offset, c.Request.Body, hasPermission(c, auth.PermFilesWrite))
+			c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			if file != nil {
+				c.Header("Digest", file.Checksums.DigestHeader())
+				c.JSON(http.StatusCreated, gin.H{"message": "File uploaded successfully", "id": file.ID, "hashed_name": file.HashedName, "checksums": file.Checksums})
+				return
+			}
+			c.Status(http.StatusNoContent)
+		})
+
+		adminClient.DELETE("/upload/:uploadID", Authorize(auth.PermFilesUpload), func(c *gin.Context) {
+			status, err := client.AbortUpload(c.GetString("username"), c.Param("uploadID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+			c.Status(http.StatusNoContent)
+		})
+
+		adminClient.GET("/usage", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			usage, status, err := client.GetUsage(c.GetString("username"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, usage)
+		})
+
+		adminClient.GET("/search", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			query := client.SearchQuery{
+				Name:        c.Query("q"),
+				Type:        c.Query("type"),
+				ContentType: c.Query("content_type"),
+				Tags:        client.SplitTags(c.QueryArray("tag")),
+				FolderID:    c.Query("folder"),
+			}
+
+			// Metadata filters are given as meta=key=value
+			for _, pair := range c.QueryArray("meta") {
+				key, value, ok := strings.Cut(pair, "=")
+				if !ok {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid meta filter, expected key=value"})
+					return
+				}
+				if query.Metadata == nil {
+					query.Metadata = map[string]string{}
+				}
+				query.Metadata[key] = value
+			}
+
+			var err error
+			for param, target := range map[string]*int64{"min_size": &query.MinSize, "max_size": &query.MaxSize} {
+				if v := c.Query(param); v != "" {
+					if *target, err = strconv.ParseInt(v, 10, 64); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+						return
+					}
+				}
+			}
+			for param, target := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+				if v := c.Query(param); v != "" {
+					if *target, err = strconv.Atoi(v); err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+						return
+					}
+				}
+			}
+			// Dates are RFC 3339 timestamps or plain YYYY-MM-DD days
+			for param, target := range map[string]*time.Time{"after": &query.After, "before": &query.Before} {
+				if v := c.Query(param); v != "" {
+					if *target, err = time.Parse(time.RFC3339, v); err != nil {
+						if *target, err = time.Parse(time.DateOnly, v); err != nil {
+							c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+							return
+						}
+					}
+				}
+			}
+
+			results, status, err := client.Search(c.GetString("username"), query)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"results": results})
+		})
+
+		adminClient.GET("/tags", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			tags, status, err := client.ListTags(c.GetString("username"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"tags": tags})
+		})
+
+		adminClient.GET("/meta/:type/:itemID", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			meta, status, err := client.GetItemMeta(c.GetString("username"), c.Param("type"), c.Param("itemID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, meta)
+		})
+
+		// PUT replaces the tags and metadata given, PATCH adds to them. In a
+		// PATCH an empty metadata value removes the key.
+		updateMeta := func(replace bool) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				var data MetaData
+				if err := c.ShouldBindJSON(&data); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+
+				meta, status, err := client.UpdateItemMeta(c.GetString("username"), c.Param("type"), c.Param("itemID"), data.Tags, data.Metadata, replace)
+				if err != nil {
+					c.JSON(status, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(http.StatusOK, meta)
+			}
+		}
+		adminClient.PUT("/meta/:type/:itemID", Authorize(auth.PermFilesWrite), updateMeta(true))
+		adminClient.PATCH("/meta/:type/:itemID", Authorize(auth.PermFilesWrite), updateMeta(false))
+
+		adminClient.DELETE("/meta/:type/:itemID/tags/:tag", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			status, err := client.RemoveTag(c.GetString("username"), c.Param("type"), c.Param("itemID"), c.Param("tag"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Tag removed"})
+		})
+
+		adminClient.GET("/folder/:folderID", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			listing, status, err := client.ListFolder(c.GetString("username"), c.Param("folderID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, listing)
+		})
+
+		adminClient.GET("/shared", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			folders, status, err := client.SharedWithMe(c.GetString("username"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"folders": folders})
+		})
+
+		adminClient.GET("/folder/access/:folderID", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			grants, status, err := client.ListFolderAccess(c.GetString("username"), c.Param("folderID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"grants": grants})
+		})
+
+		adminClient.POST("/folder/access/:folderID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data GrantData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if data.Grantee_type == "" {
+				data.Grantee_type = "user"
+			}
+
+			grant, status, err := client.GrantFolderAccess(c.GetString("username"), c.Param("folderID"), data.Grantee_type, data.Grantee, data.Permission)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, grant)
+		})
+
+		adminClient.DELETE("/folder/access/:folderID/:granteeType/:grantee", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			status, err := client.RevokeFolderAccess(c.GetString("username"), c.Param("folderID"), c.Param("granteeType"), c.Param("grantee"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Access revoked"})
+		})
+
+		adminClient.GET("/folder/download/:folderID", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			client.DownloadArchive(c, c.GetString("username"), nil, []string{c.Param("folderID")}, c.Query("format"))
+		})
+
+		adminClient.POST("/archive", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			var data ArchiveData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			client.DownloadArchive(c, c.GetString("username"), data.Files, data.Folders, data.Format)
+		})
+
+		adminClient.DELETE("/folder/:folderID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			status, err := client.TrashFolder(c.GetString("username"), c.Param("folderID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Folder moved to trash"})
+		})
+
+		adminClient.POST("/folder/rename/:folderID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data RenameData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			status, err := client.RenameFolder(c.GetString("username"), c.Param("folderID"), data.Name)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Folder renamed"})
+		})
+
+		adminClient.POST("/folder/move/:folderID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data TargetData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			status, err := client.MoveFolder(c.GetString("username"), c.Param("folderID"), data.Parent_id)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Folder moved"})
+		})
+
+		adminClient.POST("/folder/copy/:folderID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data TargetData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			folder, status, err := client.CopyFolder(c.GetString("username"), c.Param("folderID"), data.Parent_id, data.Name)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusCreated, gin.H{"message": "Folder copied", "folder": folder})
+		})
+
+		adminClient.GET("/file/versions/:fileID", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			versions, status, err := client.ListVersions(c.GetString("username"), c.Param("fileID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"versions": versions})
+		})
+
+		adminClient.POST("/file/restore/:fileID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data RestoreVersionData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			status, err := client.RestoreVersion(c.GetString("username"), c.Param("fileID"), strconv.FormatInt(data.Version_id, 10))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Version restored"})
+		})
+
+		adminClient.POST("/file/rename/:fileID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data RenameData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			status, err := client.RenameFile(c.GetString("username"), c.Param("fileID"), data.Name)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "File renamed"})
+		})
+
+		adminClient.POST("/file/move/:fileID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data TargetData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			status, err := client.MoveFile(c.GetString("username"), c.Param("fileID"), data.Folder_id)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "File moved"})
+		})
+
+		adminClient.POST("/file/copy/:fileID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data TargetData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			file, status, err := client.CopyFile(c.GetString("username"), c.Param("fileID"), data.Folder_id, data.Name)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusCreated, gin.H{"message": "File copied", "file": file})
+		})
+
+		adminClient.GET("/trash", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			entries, status, err := client.ListTrash(c.GetString("username"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"trash": entries})
+		})
+
+		adminClient.POST("/trash/:trashID/restore", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			status, err := client.RestoreTrash(c.GetString("username"), c.Param("trashID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Restored from trash"})
+		})
+
+		adminClient.DELETE("/trash/:trashID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			status, err := client.PurgeTrash(c.GetString("username"), c.Param("trashID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Permanently deleted"})
+		})
+
+		adminClient.DELETE("/trash", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			status, err := client.EmptyTrash(c.GetString("username"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Trash emptied"})
+		})
+
+		adminClient.POST("/share", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			var data ShareData
+			if err := c.ShouldBindJSON(&data); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			share, status, err := client.CreateShare(c.GetString("username"), data.Type, data.Item_id, data.Password, data.Expires_at, data.Max_downloads)
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusCreated, share)
+		})
+
+		adminClient.GET("/shares", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			shares, status, err := client.ListShares(c.GetString("username"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"shares": shares})
+		})
+
+		adminClient.DELETE("/share/:token", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			status, err := client.RevokeShare(c.GetString("username"), c.Param("token"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "Share revoked"})
+		})
+
+		adminClient.GET("/file/view/:fileID", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			client.ViewFile(c) // Pass the Gin context
+		})
+		adminClient.GET("/file/thumb/:fileID", Authorize(auth.PermFilesRead), func(c *gin.Context) {
+			client.ViewThumbnail(c)
+		})
+		adminClient.DELETE("/file/delete/:fileID", Authorize(auth.PermFilesWrite), func(c *gin.Context) {
+			client.DeleteFile(c) // Pass the Gin context
+		})
+	}
+
+	// WebDAV, so clients can mount their files as a network drive. Clients log
+	// in with HTTP Basic auth using their GoStore username and password.
+	davHandler := gin.WrapH(client.DAVHandler("/dav"))
+	for _, method := range []string{"OPTIONS", "GET", "HEAD", "PUT", "DELETE", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "PROPFIND", "PROPPATCH"} {
+		r.Handle(method, "/dav", davHandler)
+		r.Handle(method, "/dav/*path", davHandler)
+	}
+
+	// Public share links, no login required. Password protected shares
+	// expect the password in the Share-Password header.
+	shareRoutes := r.Group("/share")
+	{
+		shareRoutes.GET("/:token", func(c *gin.Context) {
+			info, status, err := client.ViewShare(c.Param("token"), c.GetHeader("Share-Password"), "")
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, info)
+		})
+
+		shareRoutes.GET("/:token/folder/:folderID", func(c *gin.Context) {
+			info, status, err := client.ViewShare(c.Param("token"), c.GetHeader("Share-Password"), c.Param("folderID"))
+			if err != nil {
+				c.JSON(status, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, info)
+		})
+
+		shareRoutes.GET("/:token/download", func(c *gin.Context) {
+			client.DownloadShare(c, c.Param("token"), "")
+		})
+
+		shareRoutes.GET("/:token/file/:fileID", func(c *gin.Context) {
+			client.DownloadShare(c, c.Param("token"), c.Param("fileID"))
 		})
 	}
 
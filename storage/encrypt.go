@@ -0,0 +1,440 @@
+package storage
+
+import (
+	l "GoStore/log"
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted blobs are split into chunks that are sealed separately with
+// AES-256-GCM, so they can be decrypted as a stream and read from any offset.
+// Each chunk's nonce is its index plus a flag marking the last chunk, which is
+// safe because every blob has its own random data key and stops truncated
+// blobs from decrypting as if they were complete.
+const (
+	encChunkSize = 64 * 1024
+	encTagSize   = 16
+	encMagic     = "GSE\x01"
+)
+
+var errDecrypt = errors.New("blob decryption failed")
+
+// keyring holds the master keys that wrap data keys. New data keys are always
+// wrapped with the current key; older keys stay readable until a rekey.
+var keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// InitEncryption loads the master key from ENCRYPTION_KEY or the file named
+// by ENCRYPTION_KEY_FILE. Keys are 32 bytes, given as base64 or hex. Previous
+// master keys listed in ENCRYPTION_OLD_KEYS (comma separated) can still unwrap
+// data keys until the rekey command has moved them to the current key.
+// Without a master key new blobs are stored in plaintext.
+func InitEncryption() error {
+	keyring.current = ""
+	keyring.keys = map[string][]byte{}
+
+	value := os.Getenv("ENCRYPTION_KEY")
+	if path := os.Getenv("ENCRYPTION_KEY_FILE"); value == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Failed to read encryption key file: "+err.Error())
+			return err
+		}
+		value = string(data)
+		if len(data) == 32 {
+			// Raw key bytes
+			value = hex.EncodeToString(data)
+		}
+	}
+
+	for _, old := range strings.Split(os.Getenv("ENCRYPTION_OLD_KEYS"), ",") {
+		if strings.TrimSpace(old) == "" {
+			continue
+		}
+		key, err := parseKey(old)
+		if err != nil {
+			l.LogMessage(l.ERROR, "Invalid ENCRYPTION_OLD_KEYS entry: "+err.Error())
+			return err
+		}
+		keyring.keys[keyID(key)] = key
+	}
+
+	if strings.TrimSpace(value) == "" {
+		if len(keyring.keys) > 0 {
+			l.LogMessage(l.WARNING, "ENCRYPTION_OLD_KEYS is set without a current ENCRYPTION_KEY")
+		}
+		return nil
+	}
+
+	key, err := parseKey(value)
+	if err != nil {
+		l.LogMessage(l.ERROR, "Invalid encryption key: "+err.Error())
+		return err
+	}
+	keyring.current = keyID(key)
+	keyring.keys[keyring.current] = key
+	l.LogMessage(l.INFO, "Blob encryption enabled with key "+keyring.current)
+
+	return nil
+}
+
+func parseKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key must be 32 bytes in base64 or hex")
+}
+
+// keyID identifies a master key without revealing it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// EncryptionEnabled reports whether new blobs are encrypted.
+func EncryptionEnabled() bool {
+	return keyring.current != ""
+}
+
+// CurrentKeyID returns the ID of the master key new data keys are wrapped with.
+func CurrentKeyID() string {
+	return keyring.current
+}
+
+// NewDataKey returns a random key for a single blob.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// DeriveKey returns a key for data derived from a blob, e.g. its thumbnails,
+// so nothing else is ever sealed under the blob's own data key.
+func DeriveKey(dataKey []byte, label string) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapKey seals a data key with the current master key. The blob digest is
+// bound to the wrapped key so it cannot be moved to another blob.
+func WrapKey(dataKey []byte, digest string) (string, string, error) {
+	if !EncryptionEnabled() {
+		return "", "", fmt.Errorf("no encryption key configured")
+	}
+	return wrapKey(keyring.current, dataKey, digest)
+}
+
+func wrapKey(id string, dataKey []byte, digest string) (string, string, error) {
+	gcm, err := newGCM(keyring.keys[id])
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, dataKey, []byte(digest))
+	return id, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// UnwrapKey opens a data key wrapped with the master key id.
+func UnwrapKey(id, wrapped, digest string) ([]byte, error) {
+	master, ok := keyring.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s is not configured", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errDecrypt
+	}
+	dataKey, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(digest))
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return dataKey, nil
+}
+
+// RewrapKey moves a wrapped data key to the current master key. It returns
+// the new key ID and wrapped key, unchanged if it already uses the current key.
+func RewrapKey(id, wrapped, digest string) (string, string, error) {
+	if id == keyring.current {
+		return id, wrapped, nil
+	}
+	dataKey, err := UnwrapKey(id, wrapped, digest)
+	if err != nil {
+		return "", "", err
+	}
+	return WrapKey(dataKey, digest)
+}
+
+// EncryptedSize returns the stored size of a blob of size plaintext bytes.
+func EncryptedSize(size int64) int64 {
+	chunks := max(1, (size+encChunkSize-1)/encChunkSize)
+	return int64(len(encMagic)) + size + chunks*encTagSize
+}
+
+// PlainSize returns the plaintext size of a stored blob of size bytes.
+func PlainSize(size int64) int64 {
+	body := size - int64(len(encMagic))
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + encChunkSize + encTagSize - 1) / (encChunkSize + encTagSize)
+	return max(0, body-chunks*encTagSize)
+}
+
+func chunkNonce(gcm cipher.AEAD, index int64, last bool) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	if last {
+		nonce[3] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+type encryptReader struct {
+	src   *bufio.Reader
+	gcm   cipher.AEAD
+	plain []byte
+	buf   []byte
+	out   []byte // unread part of buf
+	index int64
+	done  bool
+}
+
+// Encrypt returns a reader of the encrypted form of r.
+func Encrypt(r io.Reader, dataKey []byte) (io.Reader, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		src:   bufio.NewReaderSize(r, encChunkSize),
+		gcm:   gcm,
+		plain: make([]byte, encChunkSize),
+		out:   []byte(encMagic),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// The chunk is the last one if nothing follows it
+		last := err != nil
+		if !last {
+			if _, peekErr := e.src.Peek(1); peekErr == io.EOF {
+				last = true
+			} else if peekErr != nil {
+				return 0, peekErr
+			}
+		}
+		e.buf = e.gcm.Seal(e.buf[:0], chunkNonce(e.gcm, e.index, last), e.plain[:n], nil)
+		e.out = e.buf
+		e.index++
+		e.done = last
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+type decryptReader struct {
+	src    io.ReadCloser
+	buf    *bufio.Reader
+	gcm    cipher.AEAD
+	sealed []byte
+	opened []byte
+	plain  []byte // unread part of opened
+	index  int64
+	done   bool
+}
+
+// Decrypt returns a reader of the plaintext of an encrypted blob. If src is
+// an io.ReadSeeker the returned reader is one as well.
+func Decrypt(src io.ReadCloser, dataKey []byte) (io.ReadCloser, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{src: src, gcm: gcm, sealed: make([]byte, encChunkSize+encTagSize)}
+	d.buf = bufio.NewReaderSize(src, encChunkSize+encTagSize)
+	magic := make([]byte, len(encMagic))
+	if _, err := io.ReadFull(d.buf, magic); err != nil || string(magic) != encMagic {
+		return nil, errDecrypt
+	}
+
+	if rs, ok := src.(io.ReadSeeker); ok {
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		s := &seekableDecryptReader{decryptReader: d, rs: rs, plainSize: PlainSize(size)}
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return d, nil
+}
+
+// nextChunk decrypts the chunk at the reader's position. last is known up
+// front when seeking; otherwise it is found by peeking past the chunk.
+func (d *decryptReader) nextChunk(last func() (bool, error)) error {
+	n, err := io.ReadFull(d.buf, d.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errDecrypt
+		}
+		return err
+	}
+	isLast := err == io.ErrUnexpectedEOF
+	if !isLast {
+		if isLast, err = last(); err != nil {
+			return err
+		}
+	}
+
+	d.opened, err = d.gcm.Open(d.opened[:0], chunkNonce(d.gcm, d.index, isLast), d.sealed[:n], nil)
+	if err != nil {
+		return errDecrypt
+	}
+	d.plain = d.opened
+	d.index++
+	d.done = isLast
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		err := d.nextChunk(func() (bool, error) {
+			if _, err := d.buf.Peek(1); err == io.EOF {
+				return true, nil
+			} else if err != nil {
+				return false, err
+			}
+			return false, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+type seekableDecryptReader struct {
+	*decryptReader
+	rs        io.ReadSeeker
+	plainSize int64
+	pos       int64
+}
+
+func (s *seekableDecryptReader) chunks() int64 {
+	return max(1, (s.plainSize+encChunkSize-1)/encChunkSize)
+}
+
+func (s *seekableDecryptReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done || s.index >= s.chunks() {
+			return 0, io.EOF
+		}
+		index := s.index
+		err := s.nextChunk(func() (bool, error) { return index == s.chunks()-1, nil })
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *seekableDecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.plainSize
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+
+	index := offset / encChunkSize
+	_, err := s.rs.Seek(int64(len(encMagic))+index*(encChunkSize+encTagSize), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	s.buf = bufio.NewReaderSize(s.rs, encChunkSize+encTagSize)
+	s.index = index
+	s.plain = nil
+	s.done = false
+	s.pos = offset
+	if offset >= s.plainSize {
+		s.done = true
+		return offset, nil
+	}
+
+	// Skip into the chunk holding the offset
+	if skip := offset - index*encChunkSize; skip > 0 {
+		err := s.nextChunk(func() (bool, error) { return index == s.chunks()-1, nil })
+		if err != nil {
+			return 0, err
+		}
+		s.plain = s.plain[skip:]
+	}
+	return offset, nil
+}
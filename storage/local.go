@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local keeps blobs as plain files in a directory.
+type Local struct {
+	Dir string
+}
+
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+func (s *Local) Put(name string, r io.Reader, size int64) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed upload never leaves a
+	// truncated blob under the final name.
+	tmp, err := os.CreateTemp(s.Dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, name))
+}
+
+// Get returns the open file, which also implements io.ReadSeeker.
+func (s *Local) Get(name string) (io.ReadCloser, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(s.Dir, name))
+}
+
+func (s *Local) Stat(name string) (Info, error) {
+	if err := validName(name); err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(filepath.Join(s.Dir, name))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *Local) Delete(name string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(s.Dir, name))
+}
+
+func (s *Local) List(prefix string) ([]Info, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var infos []Info
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, Info{Name: entry.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testBucket    = "gostore"
+	testRegion    = "us-east-1"
+)
+
+// fakeS3 is an in-memory stand-in for an S3 bucket. It checks the SigV4
+// signature of every request, counting the ones it rejects, and lists at most
+// two keys per page, so that pagination is exercised.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	rejected int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != nil {
+		f.mu.Lock()
+		f.rejected++
+		f.mu.Unlock()
+		http.Error(w, "SignatureDoesNotMatch: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	if bucket != testBucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", `"`+etag(data)+`"`)
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+etag(data)+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		http.Error(w, "list-type=2 expected", http.StatusBadRequest)
+		return
+	}
+
+	var keys []string
+	for key := range f.objects {
+		rest, ok := strings.CutPrefix(key, query.Get("prefix"))
+		// Keys below the delimiter would be common prefixes, which are not
+		// needed here
+		if ok && (query.Get("delimiter") == "" || !strings.Contains(rest, query.Get("delimiter"))) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := min(start+2, len(keys))
+
+	var result listBucketResult
+	for _, key := range keys[start:end] {
+		result.Contents = append(result.Contents, struct {
+			Key          string `xml:"Key"`
+			Size         int64  `xml:"Size"`
+			LastModified string `xml:"LastModified"`
+			ETag         string `xml:"ETag"`
+		}{key, int64(len(f.objects[key])), time.Now().UTC().Format(time.RFC3339), `"` + etag(f.objects[key]) + `"`})
+	}
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verify recomputes the SigV4 signature of a request from its parts, as S3
+// does, and compares it with the one sent.
+func (f *fakeS3) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		k, v, _ := strings.Cut(part, "=")
+		fields[k] = v
+	}
+
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != testAccessKey {
+		return fmt.Errorf("bad credential %q", fields["Credential"])
+	}
+	date, region := credential[1], credential[2]
+	amzDate := r.Header.Get("x-amz-date")
+	if !strings.HasPrefix(amzDate, date) {
+		return fmt.Errorf("x-amz-date %q does not match credential date %q", amzDate, date)
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" +
+		canonicalHeaders.String() + "\n" + fields["SignedHeaders"] + "\n" + r.Header.Get("x-amz-content-sha256")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join(credential[1:], "/")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, stringToSign)); fields["Signature"] != want {
+		return fmt.Errorf("signature %q, want %q", fields["Signature"], want)
+	}
+	return nil
+}
+
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// newTestS3 returns an S3 backend against a MinIO (or other S3) instance when
+// S3_TEST_ENDPOINT, S3_TEST_BUCKET, S3_TEST_ACCESS_KEY and S3_TEST_SECRET_KEY
+// are set, and against an in-memory fake otherwise.
+func newTestS3(t *testing.T, prefix string) *S3 {
+	t.Helper()
+
+	if endpoint := os.Getenv("S3_TEST_ENDPOINT"); endpoint != "" {
+		s, err := NewS3(S3Config{
+			Endpoint:  endpoint,
+			Region:    os.Getenv("S3_TEST_REGION"),
+			Bucket:    os.Getenv("S3_TEST_BUCKET"),
+			AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+			Prefix:    fmt.Sprintf("gostore-test-%d/%s", time.Now().UnixNano(), prefix),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(func() {
+		server.Close()
+		if fake.rejected > 0 {
+			t.Errorf("%d requests had an invalid signature", fake.rejected)
+		}
+	})
+
+	s, err := NewS3(S3Config{
+		Endpoint:  server.URL,
+		Region:    testRegion,
+		Bucket:    testBucket,
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		Prefix:    prefix,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestS3PutGetStatDelete(t *testing.T) {
+	s := newTestS3(t, "blobs/")
+	data := []byte("hello gostore")
+
+	if err := s.Put("abc123", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	rc, err := s.Get("abc123")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get = %q, %v; want %q", got, err, data)
+	}
+
+	info, err := s.Stat("abc123")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Name != "abc123" || info.Size != int64(len(data)) || info.ETag == "" {
+		t.Errorf("Stat = %+v", info)
+	}
+
+	if err := s.Delete("abc123"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get("abc123"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get after Delete: %v, want os.ErrNotExist", err)
+	}
+	if _, err := s.Stat("abc123"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete: %v, want os.ErrNotExist", err)
+	}
+	if err := s.Delete("abc123"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("second Delete: %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestS3PutEmpty(t *testing.T) {
+	s := newTestS3(t, "")
+
+	if err := s.Put("empty", bytes.NewReader(nil), 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := s.Stat("empty")
+	if err != nil || info.Size != 0 {
+		t.Fatalf("Stat = %+v, %v", info, err)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	s := newTestS3(t, "blobs/")
+	for _, name := range []string{"aa1", "aa2", "ab1", "b", "aa3"} {
+		if err := s.Put(name, strings.NewReader(name), int64(len(name))); err != nil {
+			t.Fatalf("Put %s: %v", name, err)
+		}
+	}
+
+	// Keys under another prefix of the same bucket are not part of the store
+	other := *s
+	other.cfg.Prefix = strings.TrimSuffix(s.cfg.Prefix, "blobs/") + "thumbs/"
+	if err := other.Put("aa9", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("Put thumb: %v", err)
+	}
+
+	names := func(prefix string) []string {
+		infos, err := s.List(prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", prefix, err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if got, want := strings.Join(names(""), ","), "aa1,aa2,aa3,ab1,b"; got != want {
+		t.Errorf("List(\"\") = %s, want %s", got, want)
+	}
+	if got, want := strings.Join(names("aa"), ","), "aa1,aa2,aa3"; got != want {
+		t.Errorf("List(\"aa\") = %s, want %s", got, want)
+	}
+	if got := names("zz"); len(got) != 0 {
+		t.Errorf("List(\"zz\") = %v, want nothing", got)
+	}
+}
+
+// TestS3TopLevelPrefix covers buckets that keep blobs at the top level next
+// to the thumbnails prefix.
+func TestS3TopLevelPrefix(t *testing.T) {
+	if os.Getenv("S3_TEST_ENDPOINT") != "" {
+		t.Skip("looks at the whole bucket, only checked against the in-memory fake")
+	}
+	s := newTestS3(t, "")
+	thumbs := *s
+	thumbs.cfg.Prefix += "thumbs/"
+
+	if legacy, err := s.hasTopLevelObjects(); err != nil || legacy {
+		t.Fatalf("hasTopLevelObjects on empty bucket = %v, %v", legacy, err)
+	}
+	if err := thumbs.Put("abc-256", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("Put thumb: %v", err)
+	}
+	if legacy, err := s.hasTopLevelObjects(); err != nil || legacy {
+		t.Fatalf("hasTopLevelObjects with only thumbnails = %v, %v", legacy, err)
+	}
+	if err := s.Put("abc", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if legacy, err := s.hasTopLevelObjects(); err != nil || !legacy {
+		t.Fatalf("hasTopLevelObjects with a blob = %v, %v", legacy, err)
+	}
+
+	infos, err := s.List("")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Name != "abc" {
+		t.Errorf("List = %+v, want only abc", infos)
+	}
+}
+
+func TestS3RejectsInvalidNames(t *testing.T) {
+	s := newTestS3(t, "")
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`} {
+		if err := s.Put(name, strings.NewReader("x"), 1); err == nil {
+			t.Errorf("Put(%q) succeeded", name)
+		}
+	}
+}
+
+func TestS3WrongSecretRejected(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s, err := NewS3(S3Config{Endpoint: server.URL, Bucket: testBucket, AccessKey: testAccessKey, SecretKey: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("abc", strings.NewReader("x"), 1); err == nil {
+		t.Error("Put with the wrong secret succeeded")
+	}
+	if fake.rejected != 1 || len(fake.objects) != 0 {
+		t.Errorf("rejected = %d, objects = %d; want 1, 0", fake.rejected, len(fake.objects))
+	}
+}
+
+// TestS3Signature checks the signature of a fixed request, so that changes to
+// the canonical request are noticed even when client and fake agree.
+func TestS3Signature(t *testing.T) {
+	s, err := NewS3(S3Config{
+		Endpoint:  "https://examplebucket.s3.amazonaws.com",
+		Bucket:    "examplebucket",
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := s.newRequest(http.MethodGet, "test file.txt", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.URL.EscapedPath(), "/examplebucket/test%20file.txt"; got != want {
+		t.Errorf("path = %s, want %s", got, want)
+	}
+
+	s.sign(req, time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC))
+
+	if got := req.Header.Get("x-amz-date"); got != "20130524T000000Z" {
+		t.Errorf("x-amz-date = %s", got)
+	}
+	if got := req.Header.Get("x-amz-content-sha256"); got != "UNSIGNED-PAYLOAD" {
+		t.Errorf("x-amz-content-sha256 = %s", got)
+	}
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+		"Signature=55d1aaf8ca222c9a5c74b53c5ce83bffc4db3e03ab0d81010fe215e374f2ecbc"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %s\nwant %s", got, want)
+	}
+
+	req.Host = req.URL.Host
+	if err := (&fakeS3{}).verify(req); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
+
+func TestS3CanonicalQuery(t *testing.T) {
+	query := map[string][]string{
+		"prefix":             {"a b/c"},
+		"list-type":          {"2"},
+		"continuation-token": {"x+y="},
+	}
+	got := s3CanonicalQuery(query)
+	want := "continuation-token=x%2By%3D&list-type=2&prefix=a%20b%2Fc"
+	if got != want {
+		t.Errorf("s3CanonicalQuery = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	l "GoStore/log"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Info describes a stored blob.
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
+// Backend stores file contents under the hashed names kept in the files table.
+// Missing blobs are reported with errors satisfying errors.Is(err, os.ErrNotExist).
+type Backend interface {
+	Put(name string, r io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	Stat(name string) (Info, error)
+	Delete(name string) error
+	List(prefix string) ([]Info, error)
+}
+
+// Key prefix of blobs in an S3 bucket when S3_PREFIX is not set.
+const defaultS3Prefix = "blobs/"
+
+// Store is the backend selected by InitStorage. It defaults to the local
+// uploads directory so packages can use it before configuration is loaded.
+var Store Backend = NewLocal("uploads")
+
+// Thumbs holds generated previews, kept apart from the blobs so they never
+// show up as stray content in Store.
+var Thumbs Backend = NewLocal(filepath.Join("uploads", "thumbs"))
+
+// InitStorage selects the storage backend from the STORAGE_BACKEND env value.
+func InitStorage() error {
+	switch strings.ToLower(os.Getenv("STORAGE_BACKEND")) {
+	case "", "local":
+		dir := os.Getenv("STORAGE_PATH")
+		if dir == "" {
+			dir = "uploads"
+		}
+		Store = NewLocal(dir)
+		Thumbs = NewLocal(filepath.Join(dir, "thumbs"))
+		l.LogMessage(l.INFO, "Storage backend: local ("+dir+")")
+	case "s3":
+		// Blobs and thumbnails get a prefix each, so that listing the blobs
+		// never returns thumbnails.
+		prefix, ok := os.LookupEnv("S3_PREFIX")
+		if !ok {
+			prefix = defaultS3Prefix
+		}
+		cfg := S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Prefix:    prefix,
+		}
+		backend, err := NewS3(cfg)
+		if err != nil {
+			l.LogMessage(l.ERROR, "S3 storage configuration failed: "+err.Error())
+			return err
+		}
+
+		// Buckets written before blobs had a prefix keep them at the top level
+		if !ok {
+			legacy, err := backend.hasTopLevelObjects()
+			if err != nil {
+				l.LogMessage(l.ERROR, "S3 storage check failed: "+err.Error())
+				return err
+			}
+			if legacy {
+				backend.cfg.Prefix = ""
+				l.LogMessage(l.WARNING, "S3 bucket keeps blobs at the top level; set S3_PREFIX to \"\" to silence this warning")
+			}
+		}
+
+		cfg.Prefix = "thumbs/"
+		thumbs, err := NewS3(cfg)
+		if err != nil {
+			l.LogMessage(l.ERROR, "S3 storage configuration failed: "+err.Error())
+			return err
+		}
+		Store = backend
+		Thumbs = thumbs
+		l.LogMessage(l.INFO, "Storage backend: s3 ("+backend.cfg.Endpoint+"/"+backend.cfg.Bucket+")")
+	default:
+		err := fmt.Errorf("unknown STORAGE_BACKEND %q", os.Getenv("STORAGE_BACKEND"))
+		l.LogMessage(l.ERROR, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// validName rejects names that could escape the storage root.
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid blob name %q", name)
+	}
+	return nil
+}